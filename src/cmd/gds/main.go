@@ -182,6 +182,9 @@ func main() {
 	}
 	app.Commands = []cli.Command{
 		NewSyncCommand(),
+		NewRestoreCommand(),
+		NewVerifyCommand(),
+		NewRebuildCommand(),
 	}
 	// If a panic occurrs while termui session is active, the panic output is unreadable.
 	GDS_CLI_APP = app
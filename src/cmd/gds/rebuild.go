@@ -0,0 +1,101 @@
+package main
+
+import (
+	"core"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"github.com/demizer/go-humanize"
+)
+
+func NewRebuildCommand() cli.Command {
+	return cli.Command{
+		Name:  "rebuild",
+		Usage: "Rebuild lost devices from the other devices and the parity devices using a sync context",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "sync-context,s",
+				Usage: "Path to the sync context file saved by a sync (sync_context_*.json.gz or context_*.json).",
+			},
+			cli.StringSliceFlag{
+				Name:  "device,d",
+				Value: &cli.StringSlice{},
+				Usage: "The name of a lost device. The replacement device must be mounted at the mount point of the lost device.",
+			},
+		},
+		Action: func(c *cli.Context) {
+			commandInit(c)
+			if !rebuildStart(c) {
+				os.Exit(1)
+			}
+		},
+	}
+}
+
+// ensureReplacementIsReady checks that the mount point of the lost device d is writable. The replacement device has a new
+// UUID, so it is not checked.
+func ensureReplacementIsReady(d *core.Device) error {
+	tFile := filepath.Join(d.MountPoint, "test")
+	if _, err := os.Create(tFile); err != nil {
+		log.Errorf("ensureReplacementIsReady: Could not create test file, got: %s", err)
+		return deviceTestPermissionDeniedError{d.Name}
+	}
+	return os.Remove(tFile)
+}
+
+// rebuildStart rebuilds the lost devices and returns false if the rebuild failed.
+func rebuildStart(c *cli.Context) bool {
+	log.WithFields(logrus.Fields{
+		"version": 0.2,
+		"date":    time.Now().Format(time.RFC3339),
+	}).Infoln("Generic Device Storage")
+
+	names := c.StringSlice("device")
+	if len(names) == 0 {
+		panic(fatalShowHelp{"No device to rebuild specified!"})
+	}
+	c2 := loadSyncContext(c)
+	lost := make(map[string]bool)
+	for _, n := range names {
+		if _, err := c2.Devices.DeviceByName(n); err != nil {
+			panic(fatal{fmt.Sprintf("Device %q is not in the sync context", n)})
+		}
+		lost[n] = true
+	}
+
+	// Every device is read or written during the rebuild
+	for _, d := range c2.Devices {
+		var err error
+		if lost[d.Name] {
+			err = ensureReplacementIsReady(d)
+		} else {
+			err = ensureDeviceIsMounted(d)
+		}
+		if err != nil {
+			panic(fatal{err})
+		}
+	}
+
+	r, err := core.Rebuild(c2, names)
+	if err != nil {
+		log.Errorf("Rebuild error: %s", err)
+		return false
+	}
+	fmt.Printf("Rebuilt %d devices: %d files (%s written)\n", len(r.Devices), r.Files, humanize.IBytes(r.Bytes))
+	for _, n := range r.Devices {
+		fmt.Printf("    %s: update the UUID of the device in the configuration to the UUID of the replacement\n", n)
+	}
+	for _, err := range r.Errors {
+		fmt.Printf("    %s\n", err)
+	}
+	if r.Failed() {
+		log.Error("Rebuild failed!")
+		return false
+	}
+	log.Info("ALL DONE -- Rebuild complete!")
+	return true
+}
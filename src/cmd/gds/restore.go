@@ -0,0 +1,129 @@
+package main
+
+import (
+	"conui"
+	"core"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"github.com/demizer/go-humanize"
+)
+
+func NewRestoreCommand() cli.Command {
+	return cli.Command{
+		Name:  "restore",
+		Usage: "Restore files from devices using a sync context",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "sync-context,s",
+				Usage: "Path to the sync context file saved by a sync (sync_context_*.json.gz or context_*.json).",
+			},
+			cli.StringFlag{
+				Name:  "target,t",
+				Usage: "Restore files to this directory.",
+			},
+			cli.StringFlag{
+				Name: "match,m",
+				Usage: "Only restore files with a path matching the glob pattern, i.e. 'photos/2015/**'. " +
+					"The path is the path of the file in the target directory, it starts with the base directory of " +
+					"a backup path without a trailing \"/\".",
+			},
+		},
+		Action: func(c *cli.Context) {
+			commandInit(c)
+			restoreStart(c)
+		},
+	}
+}
+
+// loadSyncContext loads the sync context given with the "sync-context" argument.
+func loadSyncContext(c *cli.Context) *core.Context {
+	if c.String("sync-context") == "" {
+		panic(fatalShowHelp{"No sync context specified!"})
+	}
+	sPath := cleanPath(c.String("sync-context"))
+	log.WithFields(logrus.Fields{"path": sPath}).Info("Using sync context file")
+	c2, err := core.SyncContextFromPath(sPath)
+	if err != nil {
+		panic(fatal{fmt.Sprintf("Error loading sync context: %s", err.Error())})
+	}
+	return c2
+}
+
+// printRestoreDevices prints the devices that need to be mounted to restore the files in fi.
+func printRestoreDevices(c2 *core.Context, fi core.FileIndex, devices []int) {
+	fmt.Printf("%d files (%s) need %d of %d devices:\n\n", len(fi), humanize.IBytes(fi.TotalSizeFiles()),
+		len(devices), len(c2.Devices))
+	for _, x := range devices {
+		d := c2.Devices[x]
+		fmt.Printf("    %-20s mountPoint: %s UUID: %s\n", d.Name, d.MountPoint, d.UUID)
+	}
+	for _, f := range fi {
+		if dfs := f.CopyDestFiles(0); len(dfs) > 1 {
+			var names []string
+			for _, df := range dfs {
+				names = append(names, df.DeviceName)
+			}
+			fmt.Printf("\nSplit file %q needs: %s", f.Path, strings.Join(names, ", "))
+		}
+	}
+	if others := len(c2.FileDevices(fi)) - len(devices); others > 0 {
+		fmt.Printf("\n%d other devices hold copies of the files and are requested if a file is damaged.", others)
+	}
+	fmt.Println()
+	log.WithFields(logrus.Fields{"files": len(fi), "devices": devices}).Info("Devices needed for restore")
+}
+
+func restoreStart(c *cli.Context) {
+	defer cleanupAtExit()
+
+	log.WithFields(logrus.Fields{
+		"version": 0.2,
+		"date":    time.Now().Format(time.RFC3339),
+	}).Infoln("Generic Device Storage")
+
+	if c.String("target") == "" {
+		panic(fatalShowHelp{"No restore target specified!"})
+	}
+	target := cleanPath(c.String("target"))
+	c2 := loadSyncContext(c)
+
+	fi := c2.FileIndex
+	if c.String("match") != "" {
+		var err error
+		fi, err = c2.MatchFiles(c.String("match"))
+		if err != nil {
+			panic(fatal{err})
+		}
+		if len(fi) == 0 {
+			panic(fatal{fmt.Sprintf("No files match %q", c.String("match"))})
+		}
+	}
+	printRestoreDevices(c2, fi, c2.RestoreDevices(fi))
+
+	conui.Init()
+	go eventHandler(c2)
+
+	InitPanelUI(c2, fi)
+	// The devices holding the other copies of the files are requested if a destination file is damaged
+	progressUpdater(c2, c2.FileDevices(fi), ensureDeviceIsMounted)
+
+	go func() {
+		core.Restore(c2, fi, target)
+		log.Info("ALL DONE -- Restore complete!")
+	}()
+
+	// Give the user time to review the restore in the UI
+outer:
+	for {
+		select {
+		case err := <-c2.Errors:
+			log.Errorf("Restore error: %s", err)
+		case <-exit:
+			break outer
+		}
+	}
+}
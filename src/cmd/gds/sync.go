@@ -7,44 +7,78 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/codegangsta/cli"
+	"github.com/demizer/go-humanize"
 	"github.com/nsf/termbox-go"
 )
 
 // When set to true all the go routines exit
 var exit = make(chan bool)
 
+// The journal of a sync is saved next to the context file with this extension
+const journalExt = ".journal"
+
 func NewSyncCommand() cli.Command {
 	return cli.Command{
 		Name:  "sync",
 		Usage: "Synchronize files to devices",
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "resume,r",
+				Usage: "Resume the last interrupted sync. Files that were copied completely are not copied again.",
+			},
+			cli.BoolFlag{
+				Name:  "rehash",
+				Usage: "Hash every source file, even if the sum saved in the hash cache is still valid.",
+			},
+			cli.BoolFlag{
+				Name:  "single-pass",
+				Usage: "Compute the sums of the source files while copying instead of hashing them before the sync.",
+			},
+			cli.StringFlag{
+				Name:  "explain",
+				Usage: "Show the include or exclude rule that decides if PATH is synced, then exit.",
+			},
+		},
 		Action: func(c *cli.Context) {
-			err := checkEnvVariables(c)
-			if err != nil {
-				panic(fatal{fmt.Sprintf("Could not set environment variables: %s", err)})
-			}
-			if !c.GlobalBool("no-file-log") {
-				lp := cleanPath(c.GlobalString("log"))
-				var err error
-				GDS_LOG_FD, err = os.Create(lp)
-				if err != nil {
-					panic(fatal{fmt.Sprintf("Could not create log file: %s", err)})
-				}
-				log.Out = GDS_LOG_FD
-			}
-			lvl, err := logrus.ParseLevel(c.GlobalString("log-level"))
-			if err != nil {
-				panic(fatalShowHelp{fmt.Sprintf("Error parsing log level: %s", err)})
+			commandInit(c)
+			if c.String("explain") != "" {
+				explain(c)
+				return
 			}
-			log.Level = lvl
 			syncStart(c)
 		},
 	}
 }
 
+// commandInit sets the environment variables and the log output used by all commands.
+func commandInit(c *cli.Context) {
+	err := checkEnvVariables(c)
+	if err != nil {
+		panic(fatal{fmt.Sprintf("Could not set environment variables: %s", err)})
+	}
+	if !c.GlobalBool("no-file-log") {
+		lp := cleanPath(c.GlobalString("log"))
+		var err error
+		GDS_LOG_FD, err = os.Create(lp)
+		if err != nil {
+			panic(fatal{fmt.Sprintf("Could not create log file: %s", err)})
+		}
+		log.Out = GDS_LOG_FD
+	}
+	lvl, err := logrus.ParseLevel(c.GlobalString("log-level"))
+	if err != nil {
+		panic(fatalShowHelp{fmt.Sprintf("Error parsing log level: %s", err)})
+	}
+	log.Level = lvl
+}
+
 // loadInitialState prepares the applicaton for usage
 func loadInitialState(c *cli.Context) *core.Context {
 	cPath, err := getConfigFile(c.GlobalString("config"))
@@ -61,11 +95,37 @@ func loadInitialState(c *cli.Context) *core.Context {
 	return c2
 }
 
-func dumpContextToFile(c *cli.Context, c2 *core.Context) {
+// explain prints the include or exclude rule that decides if the path given with --explain is synced.
+func explain(c *cli.Context) {
+	cPath, err := getConfigFile(c.GlobalString("config"))
+	if err != nil {
+		panic(fatal{err})
+	}
+	c2, err := core.ConfigFromPath(cPath)
+	if err != nil {
+		panic(fatal{fmt.Sprintf("Error loading config: %s", err.Error())})
+	}
+	p, err := filepath.Abs(cleanPath(c.String("explain")))
+	if err != nil {
+		panic(fatal{err})
+	}
+	e, err := c2.Explain(p)
+	if err != nil {
+		panic(fatal{err})
+	}
+	fmt.Println(e)
+}
+
+// contextFile returns the path of the context JSON output file.
+func contextFile(c *cli.Context) string {
 	cf, err := getContextFile(c.GlobalString("context"))
 	if err != nil {
 		panic(fatal{fmt.Sprintf("Could not create context JSON output file: %s", err.Error())})
 	}
+	return cf
+}
+
+func dumpContextToFile(cf string, c2 *core.Context) {
 	j, err := json.Marshal(c2)
 	if err == nil {
 		err = ioutil.WriteFile(cf, j, 0644)
@@ -75,9 +135,9 @@ func dumpContextToFile(c *cli.Context, c2 *core.Context) {
 	}
 }
 
-// InitPanelUI creates the UI widgets First is the main progress guage for the overall progress Widgets are then created for
-// each of the devices, but are hidden initially.
-func InitPanelUI(c *core.Context) {
+// InitPanelUI creates the UI widgets First is the main progress guage for the overall progress of the files in fi, labeled
+// with the space saved by deduplication. Widgets are then created for each of the devices, but are hidden initially.
+func InitPanelUI(c *core.Context, fi core.FileIndex) {
 	visible := c.OutputStreamNum
 	for x, y := range c.Devices {
 		conui.Body.DevicePanels = append(conui.Body.DevicePanels, conui.NewDevicePanel(y.Name, y.SizeTotal))
@@ -90,7 +150,12 @@ func InitPanelUI(c *core.Context) {
 			visible--
 		}
 	}
-	conui.Body.ProgressPanel = conui.NewProgressGauge(c.FileIndex.TotalSize())
+	conui.Body.ProgressPanel = conui.NewProgressGauge(fi.TotalSize())
+	if dups := c.FileIndex.Duplicates(); len(dups) > 0 {
+		// Shown before the sync starts
+		conui.Body.ProgressPanel.Border.Label = fmt.Sprintf("%d duplicates stored once, saving %s", len(dups),
+			humanize.IBytes(c.DedupSize()))
+	}
 	conui.Body.ProgressPanel.SetVisible(true)
 	conui.Layout()
 }
@@ -152,8 +217,8 @@ func eventHandler(c *core.Context) {
 	}
 }
 
-// deviceMountHandler checks to see if the device is mounted and writable. Meant to be run as a goroutine.
-func deviceMountHandler(c *core.Context, deviceIndex int) {
+// deviceMountHandler checks to see if the device is ready using check. Meant to be run as a goroutine.
+func deviceMountHandler(c *core.Context, deviceIndex int, check func(*core.Device) error) {
 	// Listen on the channel for a mount request
 	ns := time.Now()
 	log.Debugf("Waiting for receive on SyncDeviceMount[%d]", deviceIndex)
@@ -169,7 +234,7 @@ func deviceMountHandler(c *core.Context, deviceIndex int) {
 
 	checkDevice := func(p *conui.PromptAction, keyEvent bool, mesgChan chan string) (err error) {
 		// The actual checking
-		err = ensureDeviceIsReady(d)
+		err = check(d)
 		if err != nil {
 			log.Errorf("checkDevice error: %s", err)
 			switch err.(type) {
@@ -227,7 +292,9 @@ func deviceMountHandler(c *core.Context, deviceIndex int) {
 	c.SyncDeviceMount[deviceIndex] <- true
 }
 
-func progressUpdater(c *core.Context) {
+// progressUpdater updates the progress panels. The devices in the devices index list are requested for mounting and checked
+// with check.
+func progressUpdater(c *core.Context, devices []int, check func(*core.Device) error) {
 	// Main progress panel updater
 	go func() {
 		for {
@@ -245,9 +312,9 @@ func progressUpdater(c *core.Context) {
 		}
 	}()
 	// Device panel updaters
-	for x := 0; x < c.DevicesUsed; x++ {
-		go deviceMountHandler(c, x)
+	for _, x := range devices {
 		c.SyncDeviceMount[x] = make(chan bool)
+		go deviceMountHandler(c, x, check)
 		go func(index int) {
 			dw := conui.Body.DevicePanelByIndex(index)
 		outer:
@@ -279,17 +346,20 @@ func progressUpdater(c *core.Context) {
 	}
 }
 
-func calcFileIndexHashes(c *core.Context) {
-	h := core.NewSourceFileHashComputer(c.FileIndex, c.Errors)
-	conui.Body.HashingProgressGauge = conui.NewHashingProgressGauge(c.FileIndex.TotalSizeFiles())
+// hashingProgressUpdater shows the progress of the hash computations received on reports in the hashing dialog. The returned
+// channel is closed once reports is closed.
+func hashingProgressUpdater(c *core.Context, reports <-chan core.HashFile, sizeTotal uint64) chan bool {
+	conui.Body.HashingProgressGauge = conui.NewHashingProgressGauge(sizeTotal)
 	conui.Body.HashingProgressGauge.SetVisible(true)
+	conui.Body.HashingDialog = conui.NewHashingDialog(8, 2)
+	done := make(chan bool)
 	go func() {
-		conui.Body.HashingDialog = conui.NewHashingDialog(8, 2)
+		defer close(done)
 		bars := make(map[string]*conui.HashingProgressBar)
-		bps := core.NewBytesPerSecond(c.FileIndex.TotalSize())
+		bps := core.NewBytesPerSecond(sizeTotal)
 		for {
 			select {
-			case hf, ok := <-h.Reports:
+			case hf, ok := <-reports:
 				if !ok {
 					return
 				}
@@ -299,11 +369,11 @@ func calcFileIndexHashes(c *core.Context) {
 				if hf.SizeWritn == hf.SizeTotal {
 					log.WithFields(logrus.Fields{"filePath": hf.FilePath,
 						"bytesWritnLast": hf.SizeWritnLast, "size": hf.SizeTotal,
-					}).Debugln("calcFileIndexHashes: RECEIVED: FILE WRITE COMPLETE")
+					}).Debugln("hashingProgressUpdater: RECEIVED: FILE WRITE COMPLETE")
 				} else {
 					log.WithFields(logrus.Fields{"filePath": hf.FilePath,
 						"bytesWritnLast": hf.SizeWritnLast, "size": hf.SizeTotal,
-					}).Debugln("calcFileIndexHashes: RECEIVED")
+					}).Debugln("hashingProgressUpdater: RECEIVED")
 				}
 				if val, ok := bars[hf.FilePath]; ok {
 					val.BytesPerSecond = hf.BytesPerSecond.Calc()
@@ -326,22 +396,102 @@ func calcFileIndexHashes(c *core.Context) {
 				conui.Body.HashingDialog.SortBars()
 				if conui.Body.HashingProgressGauge.SizeWritn == conui.Body.HashingProgressGauge.SizeTotal {
 					conui.Body.HashingProgressGauge.BytesPerSecond = bps.CalcFull()
-					time.Sleep(time.Second * 6)
-					c.Done <- true
 				}
+			case <-c.Done:
+				return
+			}
+		}
+	}()
+	return done
+}
+
+// loadHashCache loads the hash cache from the configuration directory. If rehash is true, the saved cache is not used and
+// all source files are hashed again.
+func loadHashCache(rehash bool) *core.HashCache {
+	p := filepath.Join(GDS_CONFIG_DIR, core.HashCacheFileName)
+	if rehash {
+		log.WithFields(logrus.Fields{"path": p}).Info("Ignoring the hash cache")
+		return core.NewHashCache(p)
+	}
+	hc, err := core.HashCacheFromPath(p)
+	if err != nil {
+		// The files are hashed again and the cache is replaced
+		log.WithFields(logrus.Fields{"path": p}).Warnf("Could not load the hash cache: %s", err)
+		return core.NewHashCache(p)
+	}
+	return hc
+}
+
+// calcFileIndexHashes computes the sums of the source files. Files with a valid entry in the hash cache are not hashed
+// unless rehash is true. The hash cache is updated with the new sums.
+func calcFileIndexHashes(c *core.Context, rehash bool) {
+	hc := loadHashCache(rehash)
+	h := core.NewSourceFileHashComputer(c.HashAlgorithm, c.FileIndex, hc, c.Errors)
+	var size uint64
+	for _, f := range h.Files {
+		size += f.SizeTotal
+	}
+	done := hashingProgressUpdater(c, h.Reports, size)
+	go func() {
+		for {
+			select {
 			case err := <-c.Errors:
 				log.Error(err)
-			case <-c.Done:
+			case <-done:
 				return
 			}
 		}
 	}()
 	h.ComputeAll(c.Done)
+	<-done
+	hc.Update(c.HashAlgorithm, c.FileIndex)
+	if err := hc.Save(); err != nil {
+		log.Errorf("Could not save the hash cache: %s", err)
+	}
 	conui.Body.HashingProgressGauge.SetVisible(false)
 	conui.Body.HashingDialog.SetVisible(false)
 	conui.Body.HashingDialog.Bars = nil
 }
 
+// dedupFiles catalogs the file index again with the sums of the hashing phase so files with the same content are stored
+// once, and logs the space saved. The sync fails if the device pool is too small for the deduplicated files. The space
+// saved is shown on the progress panel before the sync starts.
+func dedupFiles(c *core.Context) {
+	if !c.Dedup {
+		return
+	}
+	saved, err := c.DedupFiles()
+	if err != nil {
+		panic(fatal{fmt.Sprintf("Could not deduplicate files: %s", err.Error())})
+	}
+	log.WithFields(logrus.Fields{
+		"duplicates": len(c.FileIndex.Duplicates()), "saved": humanize.IBytes(saved),
+	}).Info("Files with the same content are stored once")
+}
+
+// loadResumeState loads the context and the journal of the last interrupted sync. The context file of the interrupted sync
+// is returned with the context.
+func loadResumeState() (*core.Context, string) {
+	journals, err := filepath.Glob(filepath.Join(GDS_CONFIG_DIR, "context_*.json"+journalExt))
+	if err != nil || len(journals) == 0 {
+		panic(fatal{fmt.Sprintf("No interrupted sync found in %q", GDS_CONFIG_DIR)})
+	}
+	sort.Strings(journals)
+	jp := journals[len(journals)-1]
+	cf := strings.TrimSuffix(jp, journalExt)
+	log.WithFields(logrus.Fields{"context": cf, "journal": jp}).Info("Resuming interrupted sync")
+	c2, err := core.SyncContextFromPath(cf)
+	if err != nil {
+		panic(fatal{fmt.Sprintf("Error loading sync context: %s", err.Error())})
+	}
+	entries, err := core.ReadJournal(jp)
+	if err != nil {
+		panic(fatal{fmt.Sprintf("Error loading journal: %s", err.Error())})
+	}
+	c2.Resume(entries)
+	return c2, cf
+}
+
 func syncStart(c *cli.Context) {
 	defer cleanupAtExit()
 
@@ -350,15 +500,46 @@ func syncStart(c *cli.Context) {
 		"date":    time.Now().Format(time.RFC3339),
 	}).Infoln("Generic Device Storage")
 
-	c2 := loadInitialState(c)
+	var c2 *core.Context
+	var cf string
+	if c.Bool("resume") {
+		c2, cf = loadResumeState()
+	} else {
+		c2 = loadInitialState(c)
+		cf = contextFile(c)
+	}
 
 	conui.Init()
 	go eventHandler(c2)
 
-	calcFileIndexHashes(c2)
+	if c.Bool("single-pass") {
+		c2.SinglePass = true
+	}
+	if !c.Bool("resume") && !c2.SinglePass {
+		// The sums of the resumed sync are in the context. In single-pass mode, the sums are computed by the sync.
+		calcFileIndexHashes(c2, c.Bool("rehash"))
+		dedupFiles(c2)
+	} else if !c.Bool("resume") && c2.Dedup {
+		log.Warnln("Deduplication needs the sums of the hashing phase, files are not deduplicated in single-pass mode")
+		// The device pool is checked again without deduplication
+		dedupFiles(c2)
+	}
+	if !c.Bool("resume") {
+		// The context is saved before syncing so an interrupted sync can be resumed
+		dumpContextToFile(cf, c2)
+	}
+	journal, err := core.NewJournal(cf + journalExt)
+	if err != nil {
+		panic(fatal{fmt.Sprintf("Could not open journal: %s", err.Error())})
+	}
+	c2.Journal = journal
 
-	InitPanelUI(c2)
-	progressUpdater(c2)
+	InitPanelUI(c2, c2.ChangedFiles())
+	var devices []int
+	for x := 0; x < c2.DevicesUsed; x++ {
+		devices = append(devices, x)
+	}
+	progressUpdater(c2, devices, ensureDeviceIsReady)
 
 	// log.Debugln(spd.Sdump(c2.FileIndex))
 	// conui.Close()
@@ -369,7 +550,11 @@ func syncStart(c *cli.Context) {
 		core.Sync(c2, c.GlobalBool("no-dev-context"))
 		log.Info("ALL DONE -- Sync complete!")
 		// Fin
-		dumpContextToFile(c, c2)
+		dumpContextToFile(cf, c2)
+		// Nothing left to resume
+		if err := journal.Remove(); err != nil {
+			log.Errorf("Could not remove journal: %s", err)
+		}
 		// c2.Exit = true
 	}()
 
@@ -383,4 +568,29 @@ outer:
 			break outer
 		}
 	}
+	printSyncReport(c2)
+}
+
+// printSyncReport prints the space saved by deduplication, the directories that had to be spread across devices and the
+// source files that changed every time they were copied. The destination files of unstable files might not match the
+// source files.
+func printSyncReport(c *core.Context) {
+	if dups := c.FileIndex.Duplicates(); len(dups) > 0 {
+		fmt.Printf("%d files are duplicates of other files and are stored once, saving %s\n", len(dups),
+			humanize.IBytes(c.DedupSize()))
+	}
+	if len(c.SpreadDirectories) > 0 {
+		fmt.Printf("%d directories did not fit on one device and are spread across devices:\n", len(c.SpreadDirectories))
+		for _, d := range c.SpreadDirectories {
+			fmt.Printf("    %s\n", d)
+		}
+	}
+	files := c.UnstableFiles()
+	if len(files) == 0 {
+		return
+	}
+	fmt.Printf("%d files changed while they were copied and are flagged as unstable:\n", len(files))
+	for _, f := range files {
+		fmt.Printf("    %s\n", f.Path)
+	}
 }
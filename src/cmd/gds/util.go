@@ -122,3 +122,18 @@ func ensureDeviceIsReady(d *core.Device) error {
 	}
 	return err
 }
+
+// ensureDeviceIsMounted checks if the device d is mounted. Unlike ensureDeviceIsReady, the device is not required to be
+// writable.
+func ensureDeviceIsMounted(d *core.Device) error {
+	m, err := deviceIsMountedByUUID(d.MountPoint, d.UUID)
+	if err != nil {
+		log.Errorf("ensureDeviceIsMounted: deviceIsMountedByUUID returned error: %s", err)
+		return err
+	}
+	if !m {
+		log.Errorf("ensureDeviceIsMounted: Check for device %q mounted at %q != UUID=%s", d.Name, d.MountPoint, d.UUID)
+		return deviceNotFoundByUUIDError{d.Name, d.UUID}
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"conui"
+	"core"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+)
+
+func NewVerifyCommand() cli.Command {
+	return cli.Command{
+		Name:  "verify",
+		Usage: "Verify the files stored on devices using a sync context",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "sync-context,s",
+				Usage: "Path to the sync context file saved by a sync (sync_context_*.json.gz or context_*.json).",
+			},
+			cli.BoolFlag{
+				Name:  "source",
+				Usage: "Compare the files on the devices to the source files instead of the sums in the sync context.",
+			},
+			cli.StringSliceFlag{
+				Name:  "sums,sha1sums",
+				Value: &cli.StringSlice{},
+				Usage: "Verify a mounted device using its checksum file (SHA1SUMS, SHA256SUMS, SHA512SUMS or B2SUMS), or the file in the mount point. No sync context is needed.",
+			},
+		},
+		Action: func(c *cli.Context) {
+			commandInit(c)
+			verify := verifyStart
+			if len(c.StringSlice("sums")) > 0 {
+				verify = verifySumsStart
+			}
+			if !verify(c) {
+				os.Exit(1)
+			}
+		},
+	}
+}
+
+// printVerifyReport prints the results of the verify for each device.
+func printVerifyReport(reports []*core.VerifyDeviceReport) {
+	for _, r := range reports {
+		status := "OK"
+		if r.Failed() {
+			status = "FAILED"
+		}
+		fmt.Printf("%-20s %-6s checked: %d missing: %d truncated: %d mismatched: %d drifted: %d\n", r.DeviceName,
+			status, r.Checked, r.Missing, r.Truncated, r.Mismatched, r.Drifted)
+		for _, err := range r.Errors {
+			fmt.Printf("    %s\n", err)
+		}
+		for _, d := range r.Drifts {
+			fmt.Printf("    %s\n", d)
+		}
+	}
+}
+
+// printDamagedFiles prints the files with damaged destination files that can be restored from another copy, and the files
+// that are lost.
+func printDamagedFiles(v *core.Verifier) {
+	recoverable, lost := v.DamagedFiles()
+	if len(recoverable) > 0 {
+		fmt.Printf("\n%d damaged files can be restored from another copy:\n", len(recoverable))
+		for _, f := range recoverable {
+			fmt.Printf("    %s\n", f.Path)
+		}
+	}
+	if len(lost) > 0 {
+		fmt.Printf("\n%d damaged files have no good copy:\n", len(lost))
+		for _, f := range lost {
+			fmt.Printf("    %s\n", f.Path)
+		}
+	}
+}
+
+// verifyStart verifies the devices of the sync context and returns false if verification failed.
+func verifyStart(c *cli.Context) bool {
+	defer cleanupAtExit()
+
+	log.WithFields(logrus.Fields{
+		"version": 0.2,
+		"date":    time.Now().Format(time.RFC3339),
+	}).Infoln("Generic Device Storage")
+
+	c2 := loadSyncContext(c)
+	devices := c2.FileDevices(c2.FileIndex)
+	v := core.NewVerifier(c2, c.Bool("source"))
+
+	conui.Init()
+	go eventHandler(c2)
+
+	for _, y := range c2.Devices {
+		conui.Body.DevicePanels = append(conui.Body.DevicePanels, conui.NewDevicePanel(y.Name, y.SizeTotal))
+	}
+	for _, x := range devices {
+		c2.SyncDeviceMount[x] = make(chan bool)
+		go deviceMountHandler(c2, x, ensureDeviceIsMounted)
+	}
+	hashDone := hashingProgressUpdater(c2, v.Reports, v.SizeTotal())
+	conui.Layout()
+
+	verifyDone := make(chan bool)
+	go func() {
+		v.Run()
+		<-hashDone
+		close(verifyDone)
+	}()
+
+outer:
+	for {
+		select {
+		case err := <-c2.Errors:
+			log.Errorf("Verify error: %s", err)
+		case <-verifyDone:
+			break outer
+		case <-exit:
+			return false
+		}
+	}
+
+	conui.Close()
+	printVerifyReport(v.Devices)
+	printDamagedFiles(v)
+	if v.Failed() {
+		log.Error("Verify failed!")
+		return false
+	}
+	log.Info("ALL DONE -- Verify complete!")
+	return true
+}
+
+// verifySumsStart verifies the files listed in the checksum files written to the devices by a sync and returns false if
+// verification failed.
+func verifySumsStart(c *cli.Context) bool {
+	var reports []*core.VerifyDeviceReport
+	var failed bool
+	for _, p := range c.StringSlice("sums") {
+		p = cleanPath(p)
+		if fi, err := os.Stat(p); err == nil && fi.IsDir() {
+			// The mount point of the device
+			p = core.FindSumsFile(p)
+		}
+		log.WithFields(logrus.Fields{"path": p}).Info("Verifying checksum file")
+		r, err := core.VerifySums(p)
+		if err != nil {
+			log.Errorf("Verify error: %s", err)
+			failed = true
+			continue
+		}
+		failed = failed || r.Failed()
+		reports = append(reports, r)
+	}
+	printVerifyReport(reports)
+	if failed {
+		log.Error("Verify failed!")
+		return false
+	}
+	log.Info("ALL DONE -- Verify complete!")
+	return true
+}
@@ -0,0 +1,88 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// backupPathsContext returns a context created from a configuration with the freebooks and symlinks test data as backup
+// paths. The symlinks test data is named "links".
+func backupPathsContext(t *testing.T) func() *Context {
+	return func() *Context {
+		books, err := filepath.Abs("../../testdata/filesync_freebooks")
+		if err != nil {
+			t.Fatal(err)
+		}
+		links, err := filepath.Abs("../../testdata/filesync_symlinks")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := NewContextFromYaml([]byte(fmt.Sprintf(`
+backupPaths:
+  - path: %q
+  - name: links
+    path: %q
+devices:
+  - name: Test Device 0
+    uuid: test-device-0
+    sizeTotal: 28173338480
+    mountPoint: %q
+`, books, links, NewMountPoint(t, testTempDir, "mountpoint-0-"))))
+		if err != nil {
+			t.Fatalf("EXPECT: No errors from NewContextFromYaml() GOT: %s", err)
+		}
+		return c
+	}
+}
+
+// TestRestoreMultipleBackupPaths syncs two backup paths to one device and restores each backup path in a directory with its
+// name.
+func TestRestoreMultipleBackupPaths(t *testing.T) {
+	r := &restoreTest{t: t,
+		sync: &syncTest{t: t, context: backupPathsContext(t)},
+	}
+	r.Run()
+	if t.Failed() {
+		return
+	}
+	sources := make(map[string]int)
+	for _, f := range r.ctx.FileIndex {
+		sources[f.Source]++
+	}
+	if expect := map[string]int{"filesync_freebooks": 6, "links": 3}; !reflect.DeepEqual(sources, expect) {
+		t.Errorf("EXPECT: Files by backup path %v GOT: %v", expect, sources)
+	}
+	for _, p := range []string{"filesync_freebooks/alice", "links/test.txt"} {
+		if _, err := os.Stat(filepath.Join(r.target, p)); err != nil {
+			t.Errorf("EXPECT: %q is restored GOT: %s", p, err)
+		}
+	}
+}
+
+func TestContextBadBackupPaths(t *testing.T) {
+	tests := []struct {
+		backupPaths string
+		reason      string
+	}{
+		{"[{name: a}]", "path is not defined"},
+		{"[{path: /tmp/a}, {path: /var/a}]", "name is used by another backup path"},
+		{"[{path: /}]", "name is not a valid directory name"},
+		{"[{path: /tmp}, {path: /tmp/a}]", `overlaps with "/tmp"`},
+	}
+	for _, test := range tests {
+		_, err := NewContextFromYaml([]byte(fmt.Sprintf(`
+backupPaths: %s
+devices:
+  - name: Test Device 0
+    uuid: test-device-0
+    sizeTotal: 1000
+    mountPoint: /mnt/test
+`, test.backupPaths)))
+		if e, ok := err.(ContextFileBadBackupPath); !ok || e.Reason != test.reason {
+			t.Errorf("EXPECT: %T %q for %s GOT: %v", ContextFileBadBackupPath{}, test.reason, test.backupPaths, err)
+		}
+	}
+}
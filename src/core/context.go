@@ -1,8 +1,11 @@
 package core
 
 import (
+	"bufio"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -57,6 +60,85 @@ func (e ContextFileDeviceHasNoUUID) Error() string {
 	return fmt.Sprintf("UUID is not defined for device %q", e.Name)
 }
 
+// ContextFileBadLayout is an error returned by ContextFromPath(). It indicates the layout of a device or the default layout
+// is unknown.
+type ContextFileBadLayout struct {
+	Name   string
+	Layout Layout
+}
+
+// Error satisfies the Error interface.
+func (e ContextFileBadLayout) Error() string {
+	if e.Name == "" {
+		return fmt.Sprintf("Unknown layout %q", e.Layout)
+	}
+	return fmt.Sprintf("Unknown layout %q for device %q", e.Layout, e.Name)
+}
+
+// checkLayout returns ContextFileBadLayout if l is not a known layout. An empty layout is the default layout.
+func checkLayout(name string, l Layout) error {
+	if l != "" && l != LayoutUUID && l != LayoutMirror {
+		return ContextFileBadLayout{name, l}
+	}
+	return nil
+}
+
+// ContextFileBadBackupPath is an error returned by ContextFromPath(). It indicates an entry of backupPaths is not valid.
+type ContextFileBadBackupPath struct {
+	Name   string
+	Path   string
+	Reason string
+}
+
+// Error satisfies the Error interface.
+func (e ContextFileBadBackupPath) Error() string {
+	return fmt.Sprintf("Bad backup path %q (name %q): %s", e.Path, e.Name, e.Reason)
+}
+
+// BackupPath is one of multiple directories synced to the devices. The files of a backup path are restored in a directory
+// with the name of the backup path.
+type BackupPath struct {
+	Name string `json:"name" yaml:"name"` // Defaults to the base name of the path
+	Path string `json:"path" yaml:"path"`
+}
+
+// checkBackupPaths sets the default names of the backup paths and checks the names are unique and the paths do not overlap.
+func (c *Context) checkBackupPaths() error {
+	if len(c.BackupPaths) > 0 && c.BackupPath != "" {
+		return ContextFileBadBackupPath{Path: c.BackupPath, Reason: "backupPath and backupPaths cannot both be used"}
+	}
+	names := make(map[string]bool)
+	for x := range c.BackupPaths {
+		bp := &c.BackupPaths[x]
+		if bp.Path == "" {
+			return ContextFileBadBackupPath{bp.Name, bp.Path, "path is not defined"}
+		}
+		bp.Path = filepath.Clean(bp.Path)
+		if bp.Name == "" {
+			bp.Name = filepath.Base(bp.Path)
+		}
+		if bp.Name == "." || bp.Name == ".." || strings.Contains(bp.Name, "/") {
+			return ContextFileBadBackupPath{bp.Name, bp.Path, "name is not a valid directory name"}
+		}
+		if names[bp.Name] {
+			return ContextFileBadBackupPath{bp.Name, bp.Path, "name is used by another backup path"}
+		}
+		names[bp.Name] = true
+		for _, o := range c.BackupPaths[:x] {
+			if inPath(o.Path, bp.Path) || inPath(bp.Path, o.Path) {
+				return ContextFileBadBackupPath{bp.Name, bp.Path, fmt.Sprintf("overlaps with %q", o.Path)}
+			}
+		}
+	}
+	return nil
+}
+
+// inPath returns true if p is base or a path inside of base.
+func inPath(base, p string) bool {
+	rel, err := filepath.Rel(filepath.Clean(base), filepath.Clean(p))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
 // ContextFromPath parses a gds config file from a file path and returns a new context or an error.
 func ContextFromPath(path string) (*Context, error) {
 	conf, err := ioutil.ReadFile(path)
@@ -68,23 +150,69 @@ func ContextFromPath(path string) (*Context, error) {
 
 // Context contains the application state
 type Context struct {
-	BackupPath        string  `json:"backupPath" yaml:"backupPath"`
-	OutputStreamNum   uint16  `json:"outputStreams" yaml:"outputStreams"`
-	PaddingPercentage float64 `json:"paddingPercentage" yaml:"paddingPercentage"`
+	BackupPath        string       `json:"backupPath" yaml:"backupPath"`
+	BackupPaths       []BackupPath `json:"backupPaths" yaml:"backupPaths"` // Used instead of BackupPath to sync multiple paths
+	OutputStreamNum   uint16       `json:"outputStreams" yaml:"outputStreams"`
+	PaddingPercentage float64      `json:"paddingPercentage" yaml:"paddingPercentage"`
+	Layout            Layout       `json:"layout" yaml:"layout"`       // The default layout of the devices
+	Placement         Placement    `json:"placement" yaml:"placement"` // How the files are spread over the devices
+	Copies            int          `json:"copies" yaml:"copies"`       // The number of copies of each file, on distinct devices
+
+	// The hash algorithm of the file sums. It is recorded in the sync context so the sums are checked with the same
+	// algorithm by verify and restore.
+	HashAlgorithm HashAlgorithm `json:"hashAlgorithm" yaml:"hashAlgorithm"`
+
+	// If set, the sums of the source files are computed while the files are copied instead of reading the files twice
+	SinglePass bool `json:"singlePass" yaml:"singlePass"`
+
+	// If set, files with the same content as another file are only stored once. Needs the sums of the hashing phase.
+	Dedup bool `json:"dedup" yaml:"dedup"`
+
+	// The number of times a source file that changed while it was copied is copied again before it is flagged as unstable
+	UnstableRetries int `json:"unstableRetries" yaml:"unstableRetries"`
+
+	// Patterns with gitignore semantics for the files that are not synced, and the excluded files that are synced anyway
+	Exclude []string `json:"exclude" yaml:"exclude"`
+	Include []string `json:"include" yaml:"include"`
 
 	SyncStartDate   time.Time `json:"syncStartDate" yaml:"syncStartDate"`
 	LastSyncEndDate time.Time `json:"lastSyncEndDate" yaml:"lastSyncEndDate"`
 
+	// The path to the sync context of the previous sync. If set, only new and modified files are synced.
+	PreviousSyncContext string `json:"previousSyncContext" yaml:"previousSyncContext"`
+
 	FileIndex FileIndex `json:"fileIndex"`
 
+	// Destination files of a previous sync that are not used anymore. They are removed from the devices during the sync.
+	OrphanedDestFiles []*DestFile `json:"orphanedDestFiles"`
+	reusedOrphans     []*DestFile // Orphaned destination files with a path used by a new destination file
+	deletedDirs       []string    // The directories of the previous sync that no longer exist in the backup path
+
+	// Rules pinning the files matching a pattern to a device or keeping them off of devices. The first matching rule is
+	// used.
+	PlacementRules []PlacementRule `json:"placementRules" yaml:"placementRules"`
+
+	// The directories that did not fit on one device with the directory placement, relative to the backup paths
+	SpreadDirectories []string `json:"spreadDirectories"`
+
 	Devices     DeviceList `json:"devices" yaml:"devices"`
 	DevicesUsed int        `json:"devicesUsed"` // Counting start at 1
 
+	// The number of bytes of each data device combined at a time into the parity of the parity devices
+	ParityStripeSize uint64 `json:"parityStripeSize" yaml:"parityStripeSize"`
+
+	// The layout of the data streams protected by the parity devices. Nil if there are no parity devices.
+	StripeMap *StripeMap `json:"stripeMap"`
+
 	SyncProgress    *SyncProgressTracker `json:"-"`
 	SyncDeviceMount map[int]chan bool    `json:"-"`
 
 	SyncContextSize uint64 `json:"syncContextSize"`
 
+	Journal *Journal `json:"-"` // If set, completed destination files are recorded in the journal
+
+	sourceHashes *sourceHashes // Computes the sums of the source files in single-pass mode
+
 	Errors chan error `json:"-"` // All errors generated in the context will appear here. This chan is buffered.
 
 	Done chan bool `json:"-"`
@@ -96,6 +224,8 @@ func NewContext(bp string, os uint16, files FileIndex, devices DeviceList, pp fl
 		BackupPath:        bp,
 		OutputStreamNum:   os,
 		PaddingPercentage: pp,
+		HashAlgorithm:     HashSHA1,
+		UnstableRetries:   DefaultUnstableRetries,
 		SyncStartDate:     time.Now(),
 		Devices:           devices,
 		FileIndex:         files,
@@ -119,6 +249,9 @@ func NewContext(bp string, os uint16, files FileIndex, devices DeviceList, pp fl
 			// This variable is used when computing padding bytes
 			c.Devices[x].PaddingPercentage = c.PaddingPercentage
 		}
+		if c.Devices[x].Layout == "" {
+			c.Devices[x].Layout = c.Layout
+		}
 	}
 	if err := c.checkSizes(); err != nil {
 		return nil, err
@@ -135,6 +268,7 @@ func NewContextFromJSON(b []byte) (*Context, error) {
 	c := &Context{
 		SyncStartDate:   time.Now(),
 		OutputStreamNum: 1,
+		UnstableRetries: DefaultUnstableRetries,
 		SyncDeviceMount: make(map[int]chan bool),
 		Errors:          make(chan error),
 		Done:            make(chan bool),
@@ -142,6 +276,9 @@ func NewContextFromJSON(b []byte) (*Context, error) {
 	if err := json.Unmarshal(b, c); err != nil {
 		return nil, err
 	}
+	if c.HashAlgorithm == "" {
+		c.HashAlgorithm = HashSHA1
+	}
 	c.SyncProgress = NewSyncProgressTracker(c.Devices)
 	if c.PaddingPercentage == 0 {
 		c.PaddingPercentage = 1.0
@@ -151,6 +288,9 @@ func NewContextFromJSON(b []byte) (*Context, error) {
 			// This variable is used when computing padding bytes
 			c.Devices[x].PaddingPercentage = c.PaddingPercentage
 		}
+		if c.Devices[x].Layout == "" {
+			c.Devices[x].Layout = c.Layout
+		}
 	}
 	c.FileIndex = FileIndex{}
 	c.gatherFiles()
@@ -160,11 +300,103 @@ func NewContextFromJSON(b []byte) (*Context, error) {
 	return c, nil
 }
 
+// SyncContextFromPath loads a sync context saved by a previous sync from path. The file can be the compressed context saved
+// to the last device or the uncompressed JSON dump saved to the configuration directory. Unlike NewContextFromJSON, the
+// backup path is not walked and the files are not cataloged again; the file index and destination files are used exactly
+// as they were recorded.
+func SyncContextFromPath(path string) (*Context, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	compressed := false
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		compressed = true
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	c := &Context{
+		OutputStreamNum: 1,
+		UnstableRetries: DefaultUnstableRetries,
+		SyncDeviceMount: make(map[int]chan bool),
+		Errors:          make(chan error),
+		Done:            make(chan bool),
+	}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, err
+	}
+	if len(c.Devices) == 0 {
+		return nil, new(ContextFileHasNoDevicesError)
+	}
+	if c.HashAlgorithm == "" {
+		// Saved before the hash algorithm could be selected
+		c.HashAlgorithm = HashSHA1
+	}
+	if err := checkHashAlgorithm(c.HashAlgorithm); err != nil {
+		return nil, err
+	}
+	if compressed && c.SyncContextSize == 0 {
+		// The size is not known until after the context is saved to the last device
+		if fi, err := f.Stat(); err == nil {
+			c.SyncContextSize = uint64(fi.Size())
+		}
+	}
+	c.SyncProgress = NewSyncProgressTracker(c.Devices)
+	return c, nil
+}
+
 // NewContextFromYaml returns a new context parsed from yaml.
 func NewContextFromYaml(config []byte) (*Context, error) {
+	c, err := configFromYaml(config)
+	if err != nil {
+		return nil, err
+	}
+	c.FileIndex = FileIndex{}
+	if err := c.gatherFiles(); err != nil {
+		return nil, err
+	}
+	if c.PreviousSyncContext != "" {
+		prev, err := SyncContextFromPath(c.PreviousSyncContext)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.Incremental(prev); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	if err := c.catalogFiles(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ConfigFromPath parses a gds config file from a file path and returns a context without walking the backup paths.
+func ConfigFromPath(path string) (*Context, error) {
+	conf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return configFromYaml(conf)
+}
+
+// configFromYaml returns a new context parsed from yaml with the configuration checked and the defaults set.
+func configFromYaml(config []byte) (*Context, error) {
 	c := &Context{
 		SyncStartDate:   time.Now(),
 		OutputStreamNum: 1,
+		UnstableRetries: DefaultUnstableRetries,
 		SyncDeviceMount: make(map[int]chan bool),
 		Errors:          make(chan error),
 		Done:            make(chan bool),
@@ -187,6 +419,33 @@ func NewContextFromYaml(config []byte) (*Context, error) {
 		if len(x.UUID) == 0 {
 			return nil, ContextFileDeviceHasNoUUID{x.Name}
 		}
+		if err := checkLayout(x.Name, x.Layout); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkLayout("", c.Layout); err != nil {
+		return nil, err
+	}
+	if err := checkPlacement(c.Placement); err != nil {
+		return nil, err
+	}
+	if err := c.checkParity(); err != nil {
+		return nil, err
+	}
+	if err := c.checkCopies(); err != nil {
+		return nil, err
+	}
+	if err := c.checkPlacementRules(); err != nil {
+		return nil, err
+	}
+	if c.HashAlgorithm == "" {
+		c.HashAlgorithm = HashSHA1
+	}
+	if err := checkHashAlgorithm(c.HashAlgorithm); err != nil {
+		return nil, err
+	}
+	if err := c.checkBackupPaths(); err != nil {
+		return nil, err
 	}
 	c.SyncProgress = NewSyncProgressTracker(c.Devices)
 	if c.PaddingPercentage == 0 {
@@ -197,37 +456,64 @@ func NewContextFromYaml(config []byte) (*Context, error) {
 			// This variable is used when computing padding bytes
 			c.Devices[x].PaddingPercentage = c.PaddingPercentage
 		}
+		if c.Devices[x].Layout == "" {
+			c.Devices[x].Layout = c.Layout
+		}
 	}
-	c.FileIndex = FileIndex{}
-	c.gatherFiles()
-	if err := c.catalog(); err != nil {
+	if _, err := c.newIgnoreRules(); err != nil {
 		return nil, err
 	}
 	return c, nil
 }
 
 func (c *Context) checkSizes() error {
-	dSize := c.Devices.TotalSizePadded()
-	fSize := c.FileIndex.TotalSizeFiles()
+	data := c.Devices.DataDevices()
+	dSize := data.TotalSizePadded()
+	fSize := c.sizeWithCopies()
 	Log.Debugf("checkSizes(): TotalFileSize: %d DeviceSizeWithPadding: %d ", fSize, dSize)
 	if fSize > dSize {
-		return DevicePoolSizeExceeded{c.FileIndex.TotalSizeFiles(), c.Devices.TotalSize(), c.Devices.TotalSizePadded()}
+		return DevicePoolSizeExceeded{fSize, data.TotalSize(), data.TotalSizePadded()}
 	}
 	return nil
 }
 
-// gatherFiles walks the backup paths and loads the file index with file data.
+// gatherFiles walks the backup paths and loads the file index with file data. The files of all backup paths are added to the
+// same file index. Files matching the exclude patterns or the patterns of .gdsignore files are skipped, excluded directories
+// are not walked. Regular files with the same device and inode numbers are hardlinks: the first one found is stored, the
+// others are added as links to it. The data extents of sparse files and the extended attributes of files and directories are
+// recorded. An extended attribute that can not be read is logged and skipped.
 func (c *Context) gatherFiles() error {
+	var source, root string
+	var rules ignoreRules
+	type inodeKey struct{ dev, inode uint64 }
+	links := make(map[inodeKey]*File)
 	WalkFunc := func(p string, info os.FileInfo, err error) error {
 		if err != nil {
 			return FileSourceNotReadable{p, fmt.Sprintf("gatherFiles: %s", err.Error())}
 		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if rel != "." && rules.excluded(rel, info.IsDir()) {
+			Log.WithFields(logrus.Fields{"path": p, "rule": rules.match(rel, info.IsDir())}).Debugln("Excluded")
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			if err := rules.load(p, rel); err != nil {
+				return err
+			}
+		}
 		if info.IsDir() && p == c.BackupPath && p[len(p)-1] == '/' {
 			return nil
 		}
 		f := &File{
 			Name:    info.Name(),
 			Path:    p,
+			Source:  source,
 			Size:    uint64(info.Size()),
 			Mode:    info.Mode(),
 			ModTime: info.ModTime(),
@@ -235,16 +521,57 @@ func (c *Context) gatherFiles() error {
 			ChgTime: time.Unix(info.Sys().(*syscall.Stat_t).Ctim.Unix()),
 			Owner:   int(info.Sys().(*syscall.Stat_t).Uid),
 			Group:   int(info.Sys().(*syscall.Stat_t).Gid),
+			dev:     uint64(info.Sys().(*syscall.Stat_t).Dev),
+			inode:   uint64(info.Sys().(*syscall.Stat_t).Ino),
 		}
 		if info.IsDir() {
 			f.FileType = DIRECTORY
 		} else if info.Mode()&os.ModeSymlink != 0 {
 			f.FileType = SYMLINK
+		} else if info.Mode().IsRegular() && info.Sys().(*syscall.Stat_t).Nlink > 1 {
+			key := inodeKey{f.dev, f.inode}
+			if t, ok := links[key]; ok {
+				Log.WithFields(logrus.Fields{"path": p, "linkTarget": t.Path}).Debugln("Hardlink")
+				f.FileType = HARDLINK
+				f.LinkTarget = t.Path
+			} else {
+				links[key] = f
+			}
+		}
+		if f.FileType == FILE || f.FileType == DIRECTORY {
+			// Hardlinks share the attributes of the file they link to
+			var errs []XattrError
+			f.Xattrs, errs = readXattrs(p)
+			for _, err := range errs {
+				Log.WithFields(logrus.Fields{"path": p}).Warnln(err)
+			}
+		}
+		if st := info.Sys().(*syscall.Stat_t); f.FileType == FILE && uint64(st.Blocks)*512 < f.Size {
+			// Fewer blocks are allocated than the size of the file, it has holes
+			if f.Extents, err = dataExtents(p, f.Size); err != nil {
+				return FileSourceNotReadable{p, fmt.Sprintf("gatherFiles: %s", err.Error())}
+			}
 		}
 		c.FileIndex.Add(f)
 		return nil
 	}
-	return filepath.Walk(c.BackupPath, WalkFunc)
+	walk := func(name, path string) error {
+		var err error
+		if rules, err = c.newIgnoreRules(); err != nil {
+			return err
+		}
+		source, root = name, path
+		return filepath.Walk(path, WalkFunc)
+	}
+	if len(c.BackupPaths) == 0 {
+		return walk("", c.BackupPath)
+	}
+	for _, bp := range c.BackupPaths {
+		if err := walk(bp.Name, bp.Path); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // catalogTracker trackes the state of the cataloging process
@@ -259,10 +586,30 @@ type catalogTracker struct {
 
 	device       *Device // Current device being tracked
 	deviceNumber int
+
+	free    []uint64 // The free space of each device, used by the placement strategies other than sequential
+	placed  []uint64 // The bytes placed on each device by the placement rules and strategies other than sequential
+	allowed []bool   // If set, only the devices set to true are used by the placement rules
+	spread  []string // The directories spread across devices by the directory placement
+	copy    int      // The copy of the file being placed, set while placing the extra copies
 }
 
 func newCatalogTracker(c *Context) *catalogTracker {
-	return &catalogTracker{ctx: c, device: c.Devices[0]}
+	ct := &catalogTracker{ctx: c, device: c.Devices[0]}
+	ct.initFree()
+	ct.size = ct.deviceUsed(0)
+	return ct
+}
+
+// deviceUsed returns the bytes used on the device with the index x by a previous sync and the files placed so far, except
+// for the files placed by the sequential placement.
+func (ct *catalogTracker) deviceUsed(x int) uint64 {
+	return ct.ctx.Devices[x].SizeUsed + ct.placed[x]
+}
+
+// deviceFull returns true if there is no space left on the current device.
+func (ct *catalogTracker) deviceFull() bool {
+	return ct.size >= ct.device.SizeTotalPadded()
 }
 
 func (ct *catalogTracker) nextDevice() error {
@@ -271,32 +618,39 @@ func (ct *catalogTracker) nextDevice() error {
 		"nextDeviceNum":   ct.deviceNumber + 1,
 		"numberOfDevices": len(ct.ctx.Devices),
 	}).Debugln("nextDevice")
+	if ct.deviceNumber+1 >= len(ct.ctx.Devices.DataDevices()) {
+		c := ct.ctx
+		return DevicePoolSizeExceeded{c.FileIndex.TotalSizeFiles(), c.Devices.TotalSize(), c.Devices.TotalSizePadded()}
+	}
 	ct.deviceNumber += 1
 	ct.device = ct.ctx.Devices[ct.deviceNumber]
-	ct.size = 0
+	ct.size = ct.deviceUsed(ct.deviceNumber)
 	return nil
 }
 
 // splitCheck returns true if the passed file will need to be split based on the byte space remaining for the current device.
 func (ct *catalogTracker) splitCheck() bool {
+	size := ct.file.allocatedSize()
 	Log.Debugf("splitCheck: ct.size: %d ct.file.size: %d dev.SizeTotalPadded: %d",
-		ct.size, ct.file.Size, ct.device.SizeTotalPadded())
-	if (ct.size + ct.file.Size) <= ct.device.SizeTotalPadded() {
-		ct.size += ct.file.Size
-	} else if ct.size < ct.device.SizeTotalPadded() && ct.file.Size > ct.device.SizeTotalPadded()-ct.size {
+		ct.size, size, ct.device.SizeTotalPadded())
+	if (ct.size + size) <= ct.device.SizeTotalPadded() {
+		ct.size += size
+	} else if ct.size < ct.device.SizeTotalPadded() && size > ct.device.SizeTotalPadded()-ct.size {
 		return true
 	}
 	return false
 }
 
+// splitEndByteCalc sets the end byte of the current destination file to the end of the file, or to the byte where the
+// remaining device space runs out. Split points are logical byte offsets, the holes of a sparse file take up no space.
 func (ct *catalogTracker) splitEndByteCalc() {
 	avail := ct.device.SizeTotalPadded() - ct.size
-	remain := ct.file.Size - ct.destFile.StartByte
+	remain := ct.file.allocated(ct.destFile.StartByte, ct.file.Size)
 	Log.Debugf("Remain: %d Avail: %d", remain, avail)
-	ct.destFile.EndByte = ct.destFile.StartByte + remain
+	ct.destFile.EndByte = ct.file.Size
 	if avail > 0 && remain > avail {
 		Log.Debugln("Using the remaining device space")
-		ct.destFile.EndByte = ct.destFile.StartByte + avail
+		ct.destFile.EndByte = ct.file.allocatedEnd(ct.destFile.StartByte, avail)
 	}
 	ct.destFile.Size = ct.destFile.EndByte - ct.destFile.StartByte
 }
@@ -318,13 +672,13 @@ func (ct *catalogTracker) splitFile() error {
 	ct.debugPrintSplit("Before loop")
 	for {
 		ct.destFile = NewDestFile(ct.file, ct.device, ct.destFilePrev, ct.destFilePrev)
-		if (ct.device.SizeTotalPadded() - ct.size) == 0 {
+		if ct.deviceFull() {
 			if err := ct.nextDevice(); err != nil {
 				return err
 			}
 		}
 		// If the file is still larger than the new device, use all of the available space
-		if (ct.size + ct.destFile.Size) >= ct.device.SizeTotalPadded() {
+		if ct.size+ct.file.allocated(ct.destFile.StartByte, ct.file.Size) >= ct.device.SizeTotalPadded() {
 			// Use the remaining device space
 			ct.debugPrintSplit("Before size calc")
 			ct.splitEndByteCalc()
@@ -333,7 +687,7 @@ func (ct *catalogTracker) splitFile() error {
 			ct.destFile.Size = ct.destFile.EndByte - ct.destFile.StartByte
 		}
 
-		ct.size += ct.destFile.Size
+		ct.size += ct.file.allocated(ct.destFile.StartByte, ct.destFile.EndByte)
 		ct.file.AddDestFile(ct.destFile)
 
 		if ct.destFile.EndByte == ct.file.Size {
@@ -361,10 +715,99 @@ func (ct *catalogTracker) debugPrintSplit(msg string) {
 	}).Debugln("Split File:", msg)
 }
 
-// catalog determines to which device a file will be saved. Files that won't completely fit on one device will be split
-// across devices.
+// mirrorDestPaths sets the paths of the new destination files on devices using the mirror layout. A path that is still used
+// by a destination file of a previous sync, for example a file that was renamed and replaced with a new file, gets a numbered
+// suffix. So does a file in the root of the backup path with the name of a metadata file, like "SHA1SUMS", that would be
+// overwritten by the metadata file.
+func (c *Context) mirrorDestPaths() error {
+	used := make(map[string]bool)
+	for _, f := range c.FileIndex {
+		if f.Kept {
+			for _, df := range f.DestFiles {
+				used[df.Path] = true
+			}
+		}
+	}
+	for _, f := range c.FileIndex {
+		if f.Kept {
+			continue
+		}
+		for n := 0; n < f.Copies(); n++ {
+			// The parts are numbered within each copy
+			dfs := f.CopyDestFiles(n)
+			for x, df := range dfs {
+				d, err := c.Devices.DeviceByName(df.DeviceName)
+				if err != nil {
+					return err
+				}
+				if d.Layout != LayoutMirror {
+					continue
+				}
+				rel, err := c.relPath(f.Path)
+				if err != nil {
+					return err
+				}
+				df.mirrorDestPath(d.MountPoint, rel, x, len(dfs))
+				reserved := metadataPath(d.MountPoint, df.Path)
+				for n, p := 1, df.Path; used[df.Path] || reserved; n++ {
+					reserved = false
+					df.Path = fmt.Sprintf("%s.gds-%d", p, n)
+				}
+				used[df.Path] = true
+			}
+		}
+	}
+	return nil
+}
+
+// sequential places the file on the current device. The tracker moves on to the next device once the current device is full.
+// A file that won't completely fit on the current device is split across devices.
+func (ct *catalogTracker) sequential(file *File) error {
+	c := ct.ctx
+	ct.file = file
+	for ct.deviceFull() {
+		if file.Size == 0 && ct.deviceNumber+1 == len(c.Devices.DataDevices()) {
+			// Empty files fit on a full device
+			break
+		}
+		if err := ct.nextDevice(); err != nil {
+			return err
+		}
+	}
+	ct.destFile = NewDestFile(file, ct.device, nil, nil)
+
+	if ct.splitCheck() {
+		Log.WithFields(logrus.Fields{
+			"deviceSize": ct.device.SizeTotal,
+			"ct.size":    ct.size,
+			"file":       ct.file.Name,
+			"size":       ct.file.Size}).Debugf("Splitting")
+		return ct.splitFile()
+	}
+	file.AddDestFile(ct.destFile)
+	return nil
+}
+
+// catalogFiles catalogs the file index. With deduplication, a device pool that is too small for the files is not an error
+// yet. The files are cataloged again by DedupFiles once their sums are known, and the pool is only too small if the
+// deduplicated files do not fit either.
+func (c *Context) catalogFiles() error {
+	err := c.catalog()
+	if _, ok := err.(DevicePoolSizeExceeded); ok && c.Dedup {
+		Log.WithFields(logrus.Fields{"error": err}).Warnln("Device pool is too small for the files before deduplication")
+		return nil
+	}
+	return err
+}
+
+// catalog determines to which device a file will be saved. Files matching a placement rule are placed first on the devices
+// allowed by the rule, the other files are placed using the placement strategy of the context. Files that won't completely
+// fit on one device will be split across devices. The extra copies of the files are placed last.
 func (c *Context) catalog() error {
 	ct := newCatalogTracker(c)
+	var files, ruled, copied []*File
+	rules := make(map[*File]*PlacementRule)
+	contents := c.storedContents()
 
 	// Let's light this candle
 	for _, file := range ct.ctx.FileIndex {
@@ -373,8 +816,9 @@ func (c *Context) catalog() error {
 			"filePath": file.Path, "fileType": file.FileType.String(), "size": file.Size,
 		}).Infof("Inspecting file attributes")
 
-		// Directories can be ignored, symlinks only need the symlink target set.
-		if file.FileType == DIRECTORY {
+		// Directories can be ignored, symlinks only need the symlink target set. Hardlinks and duplicates are stored with
+		// their target.
+		if file.FileType == DIRECTORY || file.FileType == HARDLINK || file.FileType == DUPLICATE {
 			continue
 		} else if file.FileType == SYMLINK {
 			if err := file.SetSymlinkTargetPath(); err != nil {
@@ -383,25 +827,68 @@ func (c *Context) catalog() error {
 			continue
 		}
 
-		ct.file = file
-		if (ct.device.SizeTotalPadded() - ct.size) == 0 {
-			ct.nextDevice()
+		if file.Kept {
+			// The destination files of the previous sync are used
+			continue
+		}
+		if c.duplicateFile(file, contents) {
+			continue
 		}
-		ct.destFile = NewDestFile(file, ct.device, nil, nil)
 
-		if ct.splitCheck() {
-			Log.WithFields(logrus.Fields{
-				"deviceSize": ct.device.SizeTotal,
-				"ct.size":    ct.size,
-				"file":       ct.file.Name,
-				"size":       ct.file.Size}).Debugf("Splitting")
-			if err := ct.splitFile(); err != nil {
+		r, err := c.placementRule(file)
+		if err != nil {
+			return err
+		}
+		if c.fileCopies(r) > 1 {
+			copied = append(copied, file)
+		}
+		if r != nil {
+			rules[file] = r
+			ruled = append(ruled, file)
+			continue
+		}
+		files = append(files, file)
+	}
+	if err := ct.placeRuled(ruled, rules); err != nil {
+		return err
+	}
+	switch c.Placement {
+	case PlacementFirstFitDecreasing:
+		if err := ct.firstFitDecreasing(files); err != nil {
+			return err
+		}
+	case PlacementDirectory:
+		if err := ct.directoryAffinity(files); err != nil {
+			return err
+		}
+	default:
+		for _, file := range files {
+			if err := ct.sequential(file); err != nil {
 				return err
 			}
-			continue
 		}
-		file.AddDestFile(ct.destFile)
+	}
+	if len(copied) > 0 {
+		if err := ct.placeCopies(copied, rules); err != nil {
+			return err
+		}
+	}
+	c.SpreadDirectories = ct.spread
+	Log.WithFields(logrus.Fields{
+		"placement": c.Placement, "splitFiles": len(c.FileIndex.SplitFiles()),
+	}).Infoln("Catalog complete")
+	if err := c.mirrorDestPaths(); err != nil {
+		return err
+	}
+	var err error
+	if c.StripeMap, err = c.newStripeMap(); err != nil {
+		return err
 	}
 	c.DevicesUsed = ct.deviceNumber + 1
+	for x, d := range c.Devices {
+		if x >= c.DevicesUsed && (len(c.FileIndex.DeviceFiles(d)) > 0 || len(c.deviceOrphans(d)) > 0 || d.Parity) {
+			c.DevicesUsed = x + 1
+		}
+	}
 	return nil
 }
@@ -0,0 +1,135 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ContextFileBadCopies is an error returned by ContextFromPath(). It indicates the number of copies is less than one or
+// more than the number of devices.
+type ContextFileBadCopies struct {
+	Copies  int
+	Devices int
+}
+
+// Error satisfies the Error interface.
+func (e ContextFileBadCopies) Error() string {
+	return fmt.Sprintf("Bad number of copies %d, must be between 1 and the number of devices (%d)", e.Copies, e.Devices)
+}
+
+// CopyPlacementError is given when a copy of a file does not fit on the devices that do not hold another copy of the file.
+type CopyPlacementError struct {
+	FilePath string
+	Copy     int // Counting from 1
+	Copies   int
+}
+
+// Error implements the Error interface.
+func (e CopyPlacementError) Error() string {
+	return fmt.Sprintf("Inadequate device space for copy %d of %d of %q on the devices without another copy", e.Copy,
+		e.Copies, e.FilePath)
+}
+
+// checkCopies returns ContextFileBadCopies if the number of copies is negative or larger than the number of data devices.
+// Zero is the default of one copy.
+func (c *Context) checkCopies() error {
+	if n := len(c.Devices.DataDevices()); c.Copies < 0 || c.Copies > n {
+		return ContextFileBadCopies{c.Copies, n}
+	}
+	return nil
+}
+
+// fileCopies returns the number of copies stored on distinct devices for a file matching the placement rule r. The copies
+// of the rule are used if set, otherwise the copies of the context. The rule can be nil.
+func (c *Context) fileCopies(r *PlacementRule) int {
+	if r != nil && r.Copies > 0 {
+		return r.Copies
+	}
+	if c.Copies > 0 {
+		return c.Copies
+	}
+	return 1
+}
+
+// sizeWithCopies returns the bytes the files in the file index take up on the devices, counting every copy of a file.
+func (c *Context) sizeWithCopies() uint64 {
+	var total uint64
+	for _, f := range c.FileIndex {
+		if f.FileType != FILE {
+			continue
+		}
+		r, _ := c.placementRule(f)
+		total += f.allocatedSize() * uint64(c.fileCopies(r))
+	}
+	return total
+}
+
+// countFree sets the free space of each device from the destination files placed so far. The sequential placement does not
+// track the free space of the devices while placing.
+func (ct *catalogTracker) countFree() {
+	ct.initFree()
+	index := make(map[string]int)
+	for x, d := range ct.ctx.Devices {
+		index[d.Name] = x
+	}
+	for _, f := range ct.ctx.FileIndex {
+		if f.Kept {
+			// Counted in the space used by the previous sync
+			continue
+		}
+		for _, df := range f.DestFiles {
+			x := index[df.DeviceName]
+			used := f.allocated(df.StartByte, df.EndByte)
+			if used < ct.free[x] {
+				ct.free[x] -= used
+			} else {
+				ct.free[x] = 0
+			}
+			ct.placed[x] += used
+		}
+	}
+}
+
+// copyAllowed returns the devices the next copy of f can be placed on. These are the devices allowed by the placement rule r
+// that do not hold a destination file of another copy of f.
+func (ct *catalogTracker) copyAllowed(f *File, r *PlacementRule) []bool {
+	var allowed []bool
+	if r != nil {
+		allowed = r.allowed(ct.ctx.Devices)
+	} else {
+		allowed = make([]bool, len(ct.ctx.Devices))
+		for x := range allowed {
+			allowed[x] = true
+		}
+	}
+	for x, d := range ct.ctx.Devices {
+		for _, df := range f.DestFiles {
+			if df.DeviceName == d.Name {
+				allowed[x] = false
+			}
+		}
+	}
+	return allowed
+}
+
+// placeCopies places the extra copies of files, largest first, once the first copy of every file is placed. Each copy goes
+// to devices that do not hold another copy of the file, so losing one device does not lose the file. A copy is only split
+// if none of these devices can hold it.
+func (ct *catalogTracker) placeCopies(files []*File, rules map[*File]*PlacementRule) error {
+	ct.countFree()
+	sort.Stable(filesBySizeDecreasing(files))
+	defer func() { ct.allowed, ct.copy = nil, 0 }()
+	for _, f := range files {
+		n := ct.ctx.fileCopies(rules[f])
+		for ct.copy = 1; ct.copy < n; ct.copy++ {
+			ct.allowed = ct.copyAllowed(f, rules[f])
+			if err := ct.placeFile(f); err != nil {
+				if _, ok := err.(DevicePoolSizeExceeded); ok {
+					return CopyPlacementError{f.Path, ct.copy + 1, n}
+				}
+				return err
+			}
+		}
+	}
+	return nil
+}
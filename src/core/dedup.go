@@ -0,0 +1,94 @@
+package core
+
+import "github.com/Sirupsen/logrus"
+
+// contentKey identifies the content of a file by its size and sum.
+type contentKey struct {
+	size uint64
+	sum  string
+}
+
+// storedContents returns the files kept from the previous sync by their content. Nil if deduplication is not enabled.
+func (c *Context) storedContents() map[contentKey]*File {
+	if !c.Dedup {
+		return nil
+	}
+	contents := make(map[contentKey]*File)
+	for _, f := range c.FileIndex {
+		if f.Kept && f.Size > 0 && f.Sum != "" {
+			if _, ok := contents[contentKey{f.Size, f.Sum}]; !ok {
+				contents[contentKey{f.Size, f.Sum}] = f
+			}
+		}
+	}
+	return contents
+}
+
+// duplicateFile returns true if the content of file is already stored with another file of contents, the file then
+// becomes a duplicate of it. Otherwise the file is added to contents. Files without a sum are never duplicates.
+func (c *Context) duplicateFile(file *File, contents map[contentKey]*File) bool {
+	if contents == nil || file.FileType != FILE || file.Size == 0 || file.Sum == "" {
+		return false
+	}
+	key := contentKey{file.Size, file.Sum}
+	t, ok := contents[key]
+	if !ok {
+		contents[key] = file
+		return false
+	}
+	Log.WithFields(logrus.Fields{
+		"filePath": file.Path, "storedWith": t.Path, "size": file.Size,
+	}).Infoln("File is a duplicate")
+	file.FileType = DUPLICATE
+	file.LinkTarget = t.Path
+	file.DestFiles = nil
+	return true
+}
+
+// DedupFiles catalogs the new and modified files again once their sums are known, so the content shared by several files
+// is stored once. A file with the same size and sum as a file stored by this or the previous sync becomes a duplicate of
+// it and is not copied. Returns the number of bytes saved on the devices. DevicePoolSizeExceeded is returned if the
+// deduplicated files do not fit on the devices.
+func (c *Context) DedupFiles() (uint64, error) {
+	if !c.Dedup {
+		return 0, nil
+	}
+	for _, f := range c.FileIndex {
+		if f.Kept {
+			continue
+		}
+		if f.FileType == DUPLICATE {
+			f.FileType = FILE
+			f.LinkTarget = ""
+		}
+		if f.FileType == FILE {
+			f.DestFiles = nil
+		}
+	}
+	if err := c.catalog(); err != nil {
+		return 0, err
+	}
+	c.reuseOrphanPaths()
+	saved := c.DedupSize()
+	Log.WithFields(logrus.Fields{
+		"duplicates": len(c.FileIndex.Duplicates()), "saved": saved,
+	}).Infoln("Deduplication complete")
+	return saved, nil
+}
+
+// DedupSize returns the number of bytes the duplicates would take up on the devices, counting every copy.
+func (c *Context) DedupSize() uint64 {
+	files := make(map[string]*File)
+	for _, f := range c.FileIndex {
+		if f.FileType == FILE {
+			files[f.Path] = f
+		}
+	}
+	var size uint64
+	for _, f := range c.FileIndex.Duplicates() {
+		if t, ok := files[f.LinkTarget]; ok {
+			size += f.Size * uint64(t.Copies())
+		}
+	}
+	return size
+}
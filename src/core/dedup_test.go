@@ -0,0 +1,198 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// dedupSource returns a backup path with the files "a", "dir/b" and "dir/e" of the same content, and the file "c" with
+// other content. "dir/b" has another mode than "a".
+func dedupSource(t *testing.T) string {
+	src := NewMountPoint(t, testTempDir, "source-")
+	if err := os.Mkdir(filepath.Join(src, "dir"), 0775); err != nil {
+		t.Fatal(err)
+	}
+	files := []struct {
+		name string
+		data byte
+		mode os.FileMode
+	}{
+		{"a", 'x', 0664},
+		{"c", 'c', 0664},
+		{"dir/b", 'x', 0600},
+		{"dir/e", 'x', 0664},
+	}
+	for _, f := range files {
+		p := filepath.Join(src, f.name)
+		if err := ioutil.WriteFile(p, bytes.Repeat([]byte{f.data}, 4096), f.mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(p, f.mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return src + "/"
+}
+
+func dedupDevices(t *testing.T) func() DeviceList {
+	return func() DeviceList {
+		return DeviceList{
+			&Device{
+				Name:       "Test Device 0",
+				SizeTotal:  28173338480,
+				MountPoint: NewMountPoint(t, testTempDir, "mountpoint-0-"),
+			},
+		}
+	}
+}
+
+// TestRestoreDuplicates expects the files with the same content to be stored once and restored to every path.
+func TestRestoreDuplicates(t *testing.T) {
+	src := dedupSource(t)
+	s := &syncTest{t: t, backupPath: src, deviceList: dedupDevices(t), dedup: true}
+	r := &restoreTest{t: t, sync: s}
+	r.Run()
+	if t.Failed() {
+		return
+	}
+	dups := make(map[string]string)
+	for _, f := range r.ctx.FileIndex {
+		if f.FileType == DUPLICATE {
+			dups[f.Path] = f.LinkTarget
+			if len(f.DestFiles) != 0 {
+				t.Errorf("EXPECT: No destination files for duplicate %q GOT: %d", f.Path, len(f.DestFiles))
+			}
+		}
+	}
+	expect := map[string]string{
+		filepath.Join(src, "dir/b"): filepath.Join(src, "a"),
+		filepath.Join(src, "dir/e"): filepath.Join(src, "a"),
+	}
+	if !reflect.DeepEqual(dups, expect) {
+		t.Errorf("EXPECT: Duplicates %v GOT: %v", expect, dups)
+	}
+	if n := len(r.ctx.FileIndex.DeviceFiles(r.ctx.Devices[0])); n != 2 {
+		t.Errorf("EXPECT: 2 destination files GOT: %d", n)
+	}
+	if s.dedupSaved != 8192 {
+		t.Errorf("EXPECT: 8192 bytes saved GOT: %d", s.dedupSaved)
+	}
+}
+
+// TestRestoreMatchDuplicate expects the file storing the data of a matching duplicate to be restored with it.
+func TestRestoreMatchDuplicate(t *testing.T) {
+	r := &restoreTest{t: t,
+		sync:        &syncTest{t: t, backupPath: dedupSource(t), deviceList: dedupDevices(t), dedup: true},
+		match:       "dir/b",
+		expectFiles: 2,
+	}
+	r.Run()
+}
+
+// TestDedupCopies expects the space saved by a duplicate to count every copy of the file it is stored with.
+func TestDedupCopies(t *testing.T) {
+	src := dedupSource(t)
+	s := &syncTest{t: t,
+		context: catalogContext(t, src, splitDevices(t), func(c *Context) { c.Copies = 2 }),
+		dedup:   true,
+	}
+	s.Run()
+	if t.Failed() {
+		return
+	}
+	if s.dedupSaved != 2*8192 {
+		t.Errorf("EXPECT: %d bytes saved GOT: %d", 2*8192, s.dedupSaved)
+	}
+}
+
+// dedupYamlContext returns a context created from a configuration with deduplication for the dedupSource files and one device
+// of the given size.
+func dedupYamlContext(t *testing.T, src string, size uint64) (*Context, error) {
+	return NewContextFromYaml([]byte(fmt.Sprintf(`
+backupPath: %q
+dedup: true
+devices:
+  - name: Test Device 0
+    uuid: test-device-0
+    sizeTotal: %d
+    mountPoint: %q
+`, src, size, NewMountPoint(t, testTempDir, "mountpoint-0-"))))
+}
+
+// TestDedupDevicePool expects a device pool that only fits the files once they are deduplicated to be used, and a pool that
+// does not fit the deduplicated files either to fail after deduplication.
+func TestDedupDevicePool(t *testing.T) {
+	src := dedupSource(t)
+	s := &syncTest{t: t,
+		context: func() *Context {
+			// 16384 bytes of files, 8192 bytes once deduplicated
+			c, err := dedupYamlContext(t, src, 10000)
+			if err != nil {
+				t.Fatalf("EXPECT: No errors from NewContextFromYaml() GOT: %s", err)
+			}
+			return c
+		},
+		dedup: true,
+	}
+	s.Run()
+	if t.Failed() {
+		return
+	}
+	if s.dedupSaved != 8192 {
+		t.Errorf("EXPECT: 8192 bytes saved GOT: %d", s.dedupSaved)
+	}
+
+	c, err := dedupYamlContext(t, src, 6000)
+	if err != nil {
+		t.Fatalf("EXPECT: No errors from NewContextFromYaml() GOT: %s", err)
+	}
+	for _, f := range c.FileIndex {
+		if f.FileType == FILE {
+			if f.Sum, err = fileSum(c.HashAlgorithm, f.Path); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := c.DedupFiles(); !reflect.DeepEqual(reflect.TypeOf(err), reflect.TypeOf(DevicePoolSizeExceeded{})) {
+		t.Errorf("EXPECT: DevicePoolSizeExceeded from DedupFiles() GOT: %v", err)
+	}
+}
+
+// TestSyncIncrementalDedup expects a new file with the content of a file kept from the previous sync to be a duplicate of
+// it, so nothing is copied.
+func TestSyncIncrementalDedup(t *testing.T) {
+	name := "alice/alice_in_wonderland_by_lewis_carroll_gutenberg.org.htm"
+	i := &incrementalTest{t: t,
+		backupPath: "../../testdata/filesync_freebooks",
+		deviceList: dedupDevices(t),
+		dedup:      true,
+		change: func(src string) {
+			b, err := ioutil.ReadFile(filepath.Join(src, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(src, "alice", "copy.htm"), b, 0664); err != nil {
+				t.Fatal(err)
+			}
+		},
+	}
+	i.Run()
+	if t.Failed() {
+		return
+	}
+	f, err := i.second.ctx.FileIndex.FileByName("copy.htm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.FileType != DUPLICATE || filepath.Base(f.LinkTarget) != filepath.Base(name) {
+		t.Errorf("EXPECT: %q is a duplicate of %q GOT: %s of %q", f.Path, name, f.FileType.String(), f.LinkTarget)
+	}
+	if i.second.dedupSaved != f.Size {
+		t.Errorf("EXPECT: %d bytes saved GOT: %d", f.Size, i.second.dedupSaved)
+	}
+}
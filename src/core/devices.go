@@ -33,8 +33,15 @@ type Device struct {
 	SizeWritn         uint64  `yaml:"sizeWritn"`
 	SizeTotal         uint64  `yaml:"sizeTotal"`
 	PaddingPercentage float64 `yaml:"paddingPercentage"`
+	Layout            Layout  `yaml:"layout"`
+	ManifestSize      uint64  `yaml:"manifestSize"` // The size of the manifest file on the device
+	SumsSize          uint64  `yaml:"sumsSize"`     // The size of the checksum file on the device
 	UUID              string
+	Parity            bool   `yaml:"parity"`    // If set, the device holds the parity of the other devices instead of files
+	ParitySum         string `yaml:"paritySum"` // The sum of the parity file written to the device
+	SizeUsed          uint64 `yaml:"-"`         // Bytes used on the device by a previous sync, saved for a resumed sync
 	files             []*DestFile
+	xattrsUnsupported map[string]bool // The extended attributes the file system of the device does not support
 }
 
 // SizeTotalPadded returns the device total size with the defined percentage of padding bytes subtracted.
@@ -42,6 +49,11 @@ func (d *Device) SizeTotalPadded() uint64 {
 	return d.SizeTotal - uint64(float64(d.SizeTotal)*(d.PaddingPercentage/100))
 }
 
+// sizeMetadata returns the number of bytes used by the files describing the contents of the device.
+func (d *Device) sizeMetadata() uint64 {
+	return d.ManifestSize + d.SumsSize
+}
+
 // SizePaddingBytes returns the number of bytes used for padding.
 func (d *Device) SizePaddingBytes() uint64 {
 	return uint64(float64(d.SizeTotal) * (d.PaddingPercentage / 100))
@@ -94,6 +106,28 @@ func (d *DeviceList) TotalSizeWritten() uint64 {
 	return total
 }
 
+// DataDevices returns the devices holding destination files, all of the devices except the parity devices.
+func (d *DeviceList) DataDevices() DeviceList {
+	var l DeviceList
+	for _, x := range *d {
+		if !x.Parity {
+			l = append(l, x)
+		}
+	}
+	return l
+}
+
+// ParityDevices returns the devices holding the parity of the data devices.
+func (d *DeviceList) ParityDevices() DeviceList {
+	var l DeviceList
+	for _, x := range *d {
+		if x.Parity {
+			l = append(l, x)
+		}
+	}
+	return l
+}
+
 // DeviceByName returns a pointer to the object of the named device. Returns DeviceNotFoundError if the device is not in the
 // list.
 func (d *DeviceList) DeviceByName(name string) (*Device, error) {
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -13,12 +14,16 @@ const (
 	FILE FileType = iota
 	DIRECTORY
 	SYMLINK
+	HARDLINK  // Another name of a file in the file index, the data is only stored with the file
+	DUPLICATE // A file with the same content as another file in the file index, the data is only stored with the file
 )
 
 var fileTypes = []string{
 	"File",
 	"Directory",
 	"Symlink",
+	"Hardlink",
+	"Duplicate",
 }
 
 func (f *FileType) String() string {
@@ -49,13 +54,15 @@ func (e FileBadMetadataError) Error() string {
 	return fmt.Sprintf("%s\n\n%s\n", e.JsonError, spd.Sdump(e.Info))
 }
 
-type BadDestPathSha1Sum struct {
-	srcSha1sum  string
-	destSha1sum string
+// BadDestPathSum is given when the sum of a destination file on a device does not match the expected sum.
+type BadDestPathSum struct {
+	srcSum   string
+	destSum  string
+	destPath string
 }
 
-func (e BadDestPathSha1Sum) Error() string {
-	return fmt.Sprintf("Destination file sum mismatch: expect_sha1sum=%s got=%s", e.srcSha1sum, e.destSha1sum)
+func (e BadDestPathSum) Error() string {
+	return fmt.Sprintf("Destination file %q sum mismatch: expect_sum=%s got=%s", e.destPath, e.srcSum, e.destSum)
 }
 
 // File describes a file being stored on a device.
@@ -63,9 +70,11 @@ type File struct {
 	Name          string   `json:"name"`
 	Path          string   `json:"path"`
 	Size          uint64   `json:"size"`
-	Sha1Sum       string   `json:"sha1Sum"`
+	Sum           string   `json:"sum"` // Computed with the hash algorithm of the context
 	FileType      FileType `json:"fileType"`
 	SymlinkTarget string   `json:"symlinkTarget"`
+	LinkTarget    string   `json:"linkTarget"` // The path of the file storing the data of a hardlink or duplicate
+	Source        string   `json:"source"`     // The name of the backup path the file was found in
 
 	// File metadata
 	Mode    os.FileMode `json:"mode"`
@@ -75,18 +84,76 @@ type File struct {
 	Owner   int         `json:"owner"`
 	Group   int         `json:"group"`
 
+	// The extended attributes of files and directories by name, including POSIX ACLs and SELinux labels
+	Xattrs map[string][]byte `json:"xattrs"`
+
+	// The data extents of a sparse file, nil if the file has no holes. Only the extents are stored on the devices.
+	Extents []Extent `json:"extents"`
+
 	// A destination file can be split across multiple devices
 	DestFiles []*DestFile
+
+	// Set when the source file changed every time it was copied. The destination files might not match the sum.
+	Unstable bool `json:"unstable"`
+
+	// Set when the file is unchanged since the previous sync. The destination files of the previous sync are reused and
+	// the file is not copied again. If MetaChanged is set, only the metadata of the destination files is updated. Saved
+	// with the context so a resumed sync does not copy the file again.
+	Kept        bool `json:"kept,omitempty"`
+	MetaChanged bool `json:"metaChanged,omitempty"`
+
+	// The device and inode numbers of the source file, used as the key of the hash cache
+	dev   uint64
+	inode uint64
 }
 
-// IsSplit returns true if the file is split across devices.
+// UnmarshalJSON decodes a file of a sync context. Sync contexts saved before the hash algorithm could be selected record
+// the sum as "sha1Sum".
+func (f *File) UnmarshalJSON(b []byte) error {
+	type file File // Without the UnmarshalJSON method
+	if err := json.Unmarshal(b, (*file)(f)); err != nil {
+		return err
+	}
+	if f.Sum == "" {
+		var err error
+		f.Sum, err = legacySha1Sum(b)
+		return err
+	}
+	return nil
+}
+
+// IsSplit returns true if the file, or one of its copies, is split across devices.
 func (f *File) IsSplit() bool {
-	if len(f.DestFiles) > 1 {
-		return true
+	for n := 0; n < f.Copies(); n++ {
+		if len(f.CopyDestFiles(n)) > 1 {
+			return true
+		}
 	}
 	return false
 }
 
+// Copies returns the number of copies of the file stored on the devices.
+func (f *File) Copies() int {
+	var n int
+	for _, df := range f.DestFiles {
+		if df.Copy >= n {
+			n = df.Copy + 1
+		}
+	}
+	return n
+}
+
+// CopyDestFiles returns the destination files of the copy n of the file in StartByte order.
+func (f *File) CopyDestFiles(n int) []*DestFile {
+	var dfs []*DestFile
+	for _, df := range f.DestFiles {
+		if df.Copy == n {
+			dfs = append(dfs, df)
+		}
+	}
+	return dfs
+}
+
 // Add a destination file record to the file index
 func (f *File) AddDestFile(file *DestFile) {
 	remain := f.Size - file.EndByte
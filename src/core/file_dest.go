@@ -1,6 +1,7 @@
 package core
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -9,6 +10,19 @@ import (
 	"github.com/Sirupsen/logrus"
 )
 
+// Layout is the arrangement of the destination files on a device.
+type Layout string
+
+const (
+	// LayoutUUID stores every destination file in the root of the device named with a random UUID. This is the
+	// default.
+	LayoutUUID Layout = "uuid"
+
+	// LayoutMirror recreates the directory tree of the backup path on the device. Parts of split files are named like
+	// "name.gds-part-0001-of-0003".
+	LayoutMirror Layout = "mirror"
+)
+
 // DestFile describes a destination file.
 type DestFile struct {
 	DeviceName string
@@ -16,9 +30,29 @@ type DestFile struct {
 	Size       uint64
 	StartByte  uint64
 	EndByte    uint64
-	Sha1Sum    string
+	Sum        string
+	Copy       int   // The copy of the file the destination file is part of, counting from 0
 	err        error // Used to record errors that occurr when creating or writing to the dest file.
 	done       bool  // When set to true, the file has been copied and verified at the destination
+
+	// The path of a kept destination file on a device using the mirror layout before its file was renamed or moved. The
+	// destination file is moved to Path during the sync.
+	RenamedFrom string `json:",omitempty"`
+}
+
+// UnmarshalJSON decodes a destination file of a sync context. Sync contexts saved before the hash algorithm could be
+// selected record the sum as "Sha1Sum".
+func (df *DestFile) UnmarshalJSON(b []byte) error {
+	type destFile DestFile // Without the UnmarshalJSON method
+	if err := json.Unmarshal(b, (*destFile)(df)); err != nil {
+		return err
+	}
+	if df.Sum == "" {
+		var err error
+		df.Sum, err = legacySha1Sum(b)
+		return err
+	}
+	return nil
 }
 
 // NewDestFile will return a new destination file with the UUID dest path set. If df is not nil, then the start and end bytes
@@ -36,6 +70,15 @@ func NewDestFile(f *File, d *Device, pvf *DestFile, df *DestFile) *DestFile {
 	return fp
 }
 
+// mirrorDestPath sets the destination path to the path of the source file relative to the backup path under the mount point
+// mp. If the file is split, part is the index of the destination file.
+func (df *DestFile) mirrorDestPath(mp, rel string, part, parts int) {
+	if parts > 1 {
+		rel = fmt.Sprintf("%s.gds-part-%04d-of-%04d", rel, part+1, parts)
+	}
+	df.Path = filepath.Join(mp, rel)
+}
+
 // generateDestPath will generate a new UUID destination path for the destination file using mp as the mount point.
 func (df *DestFile) generateDestPath(mp string) (err error) {
 	gid, err := NewID()
@@ -48,20 +91,29 @@ func (df *DestFile) generateDestPath(mp string) (err error) {
 
 // setMetaData sets permissions of the destination file.
 func (df *DestFile) setMetaData(f *File) error {
+	return setFileMetaData(df.Path, f)
+}
+
+// setFileMetaData sets the owner, group, access time and modification time of f on the file at path p. Both times are set
+// with nanosecond precision. Files without an access time get the modification time instead.
+func setFileMetaData(p string, f *File) error {
 	var err error
 	mTimeval := syscall.NsecToTimespec(f.ModTime.UnixNano())
+	aTimeval := mTimeval
+	if !f.AccTime.IsZero() {
+		aTimeval = syscall.NsecToTimespec(f.AccTime.UnixNano())
+	}
 	times := []syscall.Timespec{
-		mTimeval,
+		aTimeval,
 		mTimeval,
 	}
-	// err = os.Chown(f.Source.Path, f.Source.Owner, f.Source.Group)
-	err = os.Chown(df.Path, f.Owner, f.Group)
+	err = os.Lchown(p, f.Owner, f.Group)
 	if err == nil {
 		Log.WithFields(logrus.Fields{"owner": f.Owner, "group": f.Group}).Debugln("Set owner")
 		// Change the modtime of a symlink without following it
-		err = LUtimesNano(df.Path, times)
+		err = LUtimesNano(p, times)
 		if err == nil {
-			Log.WithFields(logrus.Fields{"modTime": f.ModTime}).Debugln("Set modification time")
+			Log.WithFields(logrus.Fields{"accessTime": f.AccTime, "modTime": f.ModTime}).Debugln("Set times")
 		}
 	}
 	if err != nil {
@@ -81,6 +133,11 @@ func (df *DestFile) createFile(f *File) {
 	}
 	var oFile *os.File
 	if _, lerr := os.Stat(df.Path); lerr != nil {
+		// Parent directories are needed for the mirror layout
+		if err = os.MkdirAll(filepath.Dir(df.Path), 0755); err != nil {
+			df.err = fmt.Errorf("createFile: %s", err.Error())
+			return
+		}
 		oFile, err = os.Create(df.Path)
 		err = oFile.Close()
 		if err == nil {
@@ -38,6 +38,28 @@ func (f *FileIndex) FileByName(name string) (*File, error) {
 	return nil, new(FileNotFoundError)
 }
 
+// SplitFiles returns the files that are split across devices.
+func (f *FileIndex) SplitFiles() FileIndex {
+	var files FileIndex
+	for _, file := range *f {
+		if file.IsSplit() {
+			files.Add(file)
+		}
+	}
+	return files
+}
+
+// Duplicates returns the files stored with another file of the same content.
+func (f *FileIndex) Duplicates() FileIndex {
+	var files FileIndex
+	for _, file := range *f {
+		if file.FileType == DUPLICATE {
+			files.Add(file)
+		}
+	}
+	return files
+}
+
 type destFileData struct {
 	f   *File
 	df  *DestFile
@@ -0,0 +1,93 @@
+package core
+
+import "fmt"
+
+// Arithmetic in the Galois field GF(2^8) used by the Reed-Solomon parity. Addition is XOR, multiplication uses the
+// logarithm tables of the generator 2 with the polynomial x^8 + x^4 + x^3 + x^2 + 1.
+var gfExp, gfLog = gfTables()
+
+func gfTables() (exp [512]byte, log [256]byte) {
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		log[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	// Multiplication does not need to reduce the sum of the logarithms
+	for i := 255; i < 512; i++ {
+		exp[i] = exp[i-255]
+	}
+	return
+}
+
+// gfMul returns a * b.
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+// gfInv returns the multiplicative inverse of a, which must not be zero.
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// gfMulAdd adds c * src to dst, byte by byte.
+func gfMulAdd(dst, src []byte, c byte) {
+	switch c {
+	case 0:
+		return
+	case 1:
+		for i, b := range src {
+			dst[i] ^= b
+		}
+		return
+	}
+	lc := int(gfLog[c])
+	for i, b := range src {
+		if b != 0 {
+			dst[i] ^= gfExp[lc+int(gfLog[b])]
+		}
+	}
+}
+
+// gfInvert returns the inverse of the square matrix m using Gauss-Jordan elimination. m is not changed.
+func gfInvert(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	a := make([][]byte, n)
+	inv := make([][]byte, n)
+	for i := range m {
+		a[i] = append([]byte(nil), m[i]...)
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+	for col := 0; col < n; col++ {
+		p := col
+		for p < n && a[p][col] == 0 {
+			p++
+		}
+		if p == n {
+			return nil, fmt.Errorf("gfInvert: singular matrix")
+		}
+		a[col], a[p] = a[p], a[col]
+		inv[col], inv[p] = inv[p], inv[col]
+		c := gfInv(a[col][col])
+		for j := 0; j < n; j++ {
+			a[col][j] = gfMul(a[col][j], c)
+			inv[col][j] = gfMul(inv[col][j], c)
+		}
+		for r := 0; r < n; r++ {
+			if r == col || a[r][col] == 0 {
+				continue
+			}
+			f := a[r][col]
+			gfMulAdd(a[r], a[col], f)
+			gfMulAdd(inv[r], inv[col], f)
+		}
+	}
+	return inv, nil
+}
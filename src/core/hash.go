@@ -0,0 +1,106 @@
+package core
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// HashAlgorithm is the name of the hash function used to compute the sums of the source and destination files.
+type HashAlgorithm string
+
+const (
+	HashSHA1    HashAlgorithm = "sha1" // The default, used by sync contexts that do not record an algorithm
+	HashSHA256  HashAlgorithm = "sha256"
+	HashSHA512  HashAlgorithm = "sha512"
+	HashBLAKE2b HashAlgorithm = "blake2b" // BLAKE2b-512
+)
+
+// hashAlgorithms maps the known algorithms to their hash constructors and the name of the checksum file written to the
+// devices. The checksum files can be checked with the coreutils tool of the same name, like "sha1sum -c SHA1SUMS".
+var hashAlgorithms = map[HashAlgorithm]struct {
+	new      func() hash.Hash
+	sumsFile string
+}{
+	HashSHA1:    {sha1.New, "SHA1SUMS"},
+	HashSHA256:  {sha256.New, "SHA256SUMS"},
+	HashSHA512:  {sha512.New, "SHA512SUMS"},
+	HashBLAKE2b: {newBlake2b, "B2SUMS"},
+}
+
+// newBlake2b returns an unkeyed BLAKE2b-512 hash.
+func newBlake2b() hash.Hash {
+	// New512 only fails for keys longer than 64 bytes
+	h, _ := blake2b.New512(nil)
+	return h
+}
+
+// ContextFileBadHashAlgorithm is an error returned by ContextFromPath(). It indicates the hash algorithm is unknown.
+type ContextFileBadHashAlgorithm struct {
+	HashAlgorithm HashAlgorithm
+}
+
+// Error satisfies the Error interface.
+func (e ContextFileBadHashAlgorithm) Error() string {
+	return fmt.Sprintf("Unknown hash algorithm %q", e.HashAlgorithm)
+}
+
+// checkHashAlgorithm returns ContextFileBadHashAlgorithm if a is not a known algorithm.
+func checkHashAlgorithm(a HashAlgorithm) error {
+	if _, ok := hashAlgorithms[a]; !ok {
+		return ContextFileBadHashAlgorithm{a}
+	}
+	return nil
+}
+
+// New returns a new hash using the algorithm. SHA-1 is used if the algorithm is not known.
+func (a HashAlgorithm) New() hash.Hash {
+	if h, ok := hashAlgorithms[a]; ok {
+		return h.new()
+	}
+	return sha1.New()
+}
+
+// SumsFileName returns the name of the checksum file written to the root of every device.
+func (a HashAlgorithm) SumsFileName() string {
+	if h, ok := hashAlgorithms[a]; ok {
+		return h.sumsFile
+	}
+	return hashAlgorithms[HashSHA1].sumsFile
+}
+
+// fileSum returns the hex encoded sum of the file at filePath using the algorithm a.
+func fileSum(a HashAlgorithm, filePath string) (sum string, err error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		err = fmt.Errorf("fileSum: %s", err.Error())
+		return
+	}
+	defer f.Close()
+	h := a.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		err = fmt.Errorf("fileSum: %s", err.Error())
+		return
+	}
+	sum = hex.EncodeToString(h.Sum(nil))
+	return
+}
+
+// legacySha1Sum returns the sum of a file or destination file encoded in b by a sync context saved before the hash
+// algorithm could be selected. Those contexts always use SHA-1.
+func legacySha1Sum(b []byte) (string, error) {
+	var v struct {
+		Sha1Sum string `json:"sha1Sum"`
+	}
+	err := json.Unmarshal(b, &v)
+	return v.Sha1Sum, err
+}
@@ -0,0 +1,122 @@
+package core
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// HashCacheFileName is the name of the gzip compressed hash cache file saved to the configuration directory.
+const HashCacheFileName = "hash_cache.json.gz"
+
+// HashCacheEntry is the sum of a source file. The sum is valid as long as the size, modification time and change time of
+// the file are unchanged.
+type HashCacheEntry struct {
+	Path    string    `json:"path"`
+	Size    uint64    `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	ChgTime time.Time `json:"changeTime"`
+	Sum     string    `json:"sum"`
+}
+
+// HashCache records the sums of the source files between syncs so unchanged files are not hashed again. The entries are
+// keyed by the device and inode numbers of the files.
+type HashCache struct {
+	HashAlgorithm HashAlgorithm             `json:"hashAlgorithm"`
+	Entries       map[string]HashCacheEntry `json:"entries"`
+
+	path string
+}
+
+// NewHashCache returns an empty hash cache that is saved to path.
+func NewHashCache(path string) *HashCache {
+	return &HashCache{Entries: make(map[string]HashCacheEntry), path: path}
+}
+
+// HashCacheFromPath loads the hash cache saved at path. An empty cache is returned if the file does not exist.
+func HashCacheFromPath(path string) (*HashCache, error) {
+	hc := NewHashCache(path)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return hc, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return nil, fmt.Errorf("HashCacheFromPath: %s", err)
+	}
+	defer gz.Close()
+	if err := json.NewDecoder(gz).Decode(hc); err != nil {
+		return nil, fmt.Errorf("HashCacheFromPath: %s", err)
+	}
+	if hc.Entries == nil {
+		hc.Entries = make(map[string]HashCacheEntry)
+	}
+	return hc, nil
+}
+
+// hashCacheKey returns the key of the cache entry of f. Files with the same path on different filesystems, or a file
+// replaced by another one, have different keys.
+func hashCacheKey(f *File) string {
+	return fmt.Sprintf("%d:%d", f.dev, f.inode)
+}
+
+// Lookup returns the cached sum of f computed with the hash algorithm a. False is returned if there is no entry or if the
+// file has changed since the sum was computed.
+func (hc *HashCache) Lookup(a HashAlgorithm, f *File) (string, bool) {
+	if hc == nil || hc.HashAlgorithm != a || f.inode == 0 {
+		return "", false
+	}
+	e, ok := hc.Entries[hashCacheKey(f)]
+	if !ok || e.Size != f.Size || !e.ModTime.Equal(f.ModTime) || !e.ChgTime.Equal(f.ChgTime) || e.Sum == "" {
+		return "", false
+	}
+	return e.Sum, true
+}
+
+// Update replaces the entries of the cache with the sums of files computed with the hash algorithm a. Entries of files
+// that are no longer in files are removed.
+func (hc *HashCache) Update(a HashAlgorithm, files FileIndex) {
+	hc.HashAlgorithm = a
+	hc.Entries = make(map[string]HashCacheEntry)
+	for _, f := range files {
+		if f.FileType != FILE || f.Sum == "" || f.inode == 0 {
+			continue
+		}
+		hc.Entries[hashCacheKey(f)] = HashCacheEntry{f.Path, f.Size, f.ModTime, f.ChgTime, f.Sum}
+	}
+}
+
+// Save writes the cache to its path. The file is replaced only once it is written completely.
+func (hc *HashCache) Save() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(hc.path), filepath.Base(hc.path)+".")
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(tmp)
+	err = json.NewEncoder(gz).Encode(hc)
+	if err == nil {
+		err = gz.Close()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), hc.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	Log.WithFields(logrus.Fields{"path": hc.path, "entries": len(hc.Entries)}).Infoln("Saved hash cache")
+	return nil
+}
@@ -0,0 +1,88 @@
+package core
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// TestHashCache hashes a copy of the freebooks test data, then checks only changed files are hashed again using the saved
+// hash cache.
+func TestHashCache(t *testing.T) {
+	src := NewMountPoint(t, testTempDir, "source-")
+	if out, err := exec.Command("cp", "-a", "../../testdata/filesync_freebooks/.", src).CombinedOutput(); err != nil {
+		t.Fatalf("EXPECT: No errors from cp GOT: %s (%s)", err, out)
+	}
+	cachePath := filepath.Join(NewMountPoint(t, testTempDir, "config-"), HashCacheFileName)
+
+	// hash gathers the source files and returns the names of the files that are hashed
+	hash := func(a HashAlgorithm, hc *HashCache) (FileIndex, []string) {
+		c, err := NewContext(src, 0, FileIndex{}, DeviceList{
+			&Device{Name: "Test Device 0", SizeTotal: 28173338480, MountPoint: "/mnt/test"},
+		}, 0)
+		if err != nil {
+			t.Fatalf("EXPECT: No errors from NewContext() GOT: %s", err)
+		}
+		errs := make(chan error)
+		go func() {
+			for err := range errs {
+				t.Error(err)
+			}
+		}()
+		h := NewSourceFileHashComputer(a, c.FileIndex, hc, errs)
+		go func() {
+			for range h.Reports {
+			}
+		}()
+		h.ComputeAll(c.Done)
+		close(errs)
+		var names []string
+		for _, f := range h.Files {
+			names = append(names, f.FileName)
+		}
+		sort.Strings(names)
+		for _, f := range c.FileIndex {
+			if f.FileType != FILE {
+				continue
+			}
+			if sum, err := fileSum(a, f.Path); err != nil || sum != f.Sum {
+				t.Errorf("EXPECT: Sum %q for %q GOT: %q (%v)", sum, f.Path, f.Sum, err)
+			}
+		}
+		return c.FileIndex, names
+	}
+
+	hc, err := HashCacheFromPath(cachePath)
+	if err != nil {
+		t.Fatalf("EXPECT: No errors from HashCacheFromPath() GOT: %s", err)
+	}
+	files, hashed := hash(HashSHA1, hc)
+	if len(hashed) != 3 {
+		t.Errorf("EXPECT: 3 files hashed without a cache GOT: %q", hashed)
+	}
+	hc.Update(HashSHA1, files)
+	if err := hc.Save(); err != nil {
+		t.Fatalf("EXPECT: No errors from Save() GOT: %s", err)
+	}
+
+	// Touch a file, its change time and modification time are updated
+	touched := "ulysses_by_james_joyce_gutenberg.org.htm"
+	now := time.Now().Add(time.Second)
+	if err := os.Chtimes(filepath.Join(src, "ulysses", touched), now, now); err != nil {
+		t.Fatal(err)
+	}
+	if hc, err = HashCacheFromPath(cachePath); err != nil {
+		t.Fatalf("EXPECT: No errors from HashCacheFromPath() GOT: %s", err)
+	}
+	if _, hashed = hash(HashSHA1, hc); len(hashed) != 1 || hashed[0] != touched {
+		t.Errorf("EXPECT: Only %q is hashed GOT: %q", touched, hashed)
+	}
+
+	// The cached sums cannot be used with another algorithm
+	if _, hashed = hash(HashSHA256, hc); len(hashed) != 3 {
+		t.Errorf("EXPECT: 3 files hashed using another algorithm GOT: %q", hashed)
+	}
+}
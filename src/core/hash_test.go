@@ -0,0 +1,126 @@
+package core
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// testSum is the SHA-1 sum of "abc".
+const testSum = "a9993e364706816aba3e25717850c26c9cd0d89d"
+
+func TestBlake2b(t *testing.T) {
+	// The expected sums of the counting data are from b2sum
+	counting := func(n int) string {
+		b := make([]byte, n)
+		for x := range b {
+			b[x] = byte(x)
+		}
+		return string(b)
+	}
+	tests := []struct {
+		data   string
+		expect string
+	}{
+		{"", "786a02f742015903c6c6fd852552d272912f4740e15847618a86e217f71f5419d25e1031afee585313896444934eb04b903a685b1448b755d56f701afe9be2ce"},
+		{"abc", "ba80a53f981c4d0d6a2797b69f12f6e94c212f14685ac4b74b12bb6fdbffa2d17d87c5392aab792dc252d5de4533cc9518d38aa8dbf1925ab92386edd4009923"},
+		{counting(128), "2319e3789c47e2daa5fe807f61bec2a1a6537fa03f19ff32e87eecbfd64b7e0e8ccff439ac333b040f19b0c4ddd11a61e24ac1fe0f10a039806c5dcc0da3d115"},
+		{counting(129), "f59711d44a031d5f97a9413c065d1e614c417ede998590325f49bad2fd444d3e4418be19aec4e11449ac1a57207898bc57d76a1bcf3566292c20c683a5c4648f"},
+		{counting(1000), "9fe687126e6566313081b43167cbfa0b4f721b45a5afd4076af327765d63a616478ffbd1cd5fbe4033e8638b8bcf8de6b3978b54a30f1d9d8d68fbe66c2b74cf"},
+	}
+	for _, test := range tests {
+		// Write in uneven pieces to cross the block boundaries
+		for _, size := range []int{1, 7, 128, 1000} {
+			h := newBlake2b()
+			for d := test.data; len(d) > 0; {
+				n := size
+				if n > len(d) {
+					n = len(d)
+				}
+				h.Write([]byte(d[:n]))
+				d = d[n:]
+			}
+			if got := hex.EncodeToString(h.Sum(nil)); got != test.expect {
+				t.Errorf("EXPECT: blake2b of %d bytes written %d at a time == %s GOT: %s", len(test.data), size,
+					test.expect, got)
+			}
+		}
+	}
+}
+
+// hashAlgorithmContext returns a context syncing the freebooks test data to the split devices using the hash algorithm a.
+func hashAlgorithmContext(t *testing.T, a HashAlgorithm) func() *Context {
+	return func() *Context {
+		c, err := NewContext("../../testdata/filesync_freebooks", 0, FileIndex{}, splitDevices(t)(), 0)
+		if err != nil {
+			t.Fatalf("EXPECT: No errors from NewContext() GOT: %s", err)
+		}
+		c.HashAlgorithm = a
+		return c
+	}
+}
+
+// TestVerifyHashAlgorithm verifies the sums recorded with BLAKE2b using the algorithm saved in the sync context.
+func TestVerifyHashAlgorithm(t *testing.T) {
+	v := &verifyTest{t: t,
+		sync: &syncTest{t: t, context: hashAlgorithmContext(t, HashBLAKE2b)},
+		beforeVerify: func(c *Context) {
+			if c.HashAlgorithm != HashBLAKE2b {
+				t.Errorf("EXPECT: Hash algorithm %q in the sync context GOT: %q", HashBLAKE2b, c.HashAlgorithm)
+			}
+		},
+		expectReports: []VerifyDeviceReport{
+			{DeviceName: "Test Device 0", Checked: 3},
+			{DeviceName: "Test Device 1", Checked: 1},
+		},
+	}
+	v.Run()
+}
+
+// TestRestoreHashAlgorithm restores files synced with SHA-512.
+func TestRestoreHashAlgorithm(t *testing.T) {
+	r := &restoreTest{t: t,
+		sync: &syncTest{t: t, context: hashAlgorithmContext(t, HashSHA512)},
+	}
+	r.Run()
+	if !t.Failed() && r.ctx.HashAlgorithm != HashSHA512 {
+		t.Errorf("EXPECT: Hash algorithm %q in the sync context GOT: %q", HashSHA512, r.ctx.HashAlgorithm)
+	}
+}
+
+// TestSyncContextLegacySha1Sum loads a sync context saved before the hash algorithm could be selected.
+func TestSyncContextLegacySha1Sum(t *testing.T) {
+	p := filepath.Join(NewMountPoint(t, testTempDir, "context-"), "context.json")
+	data := `{"backupPath":"/src","fileIndex":[{"name":"a","path":"/src/a","size":3,"sha1Sum":"` + testSum + `",` +
+		`"DestFiles":[{"DeviceName":"Test Device 0","Path":"/mnt/a","Size":3,"EndByte":3,"Sha1Sum":"` + testSum + `"}]}],` +
+		`"devices":[{"Name":"Test Device 0","MountPoint":"/mnt","SizeTotal":1000}]}`
+	if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := SyncContextFromPath(p)
+	if err != nil {
+		t.Fatalf("EXPECT: No errors from SyncContextFromPath() GOT: %s", err)
+	}
+	if c.HashAlgorithm != HashSHA1 {
+		t.Errorf("EXPECT: Hash algorithm %q GOT: %q", HashSHA1, c.HashAlgorithm)
+	}
+	if len(c.FileIndex) != 1 || c.FileIndex[0].Sum != testSum || c.FileIndex[0].DestFiles[0].Sum != testSum {
+		t.Errorf("EXPECT: File and destination file sum %q GOT: %s", testSum, spd.Sdump(c.FileIndex))
+	}
+}
+
+func TestContextBadHashAlgorithm(t *testing.T) {
+	_, err := NewContextFromYaml([]byte(`
+backupPath: /tmp
+hashAlgorithm: md5
+devices:
+  - name: Test Device 0
+    uuid: test-device-0
+    sizeTotal: 1000
+    mountPoint: /mnt/test
+`))
+	if expect := (ContextFileBadHashAlgorithm{"md5"}); err != expect {
+		t.Errorf("EXPECT: %v GOT: %v", expect, err)
+	}
+}
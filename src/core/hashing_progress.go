@@ -1,7 +1,6 @@
 package core
 
 import (
-	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -22,53 +21,81 @@ type HashFile struct {
 	SizeWritnLast  uint64 // The number of bytes written since the last update
 	SizeTotal      uint64
 	BytesPerSecond *BytesPerSecond
-	file           *File
+	offset         uint64  // The start byte of the hashed data
+	part           bool    // If true, only SizeTotal bytes starting at offset are hashed
+	sum            *string // The computed hash is saved here
+}
+
+// NewHashFile returns a file to be hashed by a HashComputer. If part is true, only size bytes starting at offset are hashed,
+// otherwise the whole file is hashed. Once computed, the hash is saved to sum.
+func NewHashFile(name string, path string, offset uint64, size uint64, part bool, sum *string) HashFile {
+	return HashFile{
+		FileName:       name,
+		FilePath:       path,
+		SizeTotal:      size,
+		BytesPerSecond: NewBytesPerSecond(size),
+		offset:         offset,
+		part:           part,
+		sum:            sum,
+	}
 }
 
 // HashComputer is the main hashing abstraction.
 type HashComputer struct {
-	Reports chan HashFile
-	Files   []HashFile
-	Errors  chan error
+	Reports   chan HashFile
+	Files     []HashFile
+	Errors    chan error
+	Algorithm HashAlgorithm
+}
+
+// NewHashComputer returns a new hashing computer for files using the hash algorithm a.
+func NewHashComputer(a HashAlgorithm, files []HashFile, errChan chan error) *HashComputer {
+	return &HashComputer{
+		Reports:   make(chan HashFile),
+		Files:     files,
+		Errors:    errChan,
+		Algorithm: a,
+	}
 }
 
-// NewSourceFileHashComputer returns a new hashing computer build from Files.
-func NewSourceFileHashComputer(files FileIndex, errChan chan error) *HashComputer {
+// NewSourceFileHashComputer returns a new hashing computer build from Files. Files unchanged since the previous sync already
+// have the sum of the previous sync and are not hashed. Files hashed by the incremental sync to compare them to the
+// previous sync or to find renamed files already have their sum as well. Files with a valid entry in the hash cache hc
+// get the cached sum and are not hashed either, hc may be nil.
+func NewSourceFileHashComputer(a HashAlgorithm, files FileIndex, hc *HashCache, errChan chan error) *HashComputer {
 	var nFiles []HashFile
+	var cached int
 	for _, f := range files {
-		if f.FileType == FILE && !strings.Contains(f.Path, fakeTestPath) {
-			nFiles = append(nFiles, HashFile{
-				FileName:       f.Name,
-				FilePath:       f.Path,
-				SizeTotal:      f.Size,
-				file:           f,
-				BytesPerSecond: NewBytesPerSecond(f.Size),
-			})
+		if f.FileType != FILE || f.Kept || f.Sum != "" || strings.Contains(f.Path, fakeTestPath) {
+			continue
 		}
+		if sum, ok := hc.Lookup(a, f); ok {
+			f.Sum = sum
+			cached++
+			continue
+		}
+		nFiles = append(nFiles, NewHashFile(f.Name, f.Path, 0, f.Size, false, &f.Sum))
 	}
-	return &HashComputer{
-		Reports: make(chan HashFile),
-		Files:   nFiles,
-		Errors:  errChan,
-	}
+	Log.WithFields(logrus.Fields{"files": len(nFiles), "cached": cached}).Infoln("Source files to hash")
+	return NewHashComputer(a, nFiles, errChan)
 }
 
 func (h *HashComputer) report(wg *sync.WaitGroup, bw chan uint64, file HashFile) {
 	defer wg.Done()
 	for {
-		if b, ok := <-bw; ok {
-			file.SizeWritn += b
-			file.SizeWritnLast = b
-			file.BytesPerSecond.AddPoint(b)
-			h.Reports <- file
-			if file.SizeWritn == file.SizeTotal {
-				break
-			}
+		b, ok := <-bw
+		if !ok {
+			break
 		}
+		file.SizeWritn += b
+		file.SizeWritnLast = b
+		file.BytesPerSecond.AddPoint(b)
+		h.Reports <- file
 	}
 }
 
-func (h *HashComputer) calc(f HashFile, done chan bool) {
+// calc computes the hash of f. A value is sent on done when finished. If quit is closed, the computation is stopped.
+func (h *HashComputer) calc(f HashFile, done chan bool, quit chan bool) {
 	var sum string
 	bw := make(chan uint64)
 	var wg sync.WaitGroup
@@ -76,10 +103,10 @@ func (h *HashComputer) calc(f HashFile, done chan bool) {
 	wg.Add(1)
 	go h.report(&wg, bw, f)
 
-	Log.WithFields(logrus.Fields{"filePath": f.FilePath}).Infof("Computing sha1")
+	Log.WithFields(logrus.Fields{"filePath": f.FilePath, "algorithm": h.Algorithm}).Infof("Computing hash")
 	tn := time.Now()
-	hash := sha1.New()
-	sio := NewIoReaderWriter(f.FilePath, hash, f.SizeTotal, bw, true, &done)
+	hash := h.Algorithm.New()
+	sio := NewIoReaderWriter(f.FilePath, hash, f.SizeTotal, bw, nil, &quit)
 
 	file, err := os.Open(f.FilePath)
 	if err != nil {
@@ -88,63 +115,52 @@ func (h *HashComputer) calc(f HashFile, done chan bool) {
 	}
 	defer file.Close()
 
-	if _, err := io.Copy(sio, file); err != nil {
-		h.Errors <- fmt.Errorf("calc: %s", err)
-		goto end
+	if f.part {
+		if _, err = file.Seek(int64(f.offset), 0); err == nil {
+			_, err = io.CopyN(sio, file, int64(f.SizeTotal))
+		}
+	} else {
+		_, err = io.Copy(sio, file)
 	}
-
-	sum = hex.EncodeToString(hash.Sum(nil))
 	if err != nil {
-		h.Errors <- err
+		h.Errors <- fmt.Errorf("calc: %s", err)
 		goto end
 	}
 
-	f.file.Sha1Sum = sum
+	sum = hex.EncodeToString(hash.Sum(nil))
+	*f.sum = sum
 
 end:
+	// Closing the channel stops the reporter if the file was not read completely
+	close(bw)
 	wg.Wait()
 	done <- true
 	Log.WithFields(logrus.Fields{"hash": sum, "filePath": f.FilePath, "time": time.Since(tn)}).Infof("Hash calc finished")
-	close(bw)
 }
 
-// ComputeAll will compute the hashes of all files. If a value is sent on the done channel, or it is closed, then the
-// function exits.
+// ComputeAll will compute the hashes of all files and returns once they are computed. If the done channel is closed, no
+// more files are hashed and the function returns once the running computations have stopped. The Reports channel is closed
+// before returning.
 func (h *HashComputer) ComputeAll(done chan bool) {
 	runs := runtime.NumCPU()
 	workDone := make(chan bool)
-	var wg sync.WaitGroup
 	x, count := 0, 0
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		for {
-			if count < runs && x < len(h.Files) {
-				wg.Add(1)
-				go h.calc(h.Files[x], workDone)
-				count++
-				x++
-			}
+	for x < len(h.Files) || count > 0 {
+		if count < runs && x < len(h.Files) {
 			select {
 			case <-done:
-				return
+				// Stop starting new computations
+				x = len(h.Files)
+				continue
 			default:
-				// runtime.Gosched() // This does not work so well here
-				time.Sleep(time.Millisecond * 5) // Don't starve the main thread
 			}
+			go h.calc(h.Files[x], workDone, done)
+			count++
+			x++
+			continue
 		}
-	}()
-
-	for {
-		select {
-		case <-workDone:
-			wg.Done()
-			count--
-		case <-done:
-			return
-		}
+		<-workDone
+		count--
 	}
-
-	wg.Wait()
 	close(h.Reports)
 }
@@ -0,0 +1,252 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// IgnoreFileName is the name of the files containing exclude patterns for the directory they are in and its subdirectories.
+const IgnoreFileName = ".gdsignore"
+
+// IgnoreBadPatternError is given when an include or exclude pattern is malformed.
+type IgnoreBadPatternError struct {
+	Pattern string
+	Source  string
+	Line    int
+}
+
+// Error implements the Error interface.
+func (e IgnoreBadPatternError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("Bad %s pattern %q", e.Source, e.Pattern)
+	}
+	return fmt.Sprintf("Bad pattern %q in %q line %d", e.Pattern, e.Source, e.Line)
+}
+
+// IgnoreRule is an include or exclude pattern with gitignore semantics. A pattern without a "/", other than a trailing one,
+// matches a name at any depth. Otherwise the pattern is matched against the path relative to the directory of the rule.
+// "**" matches any number of directories, a trailing "/" only matches directories, and a leading "!" includes the matched
+// files again.
+type IgnoreRule struct {
+	Pattern string // The pattern as written
+	Source  string // "exclude", "include", or the path of the .gdsignore file
+	Line    int    // The line number in the .gdsignore file
+
+	base    string // The directory the rule applies to, relative to the backup path
+	match   string // The pattern relative to base
+	negate  bool
+	dirOnly bool
+}
+
+// newIgnoreRule parses pattern. Nil is returned for empty lines and comments.
+func newIgnoreRule(pattern, source string, line int, base string) (*IgnoreRule, error) {
+	r := &IgnoreRule{Pattern: pattern, Source: source, Line: line, base: base}
+	p := strings.TrimRight(pattern, " ")
+	if p == "" || strings.HasPrefix(p, "#") {
+		return nil, nil
+	}
+	if strings.HasPrefix(p, "!") {
+		r.negate = true
+		p = p[1:]
+	} else if strings.HasPrefix(p, `\!`) || strings.HasPrefix(p, `\#`) {
+		p = p[1:]
+	}
+	if strings.HasSuffix(p, "/") {
+		r.dirOnly = true
+		p = strings.TrimRight(p, "/")
+	}
+	if !strings.Contains(p, "/") {
+		p = "**/" + p
+	}
+	r.match = strings.TrimPrefix(p, "/")
+	if r.match == "" || checkPattern(r.match) != nil {
+		return nil, IgnoreBadPatternError{pattern, source, line}
+	}
+	return r, nil
+}
+
+// matches returns true if the path rel, relative to the backup path, is matched by the rule.
+func (r *IgnoreRule) matches(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.base != "" {
+		if !strings.HasPrefix(rel, r.base+"/") {
+			return false
+		}
+		rel = strings.TrimPrefix(rel, r.base+"/")
+	}
+	if !matchPath(r.match, rel) {
+		return false
+	}
+	// "dir/**" matches everything inside of dir, but not dir itself
+	if p := strings.TrimSuffix(r.match, "/**"); p != r.match && matchPath(p, rel) {
+		return false
+	}
+	return true
+}
+
+// String returns the rule and where it is defined.
+func (r *IgnoreRule) String() string {
+	if r.Line == 0 {
+		return fmt.Sprintf("%s pattern %q", r.Source, r.Pattern)
+	}
+	return fmt.Sprintf("%q line %d: %q", r.Source, r.Line, r.Pattern)
+}
+
+// ignoreRules are the rules of a backup path. The last matching rule decides if a path is excluded.
+type ignoreRules []*IgnoreRule
+
+// newIgnoreRules returns the rules of the exclude and include patterns of the configuration. Include patterns are applied
+// after the exclude patterns. The rules of .gdsignore files are added during the walk.
+func (c *Context) newIgnoreRules() (ignoreRules, error) {
+	var rules ignoreRules
+	add := func(source string, patterns []string, negate bool) error {
+		for _, pattern := range patterns {
+			p := pattern
+			if negate {
+				// An include pattern is a negated exclude pattern
+				p = "!" + p
+			}
+			r, err := newIgnoreRule(p, source, 0, "")
+			if err != nil {
+				return IgnoreBadPatternError{pattern, source, 0}
+			}
+			if r != nil {
+				r.Pattern = pattern
+				rules = append(rules, r)
+			}
+		}
+		return nil
+	}
+	if err := add("exclude", c.Exclude, false); err != nil {
+		return nil, err
+	}
+	if err := add("include", c.Include, true); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// load adds the rules of the .gdsignore file in the directory dir, if it exists. rel is dir relative to the backup path.
+func (rules *ignoreRules) load(dir, rel string) error {
+	p := filepath.Join(dir, IgnoreFileName)
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	if rel == "." {
+		rel = ""
+	}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		r, err := newIgnoreRule(s.Text(), p, n, filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+		if r != nil {
+			*rules = append(*rules, r)
+		}
+	}
+	return s.Err()
+}
+
+// match returns the last rule matching rel, the path relative to the backup path. Nil is returned if no rule matches.
+func (rules ignoreRules) match(rel string, isDir bool) *IgnoreRule {
+	rel = filepath.ToSlash(rel)
+	for x := len(rules) - 1; x >= 0; x-- {
+		if rules[x].matches(rel, isDir) {
+			return rules[x]
+		}
+	}
+	return nil
+}
+
+// excluded returns true if rel is excluded by the rules.
+func (rules ignoreRules) excluded(rel string, isDir bool) bool {
+	r := rules.match(rel, isDir)
+	return r != nil && !r.negate
+}
+
+// IgnoreExplanation describes why a path is or is not synced.
+type IgnoreExplanation struct {
+	Path     string
+	Excluded bool
+	Rule     *IgnoreRule // The last rule matching the path, nil if no rule matches
+	Parent   string      // Set if the path is excluded because the directory Parent is excluded
+}
+
+// String returns the explanation in a form suitable for printing.
+func (e *IgnoreExplanation) String() string {
+	switch {
+	case e.Parent != "":
+		return fmt.Sprintf("%q is excluded, the parent directory %q is excluded by %s", e.Path, e.Parent, e.Rule)
+	case e.Rule == nil:
+		return fmt.Sprintf("%q is included, no rule matches", e.Path)
+	case e.Excluded:
+		return fmt.Sprintf("%q is excluded by %s", e.Path, e.Rule)
+	}
+	return fmt.Sprintf("%q is included by %s", e.Path, e.Rule)
+}
+
+// Explain returns which include or exclude rule decides if the path p is synced. The .gdsignore files of the directories of p
+// are read from disk.
+func (c *Context) Explain(p string) (*IgnoreExplanation, error) {
+	abs := func(p string) string {
+		if a, err := filepath.Abs(p); err == nil {
+			return a
+		}
+		return filepath.Clean(p)
+	}
+	p = abs(p)
+	root := abs(c.BackupPath)
+	for _, bp := range c.BackupPaths {
+		if inPath(abs(bp.Path), p) {
+			root = abs(bp.Path)
+		}
+	}
+	if !inPath(root, p) {
+		return nil, fmt.Errorf("Explain: %q is not in a backup path", p)
+	}
+	rules, err := c.newIgnoreRules()
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return nil, err
+	}
+	e := &IgnoreExplanation{Path: p}
+	if rel == "." {
+		return e, nil
+	}
+	// Walk down from the backup path like gatherFiles does
+	dir := "."
+	segs := strings.Split(filepath.ToSlash(rel), "/")
+	for x, s := range segs {
+		if err := rules.load(filepath.Join(root, dir), dir); err != nil {
+			return nil, err
+		}
+		dir = path.Join(dir, s)
+		isDir := x < len(segs)-1
+		if !isDir {
+			if fi, err := os.Lstat(p); err == nil {
+				isDir = fi.IsDir()
+			}
+		}
+		e.Rule = rules.match(dir, isDir)
+		e.Excluded = e.Rule != nil && !e.Rule.negate
+		if e.Excluded && isDir && x < len(segs)-1 {
+			e.Parent = filepath.Join(root, dir)
+			return e, nil
+		}
+	}
+	return e, nil
+}
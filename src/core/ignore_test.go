@@ -0,0 +1,154 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestIgnoreRuleMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		base    string
+		path    string
+		isDir   bool
+		expect  bool
+	}{
+		{"*.o", "", "a.o", false, true},
+		{"*.o", "", "src/lib/a.o", false, true},
+		{"*.o", "src", "lib/a.o", false, false},
+		{"*.o", "src", "src/lib/a.o", false, true},
+		{"/build", "", "build", true, true},
+		{"/build", "", "src/build", true, false},
+		{"doc/*.txt", "", "doc/a.txt", false, true},
+		{"doc/*.txt", "", "doc/x/a.txt", false, false},
+		{"doc/**/*.txt", "", "doc/x/y/a.txt", false, true},
+		{"**/cache", "", "a/b/cache", true, true},
+		{"cache/", "", "a/cache", true, true},
+		{"cache/", "", "a/cache", false, false},
+		{"vm/**", "", "vm", true, false},
+		{"vm/**", "", "vm/disk.img", false, true},
+		{`\#notes`, "", "#notes", false, true},
+		{"!keep.o", "", "keep.o", false, true},
+	}
+	for _, test := range tests {
+		r, err := newIgnoreRule(test.pattern, "exclude", 0, test.base)
+		if err != nil {
+			t.Fatalf("EXPECT: No errors from newIgnoreRule(%q) GOT: %s", test.pattern, err)
+		}
+		if got := r.matches(test.path, test.isDir); got != test.expect {
+			t.Errorf("EXPECT: %q (base %q) matches %q == %t GOT: %t", test.pattern, test.base, test.path,
+				test.expect, got)
+		}
+	}
+	for _, p := range []string{"", "# comment", "   "} {
+		if r, err := newIgnoreRule(p, "exclude", 0, ""); r != nil || err != nil {
+			t.Errorf("EXPECT: No rule for %q GOT: %v %v", p, r, err)
+		}
+	}
+	if _, err := newIgnoreRule("a/[", "exclude", 0, ""); err == nil {
+		t.Errorf("EXPECT: %T GOT: nil", IgnoreBadPatternError{})
+	}
+}
+
+// TestSyncExclude excludes files with patterns of the configuration and of .gdsignore files.
+func TestSyncExclude(t *testing.T) {
+	src := NewMountPoint(t, testTempDir, "source-")
+	if out, err := exec.Command("cp", "-a", "../../testdata/filesync_freebooks/.", src).CombinedOutput(); err != nil {
+		t.Fatalf("EXPECT: No errors from cp GOT: %s (%s)", err, out)
+	}
+	files := map[string]string{
+		".gdsignore":             "*.htm\n!alice/*.htm\n",
+		"alice/.gdsignore":       "# Tiny files\n.gitkeep\n",
+		"alice/.gitkeep":         "",
+		"cache/data.bin":         "cached",
+		"ulysses/notes.txt":      "notes",
+		"ulysses/cache/data.bin": "cached",
+	}
+	for p, data := range files {
+		p = filepath.Join(src, p)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := fmt.Sprintf(`
+backupPath: %q
+exclude: ["cache/", "*.txt"]
+include: ["ulysses/notes.txt"]
+devices:
+  - name: Test Device 0
+    uuid: test-device-0
+    sizeTotal: 28173338480
+    mountPoint: %q
+`, src+"/", NewMountPoint(t, testTempDir, "mountpoint-0-"))
+	s := &syncTest{t: t,
+		context: func() *Context {
+			c, err := NewContextFromYaml([]byte(config))
+			if err != nil {
+				t.Fatalf("EXPECT: No errors from NewContextFromYaml() GOT: %s", err)
+			}
+			return c
+		},
+	}
+	s.Run()
+	if t.Failed() {
+		return
+	}
+
+	var got []string
+	for _, f := range s.ctx.FileIndex {
+		rel, err := s.ctx.relPath(f.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, rel)
+	}
+	sort.Strings(got)
+	expect := []string{".gdsignore", ".gitkeep", "alice", "alice/.gdsignore",
+		"alice/alice_in_wonderland_by_lewis_carroll_gutenberg.org.htm", "ulysses", "ulysses/notes.txt"}
+	if fmt.Sprint(got) != fmt.Sprint(expect) {
+		t.Errorf("EXPECT: Files %q GOT: %q", expect, got)
+	}
+
+	c, err := configFromYaml([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	explain := []struct {
+		path     string
+		excluded bool
+		rule     string
+		parent   string
+	}{
+		{"ulysses/ulysses_by_james_joyce_gutenberg.org.htm", true, "*.htm", ""},
+		{"alice/alice_in_wonderland_by_lewis_carroll_gutenberg.org.htm", false, "!alice/*.htm", ""},
+		{"alice/.gitkeep", true, ".gitkeep", ""},
+		{"ulysses/notes.txt", false, "ulysses/notes.txt", ""},
+		{"ulysses/cache/data.bin", true, "cache/", "ulysses/cache"},
+		{"ulysses", false, "", ""},
+	}
+	for _, x := range explain {
+		e, err := c.Explain(filepath.Join(src, x.path))
+		if err != nil {
+			t.Fatalf("EXPECT: No errors from Explain(%q) GOT: %s", x.path, err)
+		}
+		var rule string
+		if e.Rule != nil {
+			rule = e.Rule.Pattern
+		}
+		var parent string
+		if e.Parent != "" {
+			parent = filepath.Join(src, x.parent)
+		}
+		if e.Excluded != x.excluded || rule != x.rule || e.Parent != parent {
+			t.Errorf("EXPECT: %q excluded: %t rule: %q parent: %q GOT: %s", x.path, x.excluded, x.rule, x.parent, e)
+		}
+	}
+}
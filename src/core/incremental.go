@@ -0,0 +1,358 @@
+package core
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// previousDestFile returns a copy of the destination file of the previous sync. Nil is returned if the device is no longer
+// part of the device pool.
+func (c *Context) previousDestFile(pdf *DestFile) *DestFile {
+	if _, err := c.Devices.DeviceByName(pdf.DeviceName); err != nil {
+		return nil
+	}
+	df := *pdf
+	df.done = false
+	return &df
+}
+
+// rebaseDestPaths changes the paths of the destination files of the previous sync to the current mount points of the
+// devices.
+func (c *Context) rebaseDestPaths(prev *Context) {
+	rebase := func(pdf *DestFile) {
+		d, err := c.Devices.DeviceByName(pdf.DeviceName)
+		if err != nil {
+			return
+		}
+		pd, err := prev.Devices.DeviceByName(pdf.DeviceName)
+		if err != nil {
+			return
+		}
+		if rel, err := filepath.Rel(pd.MountPoint, pdf.Path); err == nil {
+			pdf.Path = filepath.Join(d.MountPoint, rel)
+		}
+	}
+	for _, pf := range prev.FileIndex {
+		for _, pdf := range pf.DestFiles {
+			rebase(pdf)
+		}
+	}
+	for _, pdf := range prev.OrphanedDestFiles {
+		rebase(pdf)
+	}
+}
+
+// reusable returns true if the destination files of pf from the previous sync can be used for f.
+func (c *Context) reusable(f, pf *File) bool {
+	if f.FileType != FILE || pf.FileType != FILE || f.Size != pf.Size || len(pf.DestFiles) == 0 {
+		return false
+	}
+	if pf.Unstable {
+		// The destination files might not match the source file, it is copied again
+		return false
+	}
+	if r, err := c.placementRule(f); err != nil || pf.Copies() != c.fileCopies(r) {
+		// The number of copies has changed
+		return false
+	}
+	for _, df := range pf.DestFiles {
+		if _, err := c.Devices.DeviceByName(df.DeviceName); err != nil {
+			// The device is no longer part of the device pool
+			return false
+		}
+	}
+	return true
+}
+
+// reuseDestFiles sets the destination files of f to the destination files of pf from the previous sync.
+func (c *Context) reuseDestFiles(f, pf *File) {
+	f.MetaChanged = !f.ModTime.Equal(pf.ModTime) || f.Mode != pf.Mode || f.Owner != pf.Owner || f.Group != pf.Group ||
+		!reflect.DeepEqual(f.Xattrs, pf.Xattrs)
+	f.Kept = true
+	f.Sum = pf.Sum
+	for _, pdf := range pf.DestFiles {
+		df := c.previousDestFile(pdf)
+		df.done = !f.MetaChanged
+		f.AddDestFile(df)
+	}
+}
+
+// sourceSum returns the sum of the source file f. The file is hashed only once, the sum is kept on f so the hashing
+// phase does not read the file again if it is not kept.
+func (c *Context) sourceSum(f *File) (string, error) {
+	if f.Sum == "" {
+		sum, err := fileSum(c.HashAlgorithm, f.Path)
+		if err != nil {
+			return "", err
+		}
+		f.Sum = sum
+	}
+	return f.Sum, nil
+}
+
+// previousFile compares f to the file with the same path in the previous sync context. The destination files of the
+// previous sync are reused if the file is unchanged. A file that has the same size, but a different modification time is
+// hashed and compared to the sum recorded in the previous sync context.
+func (c *Context) previousFile(f, pf *File) bool {
+	if !c.reusable(f, pf) {
+		return false
+	}
+	if !f.ModTime.Equal(pf.ModTime) {
+		if pf.Sum == "" {
+			return false
+		}
+		sum, err := c.sourceSum(f)
+		if err != nil || sum != pf.Sum {
+			return false
+		}
+	}
+	c.reuseDestFiles(f, pf)
+	Log.WithFields(logrus.Fields{
+		"filePath": f.Path, "metaChanged": f.MetaChanged,
+	}).Debugln("Using destination files of previous sync")
+	return true
+}
+
+// renamedFile looks for a file of the previous sync with the same size and sum as f that is not used by any other file.
+// If one is found, f has been renamed or moved and the destination files of the previous sync are used.
+func (c *Context) renamedFile(f *File, unused map[uint64][]*File) bool {
+	if f.FileType != FILE || len(unused[f.Size]) == 0 {
+		return false
+	}
+	sum, err := c.sourceSum(f)
+	if err != nil {
+		return false
+	}
+	for x, pf := range unused[f.Size] {
+		if pf.Sum != sum || !c.reusable(f, pf) {
+			continue
+		}
+		c.reuseDestFiles(f, pf)
+		unused[f.Size] = append(unused[f.Size][:x], unused[f.Size][x+1:]...)
+		Log.WithFields(logrus.Fields{
+			"filePath": f.Path, "previousFilePath": pf.Path, "metaChanged": f.MetaChanged,
+		}).Infoln("File renamed since previous sync")
+		return true
+	}
+	return false
+}
+
+// mirrorKeptPaths moves the kept destination files on devices using the mirror layout to the paths of their files, so a
+// renamed or moved file is renamed on the device instead of keeping the path of the previous sync. A path still used by
+// another kept destination file gets a numbered suffix. The previous path is recorded in RenamedFrom.
+func (c *Context) mirrorKeptPaths() error {
+	used := make(map[string]bool)
+	for _, f := range c.FileIndex {
+		if f.Kept {
+			for _, df := range f.DestFiles {
+				used[df.Path] = true
+			}
+		}
+	}
+	for _, f := range c.FileIndex {
+		if !f.Kept {
+			continue
+		}
+		rel, err := c.relPath(f.Path)
+		if err != nil {
+			return err
+		}
+		for n := 0; n < f.Copies(); n++ {
+			dfs := f.CopyDestFiles(n)
+			for x, df := range dfs {
+				d, err := c.Devices.DeviceByName(df.DeviceName)
+				if err != nil {
+					return err
+				}
+				if d.Layout != LayoutMirror {
+					continue
+				}
+				m := DestFile{}
+				m.mirrorDestPath(d.MountPoint, rel, x, len(dfs))
+				p := m.Path
+				for i := 1; p != df.Path && (used[p] || metadataPath(d.MountPoint, p)); i++ {
+					p = fmt.Sprintf("%s.gds-%d", m.Path, i)
+				}
+				if p == df.Path {
+					continue
+				}
+				Log.WithFields(logrus.Fields{
+					"filePath": f.Path, "destPath": p, "previousDestPath": df.Path,
+				}).Infoln("Destination file is moved to the path of its file")
+				used[p] = true
+				df.RenamedFrom, df.Path = df.Path, p
+				df.done = false
+			}
+		}
+	}
+	return nil
+}
+
+// Incremental catalogs the file index using the previous sync context prev. Files that are unchanged since the previous
+// sync, compared by path, size, modification time, and sum, keep their destination files. Files with the same sum as a
+// file of the previous sync that no longer exists have been renamed and also keep their destination files. The
+// destination files of the previous sync that are not used anymore are recorded as orphans, they are removed from the
+// devices during the sync. On devices using the mirror layout, the kept destination files of renamed files are moved to
+// their new paths. New and modified files are cataloged into the free space of the devices.
+func (c *Context) Incremental(prev *Context) error {
+	// The mount point of a device may have changed
+	c.rebaseDestPaths(prev)
+	prevFiles := make(map[string]*File)
+	for _, pf := range prev.FileIndex {
+		prevFiles[pf.Path] = pf
+	}
+	if prev.HashAlgorithm != c.HashAlgorithm {
+		// The sums of the previous sync cannot be compared or reused, so every file is copied again
+		Log.WithFields(logrus.Fields{
+			"hashAlgorithm": c.HashAlgorithm, "previousHashAlgorithm": prev.HashAlgorithm,
+		}).Warnln("Hash algorithm changed since the previous sync, no destination files are reused")
+		prevFiles = nil
+	}
+	used := make(map[*File]bool)
+	for _, f := range c.FileIndex {
+		f.DestFiles = nil
+		f.Kept = false
+		f.MetaChanged = false
+		if pf, ok := prevFiles[f.Path]; ok && c.previousFile(f, pf) {
+			used[pf] = true
+		}
+	}
+
+	// Files of the previous sync that can be the source of a rename, by size
+	unused := make(map[uint64][]*File)
+	for _, pf := range prev.FileIndex {
+		if !used[pf] && pf.FileType == FILE && pf.Sum != "" && prevFiles != nil {
+			unused[pf.Size] = append(unused[pf.Size], pf)
+		}
+	}
+	for _, f := range c.FileIndex {
+		if !f.Kept {
+			c.renamedFile(f, unused)
+		}
+	}
+
+	if err := c.mirrorKeptPaths(); err != nil {
+		return err
+	}
+
+	// Record the orphaned destination files
+	kept := make(map[string]bool)
+	for _, f := range c.FileIndex {
+		for _, df := range f.DestFiles {
+			kept[df.Path] = true
+			if df.RenamedFrom != "" {
+				kept[df.RenamedFrom] = true
+			}
+		}
+	}
+	c.OrphanedDestFiles = nil
+	orphans := prev.OrphanedDestFiles
+	for _, pf := range prev.FileIndex {
+		orphans = append(orphans, pf.DestFiles...)
+	}
+	for _, pdf := range orphans {
+		df := c.previousDestFile(pdf)
+		if df == nil {
+			Log.WithFields(logrus.Fields{
+				"destPath": pdf.Path, "device": pdf.DeviceName,
+			}).Warnln("Orphaned destination file is on a device that is no longer used")
+			continue
+		}
+		if !kept[df.Path] {
+			c.OrphanedDestFiles = append(c.OrphanedDestFiles, df)
+		}
+	}
+
+	// The empty directories of deleted directories are removed from the devices using the mirror layout
+	c.deletedDirs = nil
+	dirs := make(map[string]bool)
+	for _, f := range c.FileIndex {
+		if f.FileType == DIRECTORY {
+			dirs[f.Path] = true
+		}
+	}
+	for _, pf := range prev.FileIndex {
+		if pf.FileType == DIRECTORY && !dirs[pf.Path] {
+			c.deletedDirs = append(c.deletedDirs, pf.Path)
+		}
+	}
+
+	// Only the destination files still in use and the previous sync context take up space. The space of orphaned
+	// destination files is freed before copying to the device.
+	for _, d := range c.Devices {
+		d.SizeUsed = 0
+		// The manifest and checksum files are replaced when the device is synced
+		if pd, err := prev.Devices.DeviceByName(d.Name); err == nil {
+			d.ManifestSize = pd.ManifestSize
+			d.SumsSize = pd.SumsSize
+		}
+	}
+	for _, f := range c.FileIndex {
+		for _, df := range f.DestFiles {
+			if d, err := c.Devices.DeviceByName(df.DeviceName); err == nil {
+				d.SizeUsed += f.allocated(df.StartByte, df.EndByte)
+			}
+		}
+	}
+	if len(prev.Devices) > 0 {
+		if d, err := c.Devices.DeviceByName(prev.Devices[len(prev.Devices)-1].Name); err == nil {
+			d.SizeUsed += prev.SyncContextSize
+		}
+	}
+	if err := c.catalogFiles(); err != nil {
+		return err
+	}
+	c.keepParity(prev)
+	c.reuseOrphanPaths()
+	Log.WithFields(logrus.Fields{
+		"files": len(c.FileIndex), "changedFiles": len(c.ChangedFiles()), "orphans": len(c.OrphanedDestFiles),
+	}).Infoln("Incremental sync")
+	return nil
+}
+
+// reuseOrphanPaths removes the orphaned destination files with the path of a destination file from the orphans. With the
+// mirror layout, a modified file is copied to the path of its previous destination file. The file is overwritten instead
+// of removed. The file index can be cataloged again, so the orphans removed by the last call are checked again.
+func (c *Context) reuseOrphanPaths() {
+	used := make(map[string]bool)
+	for _, f := range c.FileIndex {
+		for _, df := range f.DestFiles {
+			used[df.Path] = true
+		}
+	}
+	orphans := append(c.OrphanedDestFiles, c.reusedOrphans...)
+	c.OrphanedDestFiles, c.reusedOrphans = nil, nil
+	for _, df := range orphans {
+		if used[df.Path] {
+			c.reusedOrphans = append(c.reusedOrphans, df)
+		} else {
+			c.OrphanedDestFiles = append(c.OrphanedDestFiles, df)
+		}
+	}
+}
+
+// ChangedFiles returns the files that are new or modified since the previous sync. If the context was not created from a
+// previous sync context, all files are returned.
+func (c *Context) ChangedFiles() FileIndex {
+	var fi FileIndex
+	for _, f := range c.FileIndex {
+		if !f.Kept {
+			fi.Add(f)
+		}
+	}
+	return fi
+}
+
+// deviceOrphans returns the orphaned destination files on the device that have not been removed.
+func (c *Context) deviceOrphans(d *Device) []*DestFile {
+	var dfs []*DestFile
+	for _, df := range c.OrphanedDestFiles {
+		if df.DeviceName == d.Name && !df.done {
+			dfs = append(dfs, df)
+		}
+	}
+	return dfs
+}
@@ -0,0 +1,305 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// incrementalTest syncs a copy of backupPath, calls change to modify the copy, and then syncs the copy again using the sync
+// context saved by the first sync.
+type incrementalTest struct {
+	t          *testing.T
+	backupPath string
+	deviceList func() DeviceList
+
+	change func(src string)
+	dedup  bool // If set, both syncs store files with the same content once
+
+	expectErrors  func() []error
+	expectChanged []string          // The files expected to be copied again, relative to the backup path
+	expectRenamed map[string]string // The new paths of renamed files mapped to the old paths
+
+	first  *syncTest
+	second *syncTest
+}
+
+func (i *incrementalTest) Run() {
+	src := NewMountPoint(i.t, testTempDir, "source-")
+	if out, err := exec.Command("cp", "-a", i.backupPath+"/.", src).CombinedOutput(); err != nil {
+		i.t.Fatalf("EXPECT: No errors from cp GOT: %s (%s)", err, out)
+	}
+	src += "/"
+
+	i.first = &syncTest{t: i.t, backupPath: src, deviceList: i.deviceList, saveSyncContext: true, dedup: i.dedup}
+	i.first.Run()
+	if i.t.Failed() {
+		return
+	}
+	prev := i.first.loadSyncContext()
+	if i.change != nil {
+		i.change(src)
+	}
+
+	// The sync context file name has a resolution of one second
+	time.Sleep(time.Second)
+
+	i.second = &syncTest{t: i.t,
+		backupPath: src,
+		deviceList: func() DeviceList {
+			var devs DeviceList
+			for _, d := range i.first.ctx.Devices {
+				devs.Add(&Device{Name: d.Name, SizeTotal: d.SizeTotal, MountPoint: d.MountPoint, Layout: d.Layout,
+					Parity: d.Parity})
+			}
+			return devs
+		},
+		saveSyncContext: true,
+		previous:        prev,
+		expectErrors:    i.expectErrors,
+		dedup:           i.dedup,
+	}
+	i.second.Run()
+	if i.t.Failed() || i.expectErrors != nil {
+		return
+	}
+
+	prevFiles := make(map[string]*File)
+	for _, f := range prev.FileIndex {
+		prevFiles[f.Path] = f
+	}
+	changed := make(map[string]bool)
+	for _, p := range i.expectChanged {
+		changed[filepath.Join(src, p)] = true
+	}
+	for n, o := range i.expectRenamed {
+		prevFiles[filepath.Join(src, n)] = prevFiles[filepath.Join(src, o)]
+	}
+	var count int
+	for _, f := range i.second.ctx.ChangedFiles() {
+		if f.FileType == FILE {
+			count++
+		}
+	}
+	if count != len(i.expectChanged) {
+		i.t.Errorf("EXPECT: %d changed files GOT: %d", len(i.expectChanged), count)
+	}
+	for _, f := range i.second.ctx.FileIndex {
+		if f.FileType != FILE {
+			continue
+		}
+		pf, ok := prevFiles[f.Path]
+		same := ok && len(pf.DestFiles) == len(f.DestFiles)
+		for x := 0; same && x < len(f.DestFiles); x++ {
+			pdf, df := pf.DestFiles[x], f.DestFiles[x]
+			same = pdf.DeviceName == df.DeviceName && pdf.StartByte == df.StartByte && pdf.EndByte == df.EndByte
+			// The destination files of renamed files are moved on devices using the mirror layout
+			d, err := i.second.ctx.Devices.DeviceByName(df.DeviceName)
+			if same && (err != nil || d.Layout != LayoutMirror) {
+				same = pdf.Path == df.Path
+			}
+		}
+		if changed[f.Path] && f.Kept {
+			i.t.Errorf("EXPECT: %q is copied again GOT: Destination files of previous sync", f.Path)
+		} else if !changed[f.Path] && !same {
+			i.t.Errorf("EXPECT: %q uses destination files of previous sync GOT: Copied again", f.Path)
+		}
+	}
+
+	// The destination files of the previous sync that are not used anymore are removed
+	if len(i.second.ctx.OrphanedDestFiles) != 0 {
+		i.t.Errorf("EXPECT: No orphaned destination files GOT: %d", len(i.second.ctx.OrphanedDestFiles))
+	}
+	kept := make(map[string]bool)
+	for _, f := range i.second.ctx.FileIndex {
+		for _, df := range f.DestFiles {
+			kept[df.Path] = true
+		}
+	}
+	for _, f := range prev.FileIndex {
+		for _, df := range f.DestFiles {
+			if _, err := os.Stat(df.Path); !kept[df.Path] && !os.IsNotExist(err) {
+				i.t.Errorf("EXPECT: Orphaned destination file %q of %q is removed GOT: %v", df.Path, f.Path, err)
+			}
+		}
+	}
+}
+
+// TestSyncIncremental modifies, adds, and touches files between two syncs. The touched file has the same content, so only
+// the metadata of its destination file is updated.
+func TestSyncIncremental(t *testing.T) {
+	i := &incrementalTest{t: t,
+		backupPath: "../../testdata/filesync_freebooks",
+		deviceList: func() DeviceList {
+			return DeviceList{
+				&Device{
+					Name:       "Test Device 0",
+					SizeTotal:  28173338480,
+					MountPoint: NewMountPoint(t, testTempDir, "mountpoint-0-"),
+				},
+			}
+		},
+		change: func(src string) {
+			if err := ioutil.WriteFile(filepath.Join(src, ".gitkeep"), []byte("changed"), 0664); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(src, "alice", "new.txt"), []byte("new file"), 0664); err != nil {
+				t.Fatal(err)
+			}
+			mt := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+			p := filepath.Join(src, "ulysses", "ulysses_by_james_joyce_gutenberg.org.htm")
+			if err := os.Chtimes(p, mt, mt); err != nil {
+				t.Fatal(err)
+			}
+		},
+		expectChanged: []string{".gitkeep", "alice/new.txt"},
+	}
+	i.Run()
+}
+
+// incrementalSumKept syncs a copy of the freebooks test data, calls change with the source path, and catalogs the
+// source files with Incremental. The file called name is expected to be copied with the sum computed by Incremental, so
+// the hashing phase does not read it again.
+func incrementalSumKept(t *testing.T, name string, change func(src string)) {
+	src := NewMountPoint(t, testTempDir, "source-")
+	if out, err := exec.Command("cp", "-a", "../../testdata/filesync_freebooks/.", src).CombinedOutput(); err != nil {
+		t.Fatalf("EXPECT: No errors from cp GOT: %s (%s)", err, out)
+	}
+	first := &syncTest{t: t, backupPath: src + "/", deviceList: splitDevices(t), saveSyncContext: true}
+	first.Run()
+	if t.Failed() {
+		return
+	}
+	prev := first.loadSyncContext()
+	change(src)
+	var devs DeviceList
+	for _, d := range first.ctx.Devices {
+		devs.Add(&Device{Name: d.Name, SizeTotal: d.SizeTotal, MountPoint: d.MountPoint})
+	}
+	c, err := NewContext(src+"/", 0, FileIndex{}, devs, 0)
+	if err != nil {
+		t.Fatalf("EXPECT: No errors from NewContext() GOT: %s", err)
+	}
+	if err := c.Incremental(prev); err != nil {
+		t.Fatalf("EXPECT: No errors from Incremental() GOT: %s", err)
+	}
+	f, err := c.FileIndex.FileByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Kept {
+		t.Errorf("EXPECT: %q copied GOT: Kept", f.Path)
+	}
+	if sum, err := fileSum(c.HashAlgorithm, f.Path); err != nil || sum != f.Sum {
+		t.Errorf("EXPECT: Sum %q for %q GOT: %q (%v)", sum, f.Path, f.Sum, err)
+	}
+	for _, hf := range NewSourceFileHashComputer(c.HashAlgorithm, c.FileIndex, nil, nil).Files {
+		if hf.FilePath == f.Path {
+			t.Errorf("EXPECT: %q not hashed again GOT: Hashed", f.Path)
+		}
+	}
+}
+
+// TestIncrementalSumKept modifies a file without changing its size. The file is hashed by Incremental to compare it to
+// the previous sync.
+func TestIncrementalSumKept(t *testing.T) {
+	incrementalSumKept(t, "ulysses_by_james_joyce_gutenberg.org.htm", func(src string) {
+		p := filepath.Join(src, "ulysses", "ulysses_by_james_joyce_gutenberg.org.htm")
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b[0] ^= 0xff
+		if err := ioutil.WriteFile(p, b, 0664); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// TestIncrementalRenameSumKept replaces a file with a new file of the same size but different content. The new file is
+// hashed by Incremental to look for a rename.
+func TestIncrementalRenameSumKept(t *testing.T) {
+	incrementalSumKept(t, "new.htm", func(src string) {
+		p := filepath.Join(src, "ulysses", "ulysses_by_james_joyce_gutenberg.org.htm")
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(p); err != nil {
+			t.Fatal(err)
+		}
+		b[0] ^= 0xff
+		if err := ioutil.WriteFile(filepath.Join(src, "alice", "new.htm"), b, 0664); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// TestSyncIncrementalNoChanges syncs files split across devices twice without changes. No files are copied again.
+func TestSyncIncrementalNoChanges(t *testing.T) {
+	i := &incrementalTest{t: t,
+		backupPath: "../../testdata/filesync_freebooks",
+		deviceList: splitDevices(t),
+	}
+	i.Run()
+	if !t.Failed() && i.second.ctx.DevicesUsed != 2 {
+		t.Errorf("EXPECT: 2 devices used GOT: %d", i.second.ctx.DevicesUsed)
+	}
+}
+
+// TestSyncIncrementalNotEnoughDeviceSpace modifies a file so that it no longer fits in the free space of the devices. The
+// space used by the previous sync is not available.
+func TestSyncIncrementalNotEnoughDeviceSpace(t *testing.T) {
+	i := &incrementalTest{t: t,
+		backupPath: "../../testdata/filesync_freebooks",
+		deviceList: splitDevices(t),
+		change: func(src string) {
+			if err := ioutil.WriteFile(filepath.Join(src, ".gitkeep"), make([]byte, 7000), 0664); err != nil {
+				t.Fatal(err)
+			}
+		},
+		expectErrors: func() []error {
+			return []error{DevicePoolSizeExceeded{}}
+		},
+	}
+	i.Run()
+}
+
+// TestSyncIncrementalRename moves a file to another directory. The destination file of the previous sync is used.
+func TestSyncIncrementalRename(t *testing.T) {
+	i := &incrementalTest{t: t,
+		backupPath: "../../testdata/filesync_freebooks",
+		deviceList: splitDevices(t),
+		change: func(src string) {
+			err := os.Rename(filepath.Join(src, "ulysses", "ulysses_by_james_joyce_gutenberg.org.htm"),
+				filepath.Join(src, "alice", "ulysses.htm"))
+			if err != nil {
+				t.Fatal(err)
+			}
+		},
+		expectRenamed: map[string]string{"alice/ulysses.htm": "ulysses/ulysses_by_james_joyce_gutenberg.org.htm"},
+	}
+	i.Run()
+}
+
+// TestSyncIncrementalDeleteFreesSpace deletes a file and adds a new file that only fits in the space of the deleted file.
+func TestSyncIncrementalDeleteFreesSpace(t *testing.T) {
+	i := &incrementalTest{t: t,
+		backupPath: "../../testdata/filesync_freebooks",
+		deviceList: splitDevices(t),
+		change: func(src string) {
+			p := filepath.Join(src, "alice", "alice_in_wonderland_by_lewis_carroll_gutenberg.org.htm")
+			if err := os.Remove(p); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(src, "alice", "new.txt"), make([]byte, 600000), 0664); err != nil {
+				t.Fatal(err)
+			}
+		},
+		expectChanged: []string{"alice/new.txt"},
+	}
+	i.Run()
+}
@@ -1,7 +1,6 @@
 package core
 
 import (
-	"crypto/sha1"
 	"encoding/hex"
 	"hash"
 	"io"
@@ -20,12 +19,12 @@ type IoReaderWriter struct {
 	sizeWritnFromLastReport uint64      // Number of bytes written to the dest file since last progress report
 	done                    *chan bool  // If closed, copy will exit with DoneSignalReceived
 
-	sha1 hash.Hash
+	hash hash.Hash
 }
 
 // NewIoReaderWriter takes an output file, a channel of uint64 for reporting bytes written, and total number of bytes
-// written. If ns is true, then sha1 hash computation is not used.
-func NewIoReaderWriter(dp string, of io.Writer, ofs uint64, pr chan uint64, ns bool, done *chan bool) *IoReaderWriter {
+// written. The data written with MultiWriter is also written to the hash h. If h is nil, no hash is computed.
+func NewIoReaderWriter(dp string, of io.Writer, ofs uint64, pr chan uint64, h hash.Hash, done *chan bool) *IoReaderWriter {
 	i := &IoReaderWriter{
 		destPath:  dp,
 		Writer:    of,
@@ -33,15 +32,13 @@ func NewIoReaderWriter(dp string, of io.Writer, ofs uint64, pr chan uint64, ns b
 		timeStart: time.Now(),
 		sizeWritn: pr,
 		done:      done,
-	}
-	if !ns {
-		i.sha1 = sha1.New()
+		hash:      h,
 	}
 	return i
 }
 
 func (i *IoReaderWriter) MultiWriter() io.Writer {
-	return io.MultiWriter(i, i.sha1)
+	return io.MultiWriter(i, i.hash)
 }
 
 // Write writes to the io.Writer and also create a progress point for tracking write speed.
@@ -94,6 +91,7 @@ func (i *IoReaderWriter) Write(p []byte) (int, error) {
 	return n, err
 }
 
-func (i *IoReaderWriter) Sha1SumToString() string {
-	return hex.EncodeToString(i.sha1.Sum(nil))
+// SumToString returns the hex encoded sum of the data written with MultiWriter.
+func (i *IoReaderWriter) SumToString() string {
+	return hex.EncodeToString(i.hash.Sum(nil))
 }
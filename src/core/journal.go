@@ -0,0 +1,113 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// JournalEntry records a destination file that has been copied completely.
+type JournalEntry struct {
+	Path       string `json:"path"`
+	DeviceName string `json:"deviceName"`
+	Size       uint64 `json:"size"`
+	Sum        string `json:"sum"`
+}
+
+// Journal records the progress of a sync on disk. An entry is appended each time a destination file is copied so that an
+// interrupted sync can be resumed.
+type Journal struct {
+	path string
+	file *os.File
+	lock sync.Mutex
+}
+
+// NewJournal opens the journal at path for appending. The journal is created if it does not exist.
+func NewJournal(path string) (*Journal, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{path: path, file: f}, nil
+}
+
+// Record appends an entry for the completed destination file df to the journal. The entry is written to the disk before
+// returning.
+func (j *Journal) Record(df *DestFile) error {
+	b, err := json.Marshal(JournalEntry{df.Path, df.DeviceName, df.Size, df.Sum})
+	if err != nil {
+		return err
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if _, err = j.file.Write(append(b, '\n')); err == nil {
+		err = j.file.Sync()
+	}
+	return err
+}
+
+// Close closes the journal file.
+func (j *Journal) Close() error {
+	return j.file.Close()
+}
+
+// Remove closes and deletes the journal file. Used once the sync is complete.
+func (j *Journal) Remove() error {
+	j.Close()
+	return os.Remove(j.path)
+}
+
+// ReadJournal reads the journal at path and returns the entries by destination file path. An incomplete last entry, written
+// when the sync was interrupted, is ignored.
+func ReadJournal(path string) (map[string]JournalEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries := make(map[string]JournalEntry)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var e JournalEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			Log.WithFields(logrus.Fields{"journal": path, "entry": s.Text()}).Warnln("Ignoring bad journal entry")
+			continue
+		}
+		entries[e.Path] = e
+	}
+	return entries, s.Err()
+}
+
+// Resume marks the destination files recorded in the journal entries as done so they are not copied again. Destination files
+// that are not in the journal are truncated and copied again by the sync. The destination files kept from the previous
+// sync of an incremental sync are done unless their metadata is updated or they are moved to a new path. The number of
+// completed destination files is returned.
+func (c *Context) Resume(entries map[string]JournalEntry) int {
+	var count int
+	for _, d := range c.Devices {
+		d.SizeWritn = 0
+		for _, dd := range c.FileIndex.DeviceFiles(d) {
+			if dd.f.Kept && !dd.f.MetaChanged && dd.df.RenamedFrom == "" {
+				dd.df.done = true
+				count++
+				continue
+			}
+			e, ok := entries[dd.df.Path]
+			if !ok || e.DeviceName != d.Name || e.Size != dd.df.Size {
+				continue
+			}
+			dd.df.done = true
+			dd.df.Sum = e.Sum
+			if !dd.f.Kept {
+				// Kept destination files are counted in the space used by the previous sync
+				d.SizeWritn += dd.f.allocated(dd.df.StartByte, dd.df.EndByte)
+			}
+			count++
+		}
+	}
+	Log.WithFields(logrus.Fields{"completed": count, "journalEntries": len(entries)}).Infoln("Resuming sync")
+	return count
+}
@@ -0,0 +1,191 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestReadJournalIncompleteEntry(t *testing.T) {
+	p := filepath.Join(NewMountPoint(t, testTempDir, "journal-"), "journal")
+	data := `{"path":"/mnt/a","deviceName":"Test Device 0","size":10,"sum":"abc"}` + "\n" + `{"path":"/mnt/b","devi`
+	if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	e, err := ReadJournal(p)
+	if err != nil {
+		t.Fatalf("EXPECT: No errors from ReadJournal() GOT: %s", err)
+	}
+	if len(e) != 1 || e["/mnt/a"].Sum != "abc" {
+		t.Errorf("EXPECT: One entry for %q GOT: %#v", "/mnt/a", e)
+	}
+}
+
+// TestSyncResume syncs files split across devices, then simulates an interruption while the last destination file was being
+// copied. The resumed sync copies only the last destination file again.
+func TestSyncResume(t *testing.T) {
+	journal := filepath.Join(NewMountPoint(t, testTempDir, "journal-"), "journal")
+	first := &syncTest{t: t,
+		backupPath:      "../../testdata/filesync_freebooks",
+		deviceList:      splitDevices(t),
+		saveSyncContext: true,
+		journal:         journal,
+	}
+	first.Run()
+	if t.Failed() {
+		return
+	}
+
+	// Drop the last journal entry and truncate the destination file
+	b, err := ioutil.ReadFile(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	var count int
+	for _, f := range first.ctx.FileIndex {
+		count += len(f.DestFiles)
+	}
+	if len(lines) != count {
+		t.Fatalf("EXPECT: %d journal entries GOT: %d", count, len(lines))
+	}
+	var last JournalEntry
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &last); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(journal, []byte(strings.Join(lines[:len(lines)-1], "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(last.Path, int64(last.Size/2)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The change time of a completed destination file shows if it was written again
+	var done JournalEntry
+	json.Unmarshal([]byte(lines[0]), &done)
+	ctime := func() syscall.Timespec {
+		fi, err := os.Lstat(done.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Sys().(*syscall.Stat_t).Ctim
+	}
+	before := ctime()
+
+	resume := &syncTest{t: t,
+		context: func() *Context {
+			c := first.loadSyncContext()
+			e, err := ReadJournal(journal)
+			if err != nil {
+				t.Fatalf("EXPECT: No errors from ReadJournal() GOT: %s", err)
+			}
+			if n := c.Resume(e); n != count-1 {
+				t.Errorf("EXPECT: %d completed destination files GOT: %d", count-1, n)
+			}
+			return c
+		},
+		journal: journal,
+	}
+	resume.Run()
+
+	if before != ctime() {
+		t.Errorf("EXPECT: %q is not copied again GOT: Copied", done.Path)
+	}
+	f, err := os.Open(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var n int
+	for s := bufio.NewScanner(f); s.Scan(); n++ {
+	}
+	if n != count {
+		t.Errorf("EXPECT: %d journal entries GOT: %d", count, n)
+	}
+}
+
+// TestSyncResumeIncremental renames a directory between two syncs to devices using the mirror layout and simulates an
+// interruption of the incremental sync before anything was synced. The context saved before the sync is resumed: the
+// unchanged files are not copied again and the destination files of the renamed files are moved to their new paths.
+func TestSyncResumeIncremental(t *testing.T) {
+	src := NewMountPoint(t, testTempDir, "source-")
+	if out, err := exec.Command("cp", "-a", "../../testdata/filesync_freebooks/.", src).CombinedOutput(); err != nil {
+		t.Fatalf("EXPECT: No errors from cp GOT: %s (%s)", err, out)
+	}
+	first := &syncTest{t: t, backupPath: src + "/", deviceList: mirrorDevices(t), saveSyncContext: true}
+	first.Run()
+	if t.Failed() {
+		return
+	}
+	prev := first.loadSyncContext()
+	if err := os.Rename(filepath.Join(src, "ulysses"), filepath.Join(src, "joyce")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The context is saved before the sync, like the sync command does
+	var devs DeviceList
+	for _, d := range first.ctx.Devices {
+		devs.Add(&Device{Name: d.Name, SizeTotal: d.SizeTotal, MountPoint: d.MountPoint, Layout: d.Layout})
+	}
+	c, err := NewContext(src+"/", 0, FileIndex{}, devs, 0)
+	if err != nil {
+		t.Fatalf("EXPECT: No errors from NewContext() GOT: %s", err)
+	}
+	if err := c.Incremental(prev); err != nil {
+		t.Fatalf("EXPECT: No errors from Incremental() GOT: %s", err)
+	}
+	dir := NewMountPoint(t, testTempDir, "journal-")
+	cf := filepath.Join(dir, "context.json")
+	b, err := json.Marshal(c)
+	if err == nil {
+		err = ioutil.WriteFile(cf, b, 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The change time of an unchanged destination file shows if it was written again
+	f, err := c.FileIndex.FileByName("alice_in_wonderland_by_lewis_carroll_gutenberg.org.htm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctime := func() syscall.Timespec {
+		fi, err := os.Lstat(f.DestFiles[0].Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Sys().(*syscall.Stat_t).Ctim
+	}
+	before := ctime()
+
+	resume := &syncTest{t: t,
+		context: func() *Context {
+			c, err := SyncContextFromPath(cf)
+			if err != nil {
+				t.Fatalf("EXPECT: No errors from SyncContextFromPath() GOT: %s", err)
+			}
+			c.Resume(map[string]JournalEntry{})
+			return c
+		},
+		journal: filepath.Join(dir, "journal"),
+	}
+	resume.Run()
+	if t.Failed() {
+		return
+	}
+	if before != ctime() {
+		t.Errorf("EXPECT: %q is not copied again GOT: Copied", f.DestFiles[0].Path)
+	}
+	checkMirrorLayout(t, resume.ctx)
+	for _, d := range resume.ctx.Devices {
+		if _, err := os.Stat(filepath.Join(d.MountPoint, "ulysses")); !os.IsNotExist(err) {
+			t.Errorf("EXPECT: Directory \"ulysses\" is removed from %q GOT: %v", d.Name, err)
+		}
+	}
+}
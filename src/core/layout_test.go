@@ -0,0 +1,172 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mirrorDevices returns the split devices using the mirror layout.
+func mirrorDevices(t *testing.T) func() DeviceList {
+	return func() DeviceList {
+		devs := splitDevices(t)()
+		for _, d := range devs {
+			d.Layout = LayoutMirror
+		}
+		return devs
+	}
+}
+
+// checkMirrorLayout checks the destination files and directories on the devices use the source directory tree.
+func checkMirrorLayout(t *testing.T, c *Context) {
+	for _, f := range c.FileIndex {
+		rel, err := c.relPath(f.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for x, df := range f.DestFiles {
+			d, err := c.Devices.DeviceByName(df.DeviceName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expect := filepath.Join(d.MountPoint, rel)
+			if len(f.DestFiles) > 1 {
+				expect = fmt.Sprintf("%s.gds-part-%04d-of-%04d", expect, x+1, len(f.DestFiles))
+			}
+			if df.Path != expect {
+				t.Errorf("EXPECT: Destination path %q GOT: %q", expect, df.Path)
+			}
+			if _, err := os.Stat(df.Path); err != nil {
+				t.Error(err)
+			}
+		}
+		if f.FileType != DIRECTORY {
+			continue
+		}
+		for _, d := range c.Devices {
+			fi, err := os.Stat(filepath.Join(d.MountPoint, rel))
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			if !fi.ModTime().Equal(f.ModTime) || fi.Mode() != f.Mode {
+				t.Errorf("Directory: %q\n\t Got ModTime: %s Mode: %s Expect: %s %s", filepath.Join(d.MountPoint, rel),
+					fi.ModTime(), fi.Mode(), f.ModTime, f.Mode)
+			}
+		}
+	}
+}
+
+// TestSyncMirrorLayout syncs a file split across two devices using the mirror layout.
+func TestSyncMirrorLayout(t *testing.T) {
+	s := &syncTest{t: t,
+		backupPath: "../../testdata/filesync_freebooks/",
+		deviceList: mirrorDevices(t),
+	}
+	s.Run()
+	if !t.Failed() {
+		checkMirrorLayout(t, s.ctx)
+	}
+}
+
+// TestRestoreMirrorLayout restores files from devices using the mirror layout.
+func TestRestoreMirrorLayout(t *testing.T) {
+	r := &restoreTest{t: t,
+		sync: &syncTest{t: t,
+			backupPath: "../../testdata/filesync_freebooks",
+			deviceList: mirrorDevices(t),
+		},
+	}
+	r.Run()
+}
+
+// TestSyncIncrementalMirrorLayout modifies a file between two syncs. The destination file is overwritten in place.
+func TestSyncIncrementalMirrorLayout(t *testing.T) {
+	i := &incrementalTest{t: t,
+		backupPath: "../../testdata/filesync_freebooks",
+		deviceList: mirrorDevices(t),
+		change: func(src string) {
+			if err := ioutil.WriteFile(filepath.Join(src, ".gitkeep"), []byte("changed"), 0664); err != nil {
+				t.Fatal(err)
+			}
+		},
+		expectChanged: []string{".gitkeep"},
+	}
+	i.Run()
+	if !t.Failed() {
+		checkMirrorLayout(t, i.second.ctx)
+	}
+}
+
+// TestSyncIncrementalMirrorRename renames a directory between two syncs. The destination files are moved to the new
+// directory on the devices and the directory of the previous sync is removed.
+func TestSyncIncrementalMirrorRename(t *testing.T) {
+	i := &incrementalTest{t: t,
+		backupPath: "../../testdata/filesync_freebooks",
+		deviceList: mirrorDevices(t),
+		change: func(src string) {
+			if err := os.Rename(filepath.Join(src, "ulysses"), filepath.Join(src, "joyce")); err != nil {
+				t.Fatal(err)
+			}
+		},
+		expectRenamed: map[string]string{
+			"joyce/ulysses_by_james_joyce_gutenberg.org.htm": "ulysses/ulysses_by_james_joyce_gutenberg.org.htm",
+		},
+	}
+	i.Run()
+	if t.Failed() {
+		return
+	}
+	checkMirrorLayout(t, i.second.ctx)
+	for _, d := range i.second.ctx.Devices {
+		if _, err := os.Stat(filepath.Join(d.MountPoint, "ulysses")); !os.IsNotExist(err) {
+			t.Errorf("EXPECT: Directory \"ulysses\" is removed from %q GOT: %v", d.Name, err)
+		}
+	}
+}
+
+// TestRestoreMirrorLayoutMetadataName syncs a source file named like the checksum file of the devices. The destination
+// file gets a suffix, so the checksum file does not overwrite it.
+func TestRestoreMirrorLayoutMetadataName(t *testing.T) {
+	src := NewMountPoint(t, testTempDir, "source-")
+	if err := ioutil.WriteFile(filepath.Join(src, "SHA1SUMS"), []byte("da39a3ee5e6b4b0d3255bfef95601890afd80709  iso\n"),
+		0664); err != nil {
+		t.Fatal(err)
+	}
+	r := &restoreTest{t: t,
+		sync: &syncTest{t: t,
+			backupPath: src + "/",
+			deviceList: func() DeviceList {
+				return DeviceList{
+					&Device{
+						Name:       "Test Device 0",
+						SizeTotal:  28173338480,
+						MountPoint: NewMountPoint(t, testTempDir, "mountpoint-0-"),
+						Layout:     LayoutMirror,
+					},
+				}
+			},
+		},
+	}
+	r.Run()
+	if t.Failed() {
+		return
+	}
+	f, err := r.ctx.FileIndex.FileByName("SHA1SUMS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp := r.ctx.Devices[0].MountPoint
+	if expect := filepath.Join(mp, "SHA1SUMS.gds-1"); f.DestFiles[0].Path != expect {
+		t.Errorf("EXPECT: Destination path %q GOT: %q", expect, f.DestFiles[0].Path)
+	}
+	rep, err := VerifySums(filepath.Join(mp, "SHA1SUMS"))
+	if err != nil {
+		t.Fatalf("EXPECT: No errors from VerifySums() GOT: %s", err)
+	}
+	if rep.Failed() || rep.Checked != 1 {
+		t.Errorf("EXPECT: The destination file is checked by the checksum file GOT: %+v", rep)
+	}
+}
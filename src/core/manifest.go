@@ -0,0 +1,184 @@
+package core
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// ManifestFileName is the name of the gzip compressed manifest file written to the root of every device.
+const ManifestFileName = "gds_manifest.json.gz"
+
+// ManifestEntry describes a destination file stored on a device.
+type ManifestEntry struct {
+	Path      string      `json:"path"`     // The path of the source file
+	Source    string      `json:"source"`   // The name of the backup path of the source file
+	DestPath  string      `json:"destPath"` // The path of the destination file relative to the root of the device
+	StartByte uint64      `json:"startByte"`
+	EndByte   uint64      `json:"endByte"`
+	Size      uint64      `json:"size"` // The size of the source file
+	Mode      os.FileMode `json:"mode"`
+	Owner     int         `json:"owner"`
+	Group     int         `json:"group"`
+	ModTime   time.Time   `json:"modTime"`
+	Sum       string      `json:"sum"` // The sum of the destination file
+}
+
+// Manifest describes the contents of a single device so that the device can be understood without the other devices of the
+// device pool or the sync context.
+type Manifest struct {
+	DeviceName    string          `json:"deviceName"`
+	DeviceUUID    string          `json:"deviceUUID"`
+	DeviceNumber  int             `json:"deviceNumber"` // The position of the device in the device pool, starting at 1
+	DeviceCount   int             `json:"deviceCount"`
+	BackupPath    string          `json:"backupPath"`
+	BackupPaths   []BackupPath    `json:"backupPaths"`
+	SyncStartDate time.Time       `json:"syncStartDate"`
+	HashAlgorithm HashAlgorithm   `json:"hashAlgorithm"` // The algorithm of the sums of the files
+	Files         []ManifestEntry `json:"files"`
+}
+
+// SyncNotEnoughDeviceSpaceForMetadataError is given when a file describing the contents of a device, like the manifest, does
+// not fit in the space left on the device.
+type SyncNotEnoughDeviceSpaceForMetadataError struct {
+	DeviceName      string
+	FileName        string
+	DeviceSizeWritn uint64
+	DeviceSizeTotal uint64
+	Size            uint64
+}
+
+// Error implements the Error interface.
+func (e SyncNotEnoughDeviceSpaceForMetadataError) Error() string {
+	return fmt.Sprintf("Not enough space for %s! DeviceName=%q DeviceSizeWritn=%d DeviceSizeTotal=%d Size=%d",
+		e.FileName, e.DeviceName, e.DeviceSizeWritn, e.DeviceSizeTotal, e.Size)
+}
+
+// metadataFileName returns true if name is the name of a file gds writes to the root of a device: the manifest, the checksum
+// file of any hash algorithm, or a sync context.
+func metadataFileName(name string) bool {
+	if name == ManifestFileName {
+		return true
+	}
+	for _, h := range hashAlgorithms {
+		if name == h.sumsFile {
+			return true
+		}
+	}
+	m, _ := filepath.Match("sync_context_*.json.gz", name)
+	return m
+}
+
+// metadataPath returns true if p is the path of a metadata file in the root of the device mounted at mp.
+func metadataPath(mp, p string) bool {
+	return filepath.Dir(p) == filepath.Clean(mp) && metadataFileName(filepath.Base(p))
+}
+
+// writeMetadataFile writes a file describing the contents of the device to the root of the device and returns the size of
+// the file. An existing file of a previous sync is replaced.
+func writeMetadataFile(device *Device, name string, b []byte) (uint64, error) {
+	size := uint64(len(b))
+	if device.SizeWritn+device.SizeUsed+device.sizeMetadata()+size > device.SizeTotal {
+		return 0, SyncNotEnoughDeviceSpaceForMetadataError{device.Name, name, device.SizeWritn, device.SizeTotal, size}
+	}
+	return size, ioutil.WriteFile(filepath.Join(device.MountPoint, name), b, 0644)
+}
+
+// NewManifest returns the manifest of the destination files copied to the device.
+func (c *Context) NewManifest(device *Device) (*Manifest, error) {
+	m := &Manifest{
+		DeviceName:    device.Name,
+		DeviceUUID:    device.UUID,
+		DeviceCount:   len(c.Devices),
+		BackupPath:    c.BackupPath,
+		BackupPaths:   c.BackupPaths,
+		SyncStartDate: c.SyncStartDate,
+		HashAlgorithm: c.HashAlgorithm,
+		Files:         []ManifestEntry{},
+	}
+	for x, d := range c.Devices {
+		if d == device {
+			m.DeviceNumber = x + 1
+		}
+	}
+	for _, d := range c.FileIndex.DeviceFiles(device) {
+		if !d.df.done {
+			// Not on the device
+			continue
+		}
+		rel, err := filepath.Rel(device.MountPoint, d.df.Path)
+		if err != nil {
+			return nil, err
+		}
+		m.Files = append(m.Files, ManifestEntry{
+			Path:      d.f.Path,
+			Source:    d.f.Source,
+			DestPath:  rel,
+			StartByte: d.df.StartByte,
+			EndByte:   d.df.EndByte,
+			Size:      d.f.Size,
+			Mode:      d.f.Mode,
+			Owner:     d.f.Owner,
+			Group:     d.f.Group,
+			ModTime:   d.f.ModTime,
+			Sum:       d.df.Sum,
+		})
+	}
+	return m, nil
+}
+
+// ManifestFromPath reads a compressed manifest file.
+func ManifestFromPath(path string) (*Manifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	m := new(Manifest)
+	return m, json.NewDecoder(gz).Decode(m)
+}
+
+// saveManifest writes the manifest of the device to the root of the device.
+func saveManifest(c *Context, device *Device) error {
+	m, err := c.NewManifest(device)
+	if err != nil {
+		return err
+	}
+	j, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	gz, err := gzip.NewWriterLevel(&b, flate.BestCompression)
+	if err != nil {
+		return err
+	}
+	if _, err = gz.Write(j); err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		return err
+	}
+	// The manifest of a previous sync is replaced
+	device.ManifestSize = 0
+	if device.ManifestSize, err = writeMetadataFile(device, ManifestFileName, b.Bytes()); err != nil {
+		return err
+	}
+	Log.WithFields(logrus.Fields{
+		"device": device.Name, "files": len(m.Files), "size": device.ManifestSize,
+	}).Infoln("Saved device manifest")
+	return nil
+}
@@ -0,0 +1,51 @@
+package core
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestSyncManifest checks the manifest written to each device describes the destination files stored on the device.
+func TestSyncManifest(t *testing.T) {
+	s := &syncTest{t: t,
+		backupPath: "../../testdata/filesync_freebooks",
+		deviceList: splitDevices(t),
+	}
+	s.Run()
+	if t.Failed() {
+		return
+	}
+	for x, d := range s.ctx.Devices {
+		m, err := ManifestFromPath(filepath.Join(d.MountPoint, ManifestFileName))
+		if err != nil {
+			t.Fatalf("EXPECT: No errors from ManifestFromPath() GOT: %s", err)
+		}
+		if m.DeviceName != d.Name || m.DeviceNumber != x+1 || m.DeviceCount != len(s.ctx.Devices) {
+			t.Errorf("EXPECT: Device %q %d of %d GOT: %q %d of %d", d.Name, x+1, len(s.ctx.Devices), m.DeviceName,
+				m.DeviceNumber, m.DeviceCount)
+		}
+		dfs := s.ctx.FileIndex.DeviceFiles(d)
+		if len(m.Files) != len(dfs) {
+			t.Errorf("EXPECT: %d manifest entries for %q GOT: %d", len(dfs), d.Name, len(m.Files))
+			continue
+		}
+		for y, e := range m.Files {
+			df, f := dfs[y].df, dfs[y].f
+			if e.Path != f.Path || filepath.Join(d.MountPoint, e.DestPath) != df.Path || e.StartByte != df.StartByte ||
+				e.EndByte != df.EndByte || e.Size != f.Size || e.Mode != f.Mode || !e.ModTime.Equal(f.ModTime) {
+				t.Errorf("EXPECT: Manifest entry for %q GOT: %+v", df.Path, e)
+			}
+			if f.FileType != FILE {
+				continue
+			}
+			sum, err := fileSum(s.ctx.HashAlgorithm, df.Path)
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			if e.Sum != sum {
+				t.Errorf("EXPECT: Manifest sum %q for %q GOT: %q", sum, df.Path, e.Sum)
+			}
+		}
+	}
+}
@@ -0,0 +1,742 @@
+package core
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// ParityFileName is the name of the file holding the parity of the data devices, written to the root of a parity device.
+const ParityFileName = "gds_parity.bin"
+
+// DefaultParityStripeSize is the number of bytes of each data device combined at a time into the parity.
+const DefaultParityStripeSize = 1 << 20
+
+// ContextFileBadParity is an error returned by ContextFromPath(). It indicates the parity devices cannot protect the data
+// devices.
+type ContextFileBadParity struct {
+	DeviceName string
+	Reason     string
+}
+
+// Error satisfies the Error interface.
+func (e ContextFileBadParity) Error() string {
+	return fmt.Sprintf("Bad parity device %q: %s", e.DeviceName, e.Reason)
+}
+
+// ParityDeviceSizeExceeded is given when the data stream of a data device is larger than a parity device.
+type ParityDeviceSizeExceeded struct {
+	DeviceName       string // The parity device
+	ParitySize       uint64
+	DeviceSizePadded uint64
+}
+
+// Error implements the Error interface.
+func (e ParityDeviceSizeExceeded) Error() string {
+	return fmt.Sprintf("Inadequate parity device space on %q! ParitySize: %d DeviceSizePadded: %d", e.DeviceName,
+		e.ParitySize, e.DeviceSizePadded)
+}
+
+// RebuildNoParityError is given when a device is rebuilt using a sync context without parity.
+type RebuildNoParityError struct{}
+
+// Error implements the Error interface.
+func (e RebuildNoParityError) Error() string {
+	return "The sync context has no parity devices"
+}
+
+// RebuildTooManyDevicesError is given when more data devices are lost than there are parity devices left.
+type RebuildTooManyDevicesError struct {
+	Lost   int // The lost data devices
+	Parity int // The parity devices that are not lost
+}
+
+// Error implements the Error interface.
+func (e RebuildTooManyDevicesError) Error() string {
+	return fmt.Sprintf("Cannot rebuild %d lost data devices with %d parity devices", e.Lost, e.Parity)
+}
+
+// RebuildSumMismatchError is given when the sum of a rebuilt destination file does not match the sum recorded in the sync
+// context.
+type RebuildSumMismatchError struct {
+	DestPath   string
+	Sum        string
+	RebuiltSum string
+}
+
+// Error implements the Error interface.
+func (e RebuildSumMismatchError) Error() string {
+	return fmt.Sprintf("Rebuilt %q does not match the sync context! Sum: %s RebuiltSum: %s", e.DestPath, e.Sum,
+		e.RebuiltSum)
+}
+
+// RebuildParityMismatchError is given when the parity file read to rebuild a device does not match the sum recorded in the
+// sync context. The rebuilt files are likely damaged.
+type RebuildParityMismatchError struct {
+	DeviceName string
+	Sum        string
+	ReadSum    string
+}
+
+// Error implements the Error interface.
+func (e RebuildParityMismatchError) Error() string {
+	return fmt.Sprintf("Parity file of %q does not match the sync context! Sum: %s ReadSum: %s", e.DeviceName, e.Sum,
+		e.ReadSum)
+}
+
+// ParitySourceChangedError is given when a part of a source file read to compute the parity does not match the sum of the
+// destination file copied from it. The source file changed after it was copied, so the parity would not match the data
+// devices. The parity device is computed again by the next sync.
+type ParitySourceChangedError struct {
+	Path    string
+	Sum     string
+	ReadSum string
+}
+
+// Error implements the Error interface.
+func (e ParitySourceChangedError) Error() string {
+	return fmt.Sprintf("Source file %q changed since it was copied, the parity is not saved! Sum: %s ReadSum: %s", e.Path,
+		e.Sum, e.ReadSum)
+}
+
+// StripeExtent is a destination file that is part of the data stream of a device.
+type StripeExtent struct {
+	DestPath string `json:"destPath"` // Relative to the mount point of the device
+	Offset   uint64 `json:"offset"`   // The position of the destination file in the data stream
+	Size     uint64 `json:"size"`
+}
+
+// StripeDevice is the data stream of a data device, the destination files of the device one after the other.
+type StripeDevice struct {
+	DeviceName string         `json:"deviceName"`
+	Size       uint64         `json:"size"`
+	Extents    []StripeExtent `json:"extents"`
+}
+
+// StripeMap records how the parity was computed. The data streams of the data devices, padded with zeros to the size of the
+// largest stream, are combined stripe by stripe into the parity file of each parity device.
+type StripeMap struct {
+	StripeSize uint64         `json:"stripeSize"`
+	Size       uint64         `json:"size"` // The size of the largest data stream and of the parity files
+	Devices    []StripeDevice `json:"devices"`
+}
+
+// checkParity returns ContextFileBadParity if the parity devices are not after all of the data devices, or if there are too
+// many devices for the Reed-Solomon parity.
+func (c *Context) checkParity() error {
+	parity := c.Devices.ParityDevices()
+	if len(parity) == 0 {
+		return nil
+	}
+	data := len(c.Devices) - len(parity)
+	for x, d := range c.Devices {
+		if d.Parity && x < data {
+			return ContextFileBadParity{d.Name, "parity devices must be listed after the data devices"}
+		}
+	}
+	if data == 0 {
+		return ContextFileBadParity{parity[0].Name, "there are no data devices"}
+	}
+	if len(c.Devices) > 256 {
+		return ContextFileBadParity{parity[0].Name, "parity supports at most 256 devices"}
+	}
+	return nil
+}
+
+// parityCoefficient returns the factor of the data device with the index i in the parity of the parity device with the index
+// j, out of n data devices and m parity devices. A single parity device is the XOR of the data devices. With more parity
+// devices, the factors are a Cauchy matrix, so any number of lost data devices up to m can be solved for.
+func parityCoefficient(j, i, n, m int) byte {
+	if m == 1 {
+		return 1
+	}
+	return gfInv(byte(n+j) ^ byte(i))
+}
+
+// streamFiles returns the destination files making up the data stream of the device, in device file order. Empty files and
+// files that are not regular files are not part of the stream.
+func (c *Context) streamFiles(d *Device) []*destFileData {
+	var files []*destFileData
+	for _, x := range c.FileIndex.DeviceFiles(d) {
+		if x.f.FileType == FILE && x.df.Size > 0 {
+			files = append(files, x)
+		}
+	}
+	return files
+}
+
+// newStripeMap returns the stripe map of the data devices, or nil if there are no parity devices. ParityDeviceSizeExceeded is
+// returned if the parity does not fit on a parity device.
+func (c *Context) newStripeMap() (*StripeMap, error) {
+	parity := c.Devices.ParityDevices()
+	if len(parity) == 0 {
+		return nil, nil
+	}
+	sm := &StripeMap{StripeSize: c.ParityStripeSize}
+	if sm.StripeSize == 0 {
+		sm.StripeSize = DefaultParityStripeSize
+	}
+	for _, d := range c.Devices.DataDevices() {
+		sd := StripeDevice{DeviceName: d.Name}
+		for _, x := range c.streamFiles(d) {
+			rel, err := filepath.Rel(d.MountPoint, x.df.Path)
+			if err != nil {
+				return nil, err
+			}
+			sd.Extents = append(sd.Extents, StripeExtent{rel, sd.Size, x.df.Size})
+			sd.Size += x.df.Size
+		}
+		if sd.Size > sm.Size {
+			sm.Size = sd.Size
+		}
+		sm.Devices = append(sm.Devices, sd)
+	}
+	for _, d := range parity {
+		if sm.Size > d.SizeTotalPadded() {
+			return nil, ParityDeviceSizeExceeded{d.Name, sm.Size, d.SizeTotalPadded()}
+		}
+	}
+	return sm, nil
+}
+
+// keepParity keeps the parity files written by the previous sync if the data streams are unchanged, so the parity devices
+// are not written again. The parity files then take up space on the parity devices.
+func (c *Context) keepParity(prev *Context) {
+	if c.StripeMap == nil || prev.StripeMap == nil || !reflect.DeepEqual(c.StripeMap, prev.StripeMap) {
+		return
+	}
+	for _, f := range c.ChangedFiles() {
+		if f.FileType == FILE && f.Size > 0 {
+			// The file is copied to a path of the previous sync, the data stream has the same layout with new data
+			return
+		}
+	}
+	for _, d := range c.Devices.ParityDevices() {
+		if pd, err := prev.Devices.DeviceByName(d.Name); err == nil && pd.Parity {
+			d.ParitySum = pd.ParitySum
+			if d.ParitySum != "" {
+				d.SizeUsed += c.StripeMap.Size
+			}
+		}
+	}
+}
+
+// parityDeviceIndex returns the index of the parity device d among the parity devices.
+func (c *Context) parityDeviceIndex(d *Device) int {
+	for x, p := range c.Devices.ParityDevices() {
+		if p == d {
+			return x
+		}
+	}
+	return -1
+}
+
+// streamPart is a range of a file in a data stream.
+type streamPart struct {
+	path   string
+	offset uint64
+	size   uint64
+	sum    string // If set, the expected sum of the range
+}
+
+// streamReader reads the parts of a data stream one after the other. The end of the stream is padded with zeros. The parts
+// with a sum are hashed with alg while they are read and ParitySourceChangedError is returned if a part does not match.
+type streamReader struct {
+	parts []streamPart
+	alg   HashAlgorithm
+	file  *os.File
+	path  string
+	left  uint64    // The bytes left to read from the current part
+	sum   string    // The expected sum of the current part
+	hash  hash.Hash // Nil if the current part has no sum
+}
+
+// read fills buf with the next bytes of the data stream.
+func (s *streamReader) read(buf []byte) error {
+	for len(buf) > 0 {
+		if s.file == nil {
+			if len(s.parts) == 0 {
+				for x := range buf {
+					buf[x] = 0
+				}
+				return nil
+			}
+			p := s.parts[0]
+			s.parts = s.parts[1:]
+			f, err := os.Open(p.path)
+			if err != nil {
+				return err
+			}
+			if _, err = f.Seek(int64(p.offset), 0); err != nil {
+				f.Close()
+				return err
+			}
+			s.file, s.path, s.left, s.sum, s.hash = f, p.path, p.size, p.sum, nil
+			if p.sum != "" {
+				s.hash = s.alg.New()
+			}
+		}
+		n := uint64(len(buf))
+		if n > s.left {
+			n = s.left
+		}
+		if _, err := io.ReadFull(s.file, buf[:n]); err != nil {
+			return fmt.Errorf("read %s: %s", s.path, err)
+		}
+		if s.hash != nil {
+			s.hash.Write(buf[:n])
+		}
+		buf = buf[n:]
+		s.left -= n
+		if s.left == 0 {
+			s.close()
+			if s.hash == nil {
+				continue
+			}
+			if sum := hex.EncodeToString(s.hash.Sum(nil)); sum != s.sum {
+				return ParitySourceChangedError{s.path, s.sum, sum}
+			}
+		}
+	}
+	return nil
+}
+
+// close closes the file of the current part.
+func (s *streamReader) close() {
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+}
+
+// streamWriter writes a data stream to the files of its parts, which are created. Bytes past the end of the stream are
+// dropped.
+type streamWriter struct {
+	parts []streamPart
+	file  *os.File
+	path  string
+	left  uint64 // The bytes left to write to the current part
+}
+
+// write writes buf to the next bytes of the data stream.
+func (s *streamWriter) write(buf []byte) error {
+	for len(buf) > 0 {
+		if s.file == nil {
+			if len(s.parts) == 0 {
+				return nil
+			}
+			p := s.parts[0]
+			s.parts = s.parts[1:]
+			if err := os.MkdirAll(filepath.Dir(p.path), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(p.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			s.file, s.path, s.left = f, p.path, p.size
+		}
+		n := uint64(len(buf))
+		if n > s.left {
+			n = s.left
+		}
+		if _, err := s.file.Write(buf[:n]); err != nil {
+			return fmt.Errorf("write %s: %s", s.path, err)
+		}
+		buf = buf[n:]
+		s.left -= n
+		if s.left == 0 {
+			if err := s.close(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// close closes the file of the current part.
+func (s *streamWriter) close() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// sourceStream returns the reader of the data stream of the data device d, read from the source files. Each part is
+// checked against the sum of its destination file.
+func (c *Context) sourceStream(d *Device) *streamReader {
+	s := &streamReader{alg: c.HashAlgorithm}
+	for _, x := range c.streamFiles(d) {
+		sum := x.df.Sum
+		if sum == "" && !x.f.IsSplit() {
+			sum = x.f.Sum
+		}
+		s.parts = append(s.parts, streamPart{x.f.Path, x.df.StartByte, x.df.Size, sum})
+	}
+	return s
+}
+
+// destStreamParts returns the parts of the data stream of sd, the destination files on the device mounted at mp.
+func destStreamParts(sd StripeDevice, mp string) []streamPart {
+	var parts []streamPart
+	for _, e := range sd.Extents {
+		parts = append(parts, streamPart{filepath.Join(mp, e.DestPath), 0, e.Size, ""})
+	}
+	return parts
+}
+
+// syncParity writes the parity file to the parity device. The parity is computed from the source files, so the data devices
+// do not need to be mounted at the same time as the parity device. The sum of the parity file is recorded in the device.
+// If a source file no longer matches its destination files, the sum is left empty so the parity is computed again by the
+// next sync.
+func syncParity(c *Context, device *Device, trakc chan<- fileTracker) {
+	Log.WithFields(logrus.Fields{"device": device.Name}).Infoln("Computing parity")
+	syncErrCtx := fmt.Sprintf("sync Device[%q]:", device.Name)
+	sm := c.StripeMap
+	data := c.Devices.DataDevices()
+	j, m := c.parityDeviceIndex(device), len(c.Devices.ParityDevices())
+
+	device.ParitySum = ""
+	p := filepath.Join(device.MountPoint, ParityFileName)
+	oFile, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		c.Errors <- SyncDestinatonFileOpenError{fmt.Errorf("%s parity open: %s", syncErrCtx, err.Error())}
+		return
+	}
+	defer oFile.Close()
+
+	streams := make([]*streamReader, len(data))
+	for x, d := range data {
+		streams[x] = c.sourceStream(d)
+		defer streams[x].close()
+	}
+
+	pReporter := make(chan uint64, 100)
+	mIo := NewIoReaderWriter(p, oFile, sm.Size, pReporter, c.HashAlgorithm.New(), &c.Done)
+	nIo := mIo.MultiWriter()
+	ft := fileTracker{
+		io: mIo, f: &File{Name: ParityFileName, Path: p, Size: sm.Size},
+		df: &DestFile{DeviceName: device.Name, Path: p, Size: sm.Size}, device: device, done: make(chan bool),
+	}
+	if sm.Size > 0 {
+		select {
+		case trakc <- ft:
+		case <-time.After(200 * time.Second):
+			panic("Should not be here! No receive on tracker channel in 200 seconds...")
+		}
+	}
+
+	buf := make([]byte, sm.StripeSize)
+	out := make([]byte, sm.StripeSize)
+	var changed bool // Set if a source file does not match its destination files
+	for off := uint64(0); off < sm.Size; off += sm.StripeSize {
+		n := sm.Size - off
+		if n > sm.StripeSize {
+			n = sm.StripeSize
+		}
+		for x := range out[:n] {
+			out[x] = 0
+		}
+		for i, s := range streams {
+			if err := s.read(buf[:n]); err != nil {
+				if _, ok := err.(ParitySourceChangedError); ok {
+					// The parity is written to the end, so the progress of the device completes
+					changed = true
+					c.Errors <- err
+				} else {
+					c.Errors <- SyncSourceFileOpenError{fmt.Errorf("%s parity source: %s", syncErrCtx, err.Error())}
+					return
+				}
+			}
+			gfMulAdd(out[:n], buf[:n], parityCoefficient(j, i, len(data), m))
+		}
+		if _, err := nIo.Write(out[:n]); err != nil {
+			c.Errors <- fmt.Errorf("%s parity write: %s", syncErrCtx, err.Error())
+			return
+		}
+	}
+	if err := oFile.Close(); err != nil {
+		c.Errors <- fmt.Errorf("%s parity close: %s", syncErrCtx, err.Error())
+		return
+	}
+	if sm.Size > 0 {
+		// Wait for the filetracker reporter to complete
+		<-ft.done
+	}
+	if changed {
+		Log.WithFields(logrus.Fields{"device": device.Name}).Warnln("Parity does not match the data devices")
+		return
+	}
+	device.ParitySum = mIo.SumToString()
+	Log.WithFields(logrus.Fields{"device": device.Name, "size": sm.Size, "sum": device.ParitySum}).Infoln("Parity sum")
+}
+
+// RebuildReport is the result of rebuilding lost devices.
+type RebuildReport struct {
+	Devices []string // The rebuilt devices
+	Files   int      // The destination files rebuilt
+	Bytes   uint64   // The bytes written to the rebuilt devices
+	Errors  []error
+}
+
+// Failed returns true if errors occurred while rebuilding.
+func (r *RebuildReport) Failed() bool {
+	return len(r.Errors) > 0
+}
+
+// Rebuild regenerates the contents of the lost devices named in names from the other data devices and the parity devices.
+// The replacement devices must be mounted at the mount points of the lost devices, the other devices at their mount points.
+// Any number of data devices up to the number of remaining parity devices can be rebuilt, lost parity devices are computed
+// again. The rebuilt destination files are checked against the sums of the sync context, mismatches are reported in the
+// returned report. An error is returned if the devices cannot be rebuilt.
+func Rebuild(c *Context, names []string) (*RebuildReport, error) {
+	sm := c.StripeMap
+	if sm == nil || len(c.Devices.ParityDevices()) == 0 {
+		return nil, RebuildNoParityError{}
+	}
+	lostNames := make(map[string]bool)
+	for _, n := range names {
+		if _, err := c.Devices.DeviceByName(n); err != nil {
+			return nil, fmt.Errorf("Rebuild: device %q does not exist", n)
+		}
+		lostNames[n] = true
+	}
+	data, parity := c.Devices.DataDevices(), c.Devices.ParityDevices()
+	n, m := len(data), len(parity)
+
+	// The lost data devices are solved for using as many of the remaining parity devices
+	var lost, avail, rows []int
+	for i, d := range data {
+		if lostNames[d.Name] {
+			lost = append(lost, i)
+		} else {
+			avail = append(avail, i)
+		}
+	}
+	for j, d := range parity {
+		if !lostNames[d.Name] && len(rows) < len(lost) {
+			rows = append(rows, j)
+		}
+	}
+	if len(rows) < len(lost) {
+		return nil, RebuildTooManyDevicesError{len(lost), len(rows)}
+	}
+	a := make([][]byte, len(lost))
+	for r, j := range rows {
+		a[r] = make([]byte, len(lost))
+		for k, i := range lost {
+			a[r][k] = parityCoefficient(j, i, n, m)
+		}
+	}
+	inv, err := gfInvert(a)
+	if err != nil {
+		return nil, err
+	}
+	Log.WithFields(logrus.Fields{"devices": names, "parityRows": rows}).Infoln("Rebuilding devices")
+
+	// The data streams of every data device, read from the devices or rebuilt
+	streams := make([][]byte, n)
+	readers := make(map[int]*streamReader)
+	writers := make(map[int]*streamWriter)
+	for i, d := range data {
+		streams[i] = make([]byte, sm.StripeSize)
+		parts := destStreamParts(sm.Devices[i], d.MountPoint)
+		if lostNames[d.Name] {
+			writers[i] = &streamWriter{parts: parts}
+		} else {
+			readers[i] = &streamReader{parts: parts}
+			defer readers[i].close()
+		}
+	}
+	var lostParity []int
+	parityFiles := make([]*os.File, m)
+	paritySums := make([]hash.Hash, m) // The sums of the parity files read or written
+	for j, d := range parity {
+		p := filepath.Join(d.MountPoint, ParityFileName)
+		var f *os.File
+		if lostNames[d.Name] {
+			lostParity = append(lostParity, j)
+			f, err = os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		} else {
+			f, err = os.Open(p)
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		parityFiles[j] = f
+		paritySums[j] = c.HashAlgorithm.New()
+	}
+
+	report := &RebuildReport{Devices: names}
+	syndromes := make([][]byte, len(rows))
+	for r := range syndromes {
+		syndromes[r] = make([]byte, sm.StripeSize)
+	}
+	out := make([]byte, sm.StripeSize)
+	for off := uint64(0); off < sm.Size; off += sm.StripeSize {
+		size := sm.Size - off
+		if size > sm.StripeSize {
+			size = sm.StripeSize
+		}
+		for _, i := range avail {
+			if err := readers[i].read(streams[i][:size]); err != nil {
+				return nil, err
+			}
+		}
+		// The parity minus the remaining data devices is the parity of the lost data devices
+		for r, j := range rows {
+			s := syndromes[r][:size]
+			if _, err := io.ReadFull(parityFiles[j], s); err != nil {
+				return nil, fmt.Errorf("Rebuild: read parity of %q: %s", parity[j].Name, err)
+			}
+			paritySums[j].Write(s)
+			for _, i := range avail {
+				gfMulAdd(s, streams[i][:size], parityCoefficient(j, i, n, m))
+			}
+		}
+		for k, i := range lost {
+			d := streams[i][:size]
+			for x := range d {
+				d[x] = 0
+			}
+			for r := range rows {
+				gfMulAdd(d, syndromes[r][:size], inv[k][r])
+			}
+			if err := writers[i].write(d); err != nil {
+				return nil, err
+			}
+		}
+		for _, j := range lostParity {
+			p := out[:size]
+			for x := range p {
+				p[x] = 0
+			}
+			for i := range data {
+				gfMulAdd(p, streams[i][:size], parityCoefficient(j, i, n, m))
+			}
+			if _, err := io.MultiWriter(parityFiles[j], paritySums[j]).Write(p); err != nil {
+				return nil, err
+			}
+		}
+		report.Bytes += size * uint64(len(lost)+len(lostParity))
+	}
+	for _, w := range writers {
+		if err := w.close(); err != nil {
+			return nil, err
+		}
+	}
+	for _, j := range lostParity {
+		if err := parityFiles[j].Close(); err != nil {
+			return nil, err
+		}
+	}
+	for j, d := range parity {
+		sum := hex.EncodeToString(paritySums[j].Sum(nil))
+		if lostNames[d.Name] {
+			d.ParitySum = sum
+		} else if d.ParitySum != "" && isRow(rows, j) && sum != d.ParitySum {
+			report.Errors = append(report.Errors, RebuildParityMismatchError{d.Name, d.ParitySum, sum})
+		}
+	}
+	for _, i := range lost {
+		rebuildDeviceFiles(c, data[i], report)
+	}
+	if last := c.Devices[len(c.Devices)-1]; lostNames[last.Name] {
+		if err := rebuildSyncContext(c, last); err != nil {
+			report.Errors = append(report.Errors, err)
+		}
+	}
+	return report, nil
+}
+
+// rebuildSyncContext writes the sync context to the rebuilt last device, using the name given by the sync.
+func rebuildSyncContext(c *Context, device *Device) error {
+	cp := filepath.Join(device.MountPoint, "sync_context_"+c.SyncStartDate.Format(time.RFC3339)+".json.gz")
+	f, err := os.Create(cp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writeCompressedContextToFile(c, f)
+}
+
+// isRow returns true if the parity device with the index j was read by Rebuild.
+func isRow(rows []int, j int) bool {
+	for _, r := range rows {
+		if r == j {
+			return true
+		}
+	}
+	return false
+}
+
+// rebuildDeviceFiles finishes a rebuilt data device. The empty destination files are created, the metadata of the
+// destination files is set and their sums are checked. The directories, manifest, checksum file and the sync context of
+// the last device are written again.
+func rebuildDeviceFiles(c *Context, device *Device, report *RebuildReport) {
+	for _, d := range c.FileIndex.DeviceFiles(device) {
+		if d.f.FileType != FILE {
+			continue
+		}
+		var err error
+		if d.df.Size == 0 {
+			if err = os.MkdirAll(filepath.Dir(d.df.Path), 0755); err == nil {
+				var f *os.File
+				if f, err = os.Create(d.df.Path); err == nil {
+					err = f.Close()
+				}
+			}
+		}
+		var sum string
+		if err == nil {
+			sum, err = fileSum(c.HashAlgorithm, d.df.Path)
+		}
+		if err == nil && sum != d.df.Sum {
+			err = RebuildSumMismatchError{d.df.Path, d.df.Sum, sum}
+		}
+		if err == nil {
+			if err = os.Chmod(d.df.Path, d.f.Mode); err == nil {
+				err = d.df.setMetaData(d.f)
+			}
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, err)
+			continue
+		}
+		d.df.done = true
+		report.Files++
+	}
+	if device.Layout == LayoutMirror {
+		// mirrorDirs reports errors on the errors channel of the context
+		done := make(chan bool)
+		go func() {
+			for {
+				select {
+				case err := <-c.Errors:
+					report.Errors = append(report.Errors, err)
+				case <-done:
+					return
+				}
+			}
+		}()
+		mirrorDirs(c, device)
+		done <- true
+	}
+	if err := saveManifest(c, device); err != nil {
+		report.Errors = append(report.Errors, err)
+	}
+	if err := saveSums(c, device); err != nil {
+		report.Errors = append(report.Errors, err)
+	}
+	Log.WithFields(logrus.Fields{"device": device.Name, "files": report.Files}).Infoln("Rebuilt device")
+}
@@ -0,0 +1,314 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestGFInverse(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if p := gfMul(byte(a), gfInv(byte(a))); p != 1 {
+			t.Errorf("EXPECT: %d * 1/%d = 1 GOT: %d", a, a, p)
+		}
+	}
+}
+
+// TestGFInvert expects the product of every square Cauchy submatrix of the parity coefficients and its inverse to be the
+// identity matrix.
+func TestGFInvert(t *testing.T) {
+	n, m := 5, 3
+	for size := 1; size <= m; size++ {
+		a := make([][]byte, size)
+		for j := range a {
+			a[j] = make([]byte, size)
+			for k := range a[j] {
+				a[j][k] = parityCoefficient(j, n-1-k, n, m)
+			}
+		}
+		inv, err := gfInvert(a)
+		if err != nil {
+			t.Fatalf("EXPECT: No errors from gfInvert() GOT: %s", err)
+		}
+		for r := 0; r < size; r++ {
+			for c := 0; c < size; c++ {
+				var p byte
+				for k := 0; k < size; k++ {
+					p ^= gfMul(a[r][k], inv[k][c])
+				}
+				if expect := byte(0); r == c && p != 1 || r != c && p != expect {
+					t.Errorf("EXPECT: Identity matrix GOT: %d at (%d, %d) of the %dx%d product", p, r, c, size, size)
+				}
+			}
+		}
+	}
+	if _, err := gfInvert([][]byte{{1, 2}, {1, 2}}); err == nil {
+		t.Error("EXPECT: Error from gfInvert() with a singular matrix GOT: Nil")
+	}
+}
+
+// parityDevices returns the devices of splitDevices followed by n parity devices.
+func parityDevices(t *testing.T, n int) func() DeviceList {
+	return func() DeviceList {
+		devices := splitDevices(t)()
+		for x := 0; x < n; x++ {
+			devices = append(devices, &Device{
+				Name:       fmt.Sprintf("Parity Device %d", x),
+				SizeTotal:  1600000,
+				MountPoint: NewMountPoint(t, testTempDir, fmt.Sprintf("mountpoint-parity-%d-", x)),
+				Parity:     true,
+			})
+		}
+		return devices
+	}
+}
+
+// parityContext returns a context syncing the freebooks test data to the devices of parityDevices. A small stripe size is
+// used so the parity has many stripes.
+func parityContext(t *testing.T, n int) func() *Context {
+	return catalogContext(t, "../../testdata/filesync_freebooks", parityDevices(t, n),
+		func(c *Context) { c.ParityStripeSize = 65536 })
+}
+
+// destStream returns the data stream of the data device with the index x, read from the destination files.
+func destStream(t *testing.T, c *Context, x int) []byte {
+	sd := c.StripeMap.Devices[x]
+	d, err := c.Devices.DeviceByName(sd.DeviceName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, c.StripeMap.Size)
+	s := &streamReader{parts: destStreamParts(sd, d.MountPoint)}
+	defer s.close()
+	if err := s.read(b); err != nil {
+		t.Fatalf("EXPECT: No errors reading the data stream of %q GOT: %s", d.Name, err)
+	}
+	return b
+}
+
+// TestSyncParity expects the parity file of each parity device to be the parity of the data streams of the destination
+// files.
+func TestSyncParity(t *testing.T) {
+	for _, n := range []int{1, 2} {
+		f := &syncTest{t: t, context: parityContext(t, n)}
+		f.Run()
+		if t.Failed() {
+			return
+		}
+		c := f.ctx
+		if len(c.FileIndex.DeviceFiles(c.Devices[2])) != 0 {
+			t.Errorf("EXPECT: No files on the parity device GOT: %d", len(c.FileIndex.DeviceFiles(c.Devices[2])))
+		}
+		if c.StripeMap == nil || len(c.StripeMap.Devices) != 2 {
+			t.Fatalf("EXPECT: Stripe map of 2 data devices GOT: %+v", c.StripeMap)
+		}
+		data := c.Devices.DataDevices()
+		for j, d := range c.Devices.ParityDevices() {
+			expect := make([]byte, c.StripeMap.Size)
+			for i := range data {
+				gfMulAdd(expect, destStream(t, c, i), parityCoefficient(j, i, len(data), n))
+			}
+			p, err := ioutil.ReadFile(filepath.Join(d.MountPoint, ParityFileName))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(p, expect) {
+				t.Errorf("EXPECT: Parity of the data streams on %q GOT: %d bytes that do not match", d.Name, len(p))
+			}
+			if d.ParitySum == "" {
+				t.Errorf("EXPECT: Parity sum of %q GOT: Empty", d.Name)
+			}
+		}
+	}
+}
+
+// TestSyncParitySourceChanged modifies a source file after it is copied to a data device, before the parity is computed. The
+// parity would not match the data device, so the parity device fails and its sum is left empty.
+func TestSyncParitySourceChanged(t *testing.T) {
+	src := NewMountPoint(t, testTempDir, "source-")
+	if out, err := exec.Command("cp", "-a", "../../testdata/filesync_freebooks/.", src).CombinedOutput(); err != nil {
+		t.Fatalf("EXPECT: No errors from cp GOT: %s (%s)", err, out)
+	}
+	s := &syncTest{t: t,
+		context: catalogContext(t, src, parityDevices(t, 1), func(c *Context) { c.ParityStripeSize = 65536 }),
+		expectErrors: func() []error {
+			return []error{ParitySourceChangedError{}}
+		},
+	}
+	s.beforeMount = func(x int) {
+		if !s.ctx.Devices[x].Parity {
+			return
+		}
+		modifyDestFile(t, s.ctx, "Test Device 0", func(df *DestFile) {
+			for _, f := range s.ctx.FileIndex {
+				for _, d := range f.DestFiles {
+					if d != df {
+						continue
+					}
+					fo, err := os.OpenFile(f.Path, os.O_WRONLY, 0)
+					if err != nil {
+						t.Fatal(err)
+					}
+					fo.WriteAt([]byte("gds"), int64(df.StartByte))
+					fo.Close()
+				}
+			}
+		})
+	}
+	s.Run()
+	if p := s.ctx.Devices.ParityDevices()[0]; p.ParitySum != "" {
+		t.Errorf("EXPECT: No parity sum of %q GOT: %s", p.Name, p.ParitySum)
+	}
+}
+
+// loseDevice removes the contents of the mount point of the named device, as if the device was replaced.
+func loseDevice(t *testing.T, c *Context, name string) {
+	d, err := c.Devices.DeviceByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(d.MountPoint); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(d.MountPoint, 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRebuild rebuilds lost devices from the sync context and expects the destination files and parity files to be
+// restored.
+func TestRebuild(t *testing.T) {
+	tests := []struct {
+		parity int
+		lost   []string
+	}{
+		{1, []string{"Test Device 0"}},
+		{1, []string{"Parity Device 0"}},
+		{2, []string{"Test Device 0", "Test Device 1"}},
+		{2, []string{"Test Device 1", "Parity Device 0"}},
+	}
+	for _, test := range tests {
+		f := &syncTest{t: t, context: parityContext(t, test.parity), saveSyncContext: true}
+		f.Run()
+		if t.Failed() {
+			return
+		}
+		c := f.loadSyncContext()
+		parity := make(map[string][]byte)
+		for _, d := range c.Devices.ParityDevices() {
+			p, err := ioutil.ReadFile(filepath.Join(d.MountPoint, ParityFileName))
+			if err != nil {
+				t.Fatal(err)
+			}
+			parity[d.Name] = p
+		}
+		for _, n := range test.lost {
+			loseDevice(t, c, n)
+		}
+		r, err := Rebuild(c, test.lost)
+		if err != nil {
+			t.Fatalf("EXPECT: No errors from Rebuild(%q) GOT: %s", test.lost, err)
+		}
+		for _, err := range r.Errors {
+			t.Errorf("EXPECT: No rebuild errors GOT: %s", err)
+		}
+		for _, file := range c.FileIndex {
+			if file.FileType != FILE {
+				continue
+			}
+			for _, df := range file.DestFiles {
+				if sum, err := fileSum(c.HashAlgorithm, df.Path); err != nil || sum != df.Sum {
+					t.Errorf("EXPECT: %q on %q has sum %s GOT: %s (%v)", df.Path, df.DeviceName, df.Sum, sum, err)
+				}
+			}
+		}
+		for _, d := range c.Devices.ParityDevices() {
+			p, err := ioutil.ReadFile(filepath.Join(d.MountPoint, ParityFileName))
+			if err != nil || !bytes.Equal(p, parity[d.Name]) {
+				t.Errorf("EXPECT: Parity file of %q is unchanged GOT: %d bytes (%v)", d.Name, len(p), err)
+			}
+		}
+		if last := c.Devices[len(c.Devices)-1]; !r.Failed() {
+			if m, _ := filepath.Glob(filepath.Join(last.MountPoint, "sync_context_*.json.gz")); len(m) != 1 {
+				t.Errorf("EXPECT: Sync context on %q GOT: %d", last.Name, len(m))
+			}
+		}
+	}
+}
+
+// TestRebuildTooManyDevices expects losing both data devices with one parity device to be rejected.
+func TestRebuildTooManyDevices(t *testing.T) {
+	f := &syncTest{t: t, context: parityContext(t, 1)}
+	f.Run()
+	if t.Failed() {
+		return
+	}
+	_, err := Rebuild(f.ctx, []string{"Test Device 0", "Test Device 1"})
+	if expect := (RebuildTooManyDevicesError{2, 1}); err != expect {
+		t.Errorf("EXPECT: %v GOT: %v", expect, err)
+	}
+	if _, err := Rebuild(&Context{}, []string{"Test Device 0"}); err != (RebuildNoParityError{}) {
+		t.Errorf("EXPECT: %v GOT: %v", RebuildNoParityError{}, err)
+	}
+}
+
+// TestSyncIncrementalParity expects the parity of the previous sync to be kept if no file changed, and to be computed again
+// if a file is modified.
+func TestSyncIncrementalParity(t *testing.T) {
+	i := &incrementalTest{t: t,
+		backupPath: "../../testdata/filesync_freebooks",
+		deviceList: parityDevices(t, 1),
+	}
+	i.Run()
+	if t.Failed() {
+		return
+	}
+	d := i.second.ctx.Devices[2]
+	if d.SizeWritn != 0 || d.ParitySum != i.first.ctx.Devices[2].ParitySum {
+		t.Errorf("EXPECT: Parity of the previous sync is kept GOT: %d bytes written, sum %s", d.SizeWritn, d.ParitySum)
+	}
+
+	i = &incrementalTest{t: t,
+		backupPath: "../../testdata/filesync_freebooks",
+		deviceList: parityDevices(t, 1),
+		change: func(src string) {
+			if err := ioutil.WriteFile(filepath.Join(src, "alice", "new.txt"), []byte("new file"), 0664); err != nil {
+				t.Fatal(err)
+			}
+		},
+		expectChanged: []string{"alice/new.txt"},
+	}
+	i.Run()
+	if t.Failed() {
+		return
+	}
+	d = i.second.ctx.Devices[2]
+	if d.SizeWritn != i.second.ctx.StripeMap.Size || d.ParitySum == "" {
+		t.Errorf("EXPECT: Parity is computed again GOT: %d bytes written, sum %q", d.SizeWritn, d.ParitySum)
+	}
+}
+
+// TestContextBadParity expects a parity device listed before a data device to be rejected.
+func TestContextBadParity(t *testing.T) {
+	_, err := NewContextFromYaml([]byte(`
+backupPath: /tmp
+devices:
+  - name: Parity Device 0
+    uuid: parity-device-0
+    sizeTotal: 1000
+    mountPoint: /mnt/parity
+    parity: true
+  - name: Test Device 0
+    uuid: test-device-0
+    sizeTotal: 1000
+    mountPoint: /mnt/test
+`))
+	expect := ContextFileBadParity{"Parity Device 0", "parity devices must be listed after the data devices"}
+	if err != expect {
+		t.Errorf("EXPECT: %v GOT: %v", expect, err)
+	}
+}
@@ -0,0 +1,275 @@
+package core
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Placement is the strategy used by catalog to choose the devices of the files.
+type Placement string
+
+const (
+	// PlacementSequential fills the devices one after another in file index order. A file that crosses the end of a
+	// device is split. This is the default.
+	PlacementSequential Placement = "sequential"
+
+	// PlacementFirstFitDecreasing places the largest files first, each on the first device with enough free space for
+	// the whole file. Smaller files fill the space left on the devices. A file is only split if no device can hold it.
+	PlacementFirstFitDecreasing Placement = "first-fit-decreasing"
+
+	// PlacementDirectory keeps the files of a directory subtree together on one device whenever the subtree fits. A
+	// subtree that does not fit on any device is spread across devices by placing its subdirectories and files one by
+	// one, largest first. Files are only split if no device can hold them.
+	PlacementDirectory Placement = "directory"
+)
+
+// ContextFileBadPlacement is an error returned by ContextFromPath(). It indicates the placement strategy is unknown.
+type ContextFileBadPlacement struct {
+	Placement Placement
+}
+
+// Error satisfies the Error interface.
+func (e ContextFileBadPlacement) Error() string {
+	return fmt.Sprintf("Unknown placement %q", e.Placement)
+}
+
+// checkPlacement returns ContextFileBadPlacement if p is not a known placement strategy. An empty placement is the default
+// placement.
+func checkPlacement(p Placement) error {
+	if p != "" && p != PlacementSequential && p != PlacementFirstFitDecreasing && p != PlacementDirectory {
+		return ContextFileBadPlacement{p}
+	}
+	return nil
+}
+
+// filesBySizeDecreasing sorts files from the largest to the smallest.
+type filesBySizeDecreasing []*File
+
+func (f filesBySizeDecreasing) Len() int           { return len(f) }
+func (f filesBySizeDecreasing) Less(i, j int) bool { return f[i].Size > f[j].Size }
+func (f filesBySizeDecreasing) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+
+// initFree sets the free space of each device, the padded size minus the space used by a previous sync.
+func (ct *catalogTracker) initFree() {
+	ct.free = make([]uint64, len(ct.ctx.Devices))
+	ct.placed = make([]uint64, len(ct.ctx.Devices))
+	for x, d := range ct.ctx.Devices {
+		if d.SizeUsed < d.SizeTotalPadded() && !d.Parity {
+			ct.free[x] = d.SizeTotalPadded() - d.SizeUsed
+		}
+	}
+}
+
+// usable returns true if files can be placed on the device with the index x. Parity devices and the devices not allowed by
+// the placement rules are not used.
+func (ct *catalogTracker) usable(x int) bool {
+	return !ct.ctx.Devices[x].Parity && (ct.allowed == nil || ct.allowed[x])
+}
+
+// firstFit returns the index of the first allowed device with at least size bytes free, or -1 if no device has enough
+// space.
+func (ct *catalogTracker) firstFit(size uint64) int {
+	for x, free := range ct.free {
+		if free >= size && ct.usable(x) {
+			return x
+		}
+	}
+	return -1
+}
+
+// place adds a destination file for size bytes of the current file, starting at the end of prev, on the device with the
+// index x. The holes of a sparse file do not use free space.
+func (ct *catalogTracker) place(x int, prev *DestFile, size uint64) *DestFile {
+	df := NewDestFile(ct.file, ct.ctx.Devices[x], prev, nil)
+	df.EndByte = df.StartByte + size
+	df.Size = size
+	df.Copy = ct.copy
+	ct.file.AddDestFile(df)
+	used := ct.file.allocated(df.StartByte, df.EndByte)
+	ct.free[x] -= used
+	ct.placed[x] += used
+	return df
+}
+
+// splitLargestFirst splits the current file across the allowed devices with the most free space, so the file has as few
+// parts as possible.
+func (ct *catalogTracker) splitLargestFirst() error {
+	var order []int
+	for x := range ct.free {
+		if ct.usable(x) {
+			order = append(order, x)
+		}
+	}
+	sort.Stable(devicesByFreeDecreasing{order, ct.free})
+	var prev *DestFile
+	for _, x := range order {
+		if ct.free[x] == 0 {
+			break
+		}
+		var start uint64
+		if prev != nil {
+			start = prev.EndByte
+		}
+		prev = ct.place(x, prev, ct.file.allocatedEnd(start, ct.free[x])-start)
+		if prev.EndByte == ct.file.Size {
+			return nil
+		}
+	}
+	c := ct.ctx
+	return DevicePoolSizeExceeded{c.FileIndex.TotalSizeFiles(), c.Devices.TotalSize(), c.Devices.TotalSizePadded()}
+}
+
+// devicesByFreeDecreasing sorts device indexes from the most to the least free space.
+type devicesByFreeDecreasing struct {
+	index []int
+	free  []uint64
+}
+
+func (d devicesByFreeDecreasing) Len() int           { return len(d.index) }
+func (d devicesByFreeDecreasing) Less(i, j int) bool { return d.free[d.index[i]] > d.free[d.index[j]] }
+func (d devicesByFreeDecreasing) Swap(i, j int)      { d.index[i], d.index[j] = d.index[j], d.index[i] }
+
+// firstFitDecreasing places files, largest first, on the first device with enough free space for the whole file. Files that
+// no device can hold are split across the devices with the most free space.
+func (ct *catalogTracker) firstFitDecreasing(files []*File) error {
+	sort.Stable(filesBySizeDecreasing(files))
+	for _, f := range files {
+		if err := ct.placeFile(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dirNode is a directory of the backup paths with the total size of the files to place in its subtree.
+type dirNode struct {
+	path  string // Relative to the backup paths, like the paths of the mirror layout
+	size  uint64
+	dirs  []*dirNode
+	files []*File
+}
+
+// newDirTree returns the directory tree of files. The root of the tree is the directory containing the backup paths.
+func (c *Context) newDirTree(files []*File) (*dirNode, error) {
+	root := &dirNode{path: "."}
+	nodes := map[string]*dirNode{".": root}
+	var node func(p string) *dirNode
+	node = func(p string) *dirNode {
+		if n, ok := nodes[p]; ok {
+			return n
+		}
+		n := &dirNode{path: p}
+		nodes[p] = n
+		parent := node(filepath.Dir(p))
+		parent.dirs = append(parent.dirs, n)
+		return n
+	}
+	for _, f := range files {
+		rel, err := c.relPath(f.Path)
+		if err != nil {
+			return nil, err
+		}
+		n := node(filepath.Dir(rel))
+		n.files = append(n.files, f)
+		for p := n.path; ; p = filepath.Dir(p) {
+			nodes[p].size += f.allocatedSize()
+			if p == "." {
+				break
+			}
+		}
+	}
+	return root, nil
+}
+
+// placementUnit is a directory subtree or a single file placed by the directory placement.
+type placementUnit struct {
+	dir  *dirNode
+	file *File
+	size uint64
+}
+
+// unitsBySizeDecreasing sorts placement units from the largest to the smallest.
+type unitsBySizeDecreasing []placementUnit
+
+func (u unitsBySizeDecreasing) Len() int           { return len(u) }
+func (u unitsBySizeDecreasing) Less(i, j int) bool { return u[i].size > u[j].size }
+func (u unitsBySizeDecreasing) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+
+// placeTree places all of the files of the subtree n on the device with the index x.
+func (ct *catalogTracker) placeTree(n *dirNode, x int) {
+	for _, f := range n.files {
+		ct.file = f
+		ct.place(x, nil, f.Size)
+	}
+	for _, d := range n.dirs {
+		ct.placeTree(d, x)
+	}
+}
+
+// placeFile places the file on the first device with enough free space, or splits it if no device can hold it.
+func (ct *catalogTracker) placeFile(f *File) error {
+	ct.file = f
+	if x := ct.firstFit(f.allocatedSize()); x >= 0 {
+		ct.place(x, nil, f.Size)
+		return nil
+	}
+	Log.WithFields(logrus.Fields{"file": f.Path, "size": f.Size}).Debugln("No device can hold the file, splitting")
+	return ct.splitLargestFirst()
+}
+
+// placeDir places the subtree n on the first device with enough free space for all of its files. Otherwise the
+// subdirectories and files of n are placed one by one, largest first, and n is recorded as spread across devices unless it
+// is the root of a backup path.
+func (ct *catalogTracker) placeDir(n *dirNode, roots map[string]bool) error {
+	if x := ct.firstFit(n.size); x >= 0 {
+		ct.placeTree(n, x)
+		return nil
+	}
+	if !roots[n.path] {
+		Log.WithFields(logrus.Fields{"dir": n.path, "size": n.size}).Infoln("Directory does not fit on one device")
+		ct.spread = append(ct.spread, n.path)
+	}
+	var units []placementUnit
+	for _, d := range n.dirs {
+		units = append(units, placementUnit{dir: d, size: d.size})
+	}
+	for _, f := range n.files {
+		units = append(units, placementUnit{file: f, size: f.allocatedSize()})
+	}
+	sort.Stable(unitsBySizeDecreasing(units))
+	for _, u := range units {
+		var err error
+		if u.dir != nil {
+			err = ct.placeDir(u.dir, roots)
+		} else {
+			err = ct.placeFile(u.file)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// directoryAffinity places the files keeping directory subtrees together on one device whenever they fit.
+func (ct *catalogTracker) directoryAffinity(files []*File) error {
+	c := ct.ctx
+	root, err := c.newDirTree(files)
+	if err != nil {
+		return err
+	}
+	// The backup paths themselves are not reported as spread
+	roots := map[string]bool{".": true}
+	if len(c.BackupPaths) == 0 {
+		if rel, err := c.relPath(c.BackupPath); err == nil {
+			roots[rel] = true
+		}
+	}
+	for _, bp := range c.BackupPaths {
+		roots[bp.Name] = true
+	}
+	return ct.placeDir(root, roots)
+}
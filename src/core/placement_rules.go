@@ -0,0 +1,202 @@
+package core
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/demizer/go-humanize"
+)
+
+// PlacementRule pins the files matching a pattern to a device, keeps them off of devices, or sets their number of copies.
+// The pattern is matched against the path of a file relative to its backup path, "**" matches any number of directories.
+// Unlike the patterns of MatchFiles, the path never starts with the base directory or the name of the backup path.
+type PlacementRule struct {
+	Match          string   `json:"match" yaml:"match"`
+	Device         string   `json:"device" yaml:"device"`                 // The only device used for the files
+	ExcludeDevices []string `json:"excludeDevices" yaml:"excludeDevices"` // Devices not used for the files
+	Copies         int      `json:"copies" yaml:"copies"`                 // If set, used instead of the copies of the context
+}
+
+// String returns the rule as written in the configuration file.
+func (r PlacementRule) String() string {
+	s := fmt.Sprintf("match: %q", r.Match)
+	if r.Device != "" {
+		s += fmt.Sprintf(" device: %q", r.Device)
+	}
+	if len(r.ExcludeDevices) > 0 {
+		s += fmt.Sprintf(" excludeDevices: %q", r.ExcludeDevices)
+	}
+	if r.Copies > 0 {
+		s += fmt.Sprintf(" copies: %d", r.Copies)
+	}
+	return s
+}
+
+// allowed returns the devices the files matching the rule can be placed on. Parity devices are never allowed.
+func (r *PlacementRule) allowed(devices DeviceList) []bool {
+	a := make([]bool, len(devices))
+	for x, d := range devices {
+		a[x] = !d.Parity && (r.Device == "" || r.Device == d.Name)
+		for _, e := range r.ExcludeDevices {
+			if e == d.Name {
+				a[x] = false
+			}
+		}
+	}
+	return a
+}
+
+// ContextFileBadPlacementRule is an error returned by ContextFromPath(). It indicates an entry of placementRules is not
+// valid.
+type ContextFileBadPlacementRule struct {
+	Match  string
+	Reason string
+}
+
+// Error satisfies the Error interface.
+func (e ContextFileBadPlacementRule) Error() string {
+	return fmt.Sprintf("Bad placement rule %q: %s", e.Match, e.Reason)
+}
+
+// PlacementRuleSizeExceeded is an error given when the files matching a placement rule do not fit on the devices allowed by
+// the rule.
+type PlacementRuleSizeExceeded struct {
+	Rule            PlacementRule
+	TotalRuleSize   uint64 // The size of the files matching the rule
+	TotalDeviceSize uint64 // The free space of the devices allowed by the rule
+	Shortfall       uint64
+}
+
+// Error implements the Error interface.
+func (e PlacementRuleSizeExceeded) Error() string {
+	return fmt.Sprintf("Inadequate device space for placement rule (%s)! TotalRuleSize: %d (%s) "+
+		"TotalDeviceSize: %d (%s) Shortfall: %d (%s)", e.Rule, e.TotalRuleSize, humanize.IBytes(e.TotalRuleSize),
+		e.TotalDeviceSize, humanize.IBytes(e.TotalDeviceSize), e.Shortfall, humanize.IBytes(e.Shortfall))
+}
+
+// checkPlacementRules returns ContextFileBadPlacementRule if a placement rule has a bad pattern, names an unknown device, or
+// needs more copies than it allows devices.
+func (c *Context) checkPlacementRules() error {
+	for _, r := range c.PlacementRules {
+		if r.Match == "" {
+			return ContextFileBadPlacementRule{r.Match, "match is not defined"}
+		}
+		if err := checkPattern(r.Match); err != nil {
+			return ContextFileBadPlacementRule{r.Match, err.Error()}
+		}
+		if r.Device == "" && len(r.ExcludeDevices) == 0 && r.Copies == 0 {
+			return ContextFileBadPlacementRule{r.Match, "device, excludeDevices or copies must be defined"}
+		}
+		if r.Copies < 0 {
+			return ContextFileBadPlacementRule{r.Match, "copies must be positive"}
+		}
+		names := r.ExcludeDevices
+		if r.Device != "" {
+			names = append([]string{r.Device}, names...)
+		}
+		for _, n := range names {
+			d, err := c.Devices.DeviceByName(n)
+			if err != nil {
+				return ContextFileBadPlacementRule{r.Match, fmt.Sprintf("device %q does not exist", n)}
+			}
+			if d.Parity && n == r.Device {
+				return ContextFileBadPlacementRule{r.Match, fmt.Sprintf("device %q is a parity device", n)}
+			}
+		}
+		var allowed int
+		for _, a := range r.allowed(c.Devices) {
+			if a {
+				allowed++
+			}
+		}
+		if allowed == 0 {
+			return ContextFileBadPlacementRule{r.Match, "all devices are excluded"}
+		}
+		if n := c.fileCopies(&r); n > allowed {
+			return ContextFileBadPlacementRule{r.Match, fmt.Sprintf("%d copies need more than the %d allowed devices",
+				n, allowed)}
+		}
+	}
+	return nil
+}
+
+// sourceRelPath returns the slash separated path of f relative to its backup path.
+func (c *Context) sourceRelPath(f *File) (string, error) {
+	root := c.BackupPath
+	for _, bp := range c.BackupPaths {
+		if bp.Name == f.Source {
+			root = bp.Path
+		}
+	}
+	rel, err := filepath.Rel(root, f.Path)
+	return filepath.ToSlash(rel), err
+}
+
+// placementRule returns the first placement rule matching f, or nil if no rule matches.
+func (c *Context) placementRule(f *File) (*PlacementRule, error) {
+	if len(c.PlacementRules) == 0 {
+		return nil, nil
+	}
+	rel, err := c.sourceRelPath(f)
+	if err != nil {
+		return nil, err
+	}
+	for x, r := range c.PlacementRules {
+		if matchPath(r.Match, rel) {
+			return &c.PlacementRules[x], nil
+		}
+	}
+	return nil, nil
+}
+
+// ruleSizeExceeded returns PlacementRuleSizeExceeded for the rule r if the files matching it need more than the free space
+// of the allowed devices. Nil is returned if the files fit.
+func (ct *catalogTracker) ruleSizeExceeded(r *PlacementRule, size uint64) error {
+	var free uint64
+	for x, a := range r.allowed(ct.ctx.Devices) {
+		if a {
+			free += ct.free[x]
+		}
+	}
+	if size <= free {
+		return nil
+	}
+	return PlacementRuleSizeExceeded{*r, size, free, size - free}
+}
+
+// placeRuled places the files matching placement rules, largest first, on the devices allowed by their rule. Before
+// anything is placed, the files of each rule are checked to fit on the allowed devices.
+func (ct *catalogTracker) placeRuled(files []*File, rules map[*File]*PlacementRule) error {
+	sizes := make(map[*PlacementRule]uint64)
+	for _, f := range files {
+		sizes[rules[f]] += f.allocatedSize()
+	}
+	for x := range ct.ctx.PlacementRules {
+		r := &ct.ctx.PlacementRules[x]
+		if err := ct.ruleSizeExceeded(r, sizes[r]); err != nil {
+			return err
+		}
+	}
+	sort.Stable(filesBySizeDecreasing(files))
+	defer func() { ct.allowed = nil }()
+	for _, f := range files {
+		r := rules[f]
+		Log.WithFields(logrus.Fields{"file": f.Path, "rule": r.String()}).Debugln("Placing file using placement rule")
+		ct.allowed = r.allowed(ct.ctx.Devices)
+		if err := ct.placeFile(f); err != nil {
+			if _, ok := err.(DevicePoolSizeExceeded); !ok {
+				return err
+			}
+			// The allowed devices were filled by the files of other rules
+			var placed uint64
+			for _, df := range f.DestFiles {
+				placed += f.allocated(df.StartByte, df.EndByte)
+			}
+			return ct.ruleSizeExceeded(r, sizes[r]-placed)
+		}
+		sizes[r] -= f.allocatedSize()
+	}
+	return nil
+}
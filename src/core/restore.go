@@ -0,0 +1,726 @@
+package core
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// RestoreSumMismatchError is given when the sum of restored data does not match the sum recorded in the sync context.
+// DestPath is set when the mismatch is for a single destination file of a split file.
+type RestoreSumMismatchError struct {
+	FilePath  string
+	DestPath  string
+	ExpectSum string
+	GotSum    string
+}
+
+// Error implements the Error interface.
+func (e RestoreSumMismatchError) Error() string {
+	if e.DestPath != "" {
+		return fmt.Sprintf("Restored data from %q for %q does not match: expect_sum=%s got=%s",
+			e.DestPath, e.FilePath, e.ExpectSum, e.GotSum)
+	}
+	return fmt.Sprintf("Restored file %q does not match: expect_sum=%s got=%s", e.FilePath, e.ExpectSum, e.GotSum)
+}
+
+// RestoreCopyError is given when copying data from a device to the restored file fails. Restoring from the device is
+// stopped.
+type RestoreCopyError struct {
+	DestPath string
+	err      error
+}
+
+// Error implements the Error interface.
+func (e RestoreCopyError) Error() string {
+	return fmt.Sprintf("Could not restore from %q: %s", e.DestPath, e.err)
+}
+
+// relPath returns p relative to the backup path. If the backup path does not end with a "/", then the base directory of the
+// backup path is included in the returned path, the same way it is included in the file index. With multiple backup paths,
+// the returned path starts with the name of the backup path containing p.
+func (c *Context) relPath(p string) (string, error) {
+	if len(c.BackupPaths) > 0 {
+		for _, bp := range c.BackupPaths {
+			if inPath(bp.Path, p) {
+				rel, err := filepath.Rel(bp.Path, filepath.Clean(p))
+				if err != nil {
+					return "", err
+				}
+				return filepath.Join(bp.Name, rel), nil
+			}
+		}
+		return "", fmt.Errorf("relPath: %q is not in a backup path", p)
+	}
+	base := filepath.Clean(c.BackupPath)
+	if !strings.HasSuffix(c.BackupPath, "/") {
+		base = filepath.Dir(base)
+	}
+	rel, err := filepath.Rel(base, filepath.Clean(p))
+	if err != nil {
+		return "", err
+	}
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("relPath: %q is not in backup path %q", p, c.BackupPath)
+	}
+	return rel, nil
+}
+
+// MatchFiles returns the files in the file index with a path relative to the backup path that matches pattern. The base
+// directory of the backup path is part of the relative path if the backup path does not end with a "/". Pattern segments
+// are matched using filepath.Match and "**" matches any number of directories. Files in a matching directory are matched
+// as well. With multiple backup paths, the relative path starts with the name of the backup path. The file holding the data
+// of a matching hardlink is returned as well, since the link is restored as another name of it.
+func (c *Context) MatchFiles(pattern string) (FileIndex, error) {
+	pattern = strings.Trim(filepath.ToSlash(filepath.Clean(pattern)), "/")
+	if err := checkPattern(pattern); err != nil {
+		return nil, fmt.Errorf("MatchFiles: %q: %s", pattern, err)
+	}
+	var fi FileIndex
+	for _, f := range c.FileIndex {
+		rel, err := c.relPath(f.Path)
+		if err != nil {
+			return nil, err
+		}
+		for p := filepath.ToSlash(rel); p != "."; p = path.Dir(p) {
+			if matchPath(pattern, p) {
+				fi.Add(f)
+				break
+			}
+		}
+	}
+	// The files storing the data of matched hardlinks and duplicates are restored as well. A hardlink can be another name
+	// of a duplicate.
+	matched := make(map[string]bool)
+	for _, f := range fi {
+		matched[f.Path] = true
+	}
+	for added := true; added; {
+		added = false
+		targets := make(map[string]bool)
+		for _, f := range fi {
+			if f.FileType == HARDLINK || f.FileType == DUPLICATE {
+				targets[f.LinkTarget] = true
+			}
+		}
+		for _, f := range c.FileIndex {
+			if targets[f.Path] && !matched[f.Path] {
+				fi.Add(f)
+				matched[f.Path] = true
+				added = true
+			}
+		}
+	}
+	return fi, nil
+}
+
+// FileDevices returns the indexes of the devices that contain destination files of the files in fi. A file that is split
+// across devices needs all of them.
+func (c *Context) FileDevices(fi FileIndex) []int {
+	names := make(map[string]bool)
+	for _, f := range fi {
+		for _, df := range f.DestFiles {
+			names[df.DeviceName] = true
+		}
+	}
+	var idx []int
+	for x, d := range c.Devices {
+		if names[d.Name] {
+			idx = append(idx, x)
+		}
+	}
+	return idx
+}
+
+// RestoreDevices returns the indexes of the devices that contain the destination files of the first copy of the files in fi.
+// The other devices returned by FileDevices are only needed if a destination file is missing or corrupt.
+func (c *Context) RestoreDevices(fi FileIndex) []int {
+	names := make(map[string]bool)
+	for _, f := range fi {
+		for _, df := range f.CopyDestFiles(0) {
+			names[df.DeviceName] = true
+		}
+	}
+	var idx []int
+	for x, d := range c.Devices {
+		if names[d.Name] {
+			idx = append(idx, x)
+		}
+	}
+	return idx
+}
+
+// byteRange is the range of bytes of a file from start up to, but not including, end.
+type byteRange struct {
+	start, end uint64
+}
+
+// addRange returns the sorted ranges rs with r added. Overlapping and adjacent ranges are merged.
+func addRange(rs []byteRange, r byteRange) []byteRange {
+	var out []byteRange
+	for _, x := range rs {
+		if x.end < r.start || x.start > r.end {
+			out = append(out, x)
+			continue
+		}
+		if x.start < r.start {
+			r.start = x.start
+		}
+		if x.end > r.end {
+			r.end = x.end
+		}
+	}
+	out = append(out, r)
+	sort.Sort(byteRanges(out))
+	return out
+}
+
+// missingRanges returns the parts of the range r that are not covered by the sorted ranges rs.
+func missingRanges(rs []byteRange, r byteRange) []byteRange {
+	var out []byteRange
+	next := r.start
+	for _, x := range rs {
+		if x.end <= next || x.start >= r.end {
+			continue
+		}
+		if x.start > next {
+			out = append(out, byteRange{next, x.start})
+		}
+		next = x.end
+	}
+	if next < r.end {
+		out = append(out, byteRange{next, r.end})
+	}
+	return out
+}
+
+// byteRanges sorts byte ranges by start byte.
+type byteRanges []byteRange
+
+func (b byteRanges) Len() int           { return len(b) }
+func (b byteRanges) Less(i, j int) bool { return b[i].start < b[j].start }
+func (b byteRanges) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// rangeWriter writes the data of a destination file starting at byte off of the restored file, but only the bytes within
+// ranges. The other bytes are already restored from another copy of the file. If sparse is set, zeros that were not
+// written before are skipped, so they become holes of the restored file.
+type rangeWriter struct {
+	file    *os.File
+	off     uint64
+	ranges  []byteRange
+	sparse  bool
+	written []byteRange
+}
+
+// hole returns true if the bytes b starting at byte off of the restored file can be left as a hole.
+func (w *rangeWriter) hole(b []byte, off uint64) bool {
+	if !w.sparse {
+		return false
+	}
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	r := byteRange{off, off + uint64(len(b))}
+	m := missingRanges(w.written, r)
+	return len(m) == 1 && m[0] == r
+}
+
+// Write implements the io.Writer interface.
+func (w *rangeWriter) Write(p []byte) (int, error) {
+	end := w.off + uint64(len(p))
+	for _, r := range w.ranges {
+		if r.end <= w.off || r.start >= end {
+			continue
+		}
+		s, e := r.start, r.end
+		if s < w.off {
+			s = w.off
+		}
+		if e > end {
+			e = end
+		}
+		if w.hole(p[s-w.off:e-w.off], s) {
+			continue
+		}
+		if _, err := w.file.WriteAt(p[s-w.off:e-w.off], int64(s)); err != nil {
+			return 0, err
+		}
+	}
+	w.off = end
+	return len(p), nil
+}
+
+// restoreFile tracks the byte ranges of a file that have been restored. If the destination files are restored in StartByte
+// order, the sum of the file is computed on the way, otherwise it is computed from the restored file once all of the bytes
+// are restored. Bytes restored from a destination file with a bad sum are written, but not counted as good, so they are
+// restored again from another copy of the file.
+type restoreFile struct {
+	hash    hash.Hash
+	next    uint64      // The next expected start byte
+	written []byteRange // The bytes written to the restored file
+	good    []byteRange // The bytes written from destination files with a good sum
+	opened  bool        // Set once the restored file is created, an existing file at its path is truncated first
+	done    bool
+}
+
+// restoreTracker tracks the state of the restore process.
+type restoreTracker struct {
+	ctx    *Context
+	index  FileIndex // The files being restored
+	target string
+	files  map[*File]*restoreFile
+}
+
+func newRestoreTracker(c *Context, fi FileIndex, target string) *restoreTracker {
+	return &restoreTracker{ctx: c, index: fi, target: target, files: make(map[*File]*restoreFile)}
+}
+
+// targetPath returns the restore path of f in the target directory.
+func (r *restoreTracker) targetPath(f *File) (string, error) {
+	rel, err := r.ctx.relPath(f.Path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(r.target, rel), nil
+}
+
+// restoreFile returns the restore state of f.
+func (r *restoreTracker) restoreFile(f *File) *restoreFile {
+	rf, ok := r.files[f]
+	if !ok {
+		rf = &restoreFile{hash: r.ctx.HashAlgorithm.New()}
+		r.files[f] = rf
+	}
+	return rf
+}
+
+// fileHash returns the writer used to compute the sum of f while the bytes need of df are restored. Nil is returned if df
+// is out of order or only partly restored.
+func (r *restoreTracker) fileHash(f *File, df *DestFile, need []byteRange) io.Writer {
+	rf := r.restoreFile(f)
+	whole := len(need) == 0 || (len(need) == 1 && need[0] == byteRange{df.StartByte, df.EndByte})
+	if rf.hash == nil || !whole || df.StartByte != rf.next {
+		Log.WithFields(logrus.Fields{"file": f.Path, "startByte": df.StartByte}).Debugln("Destination file out of order")
+		rf.hash = nil
+		return nil
+	}
+	rf.next = df.EndByte
+	return rf.hash
+}
+
+// needed returns the bytes of df that have not been restored from a destination file with a good sum. Nil is returned if
+// the file is completely restored.
+func (r *restoreTracker) needed(d *destFileData) []byteRange {
+	rf, ok := r.files[d.f]
+	if !ok {
+		return []byteRange{{d.df.StartByte, d.df.EndByte}}
+	}
+	if rf.done {
+		return nil
+	}
+	return missingRanges(rf.good, byteRange{d.df.StartByte, d.df.EndByte})
+}
+
+// makeDirs creates the directories of the file index in the target directory.
+func (r *restoreTracker) makeDirs() error {
+	if err := os.MkdirAll(r.target, 0755); err != nil {
+		return fmt.Errorf("restore: %s", err.Error())
+	}
+	for _, f := range r.index {
+		if f.FileType != DIRECTORY {
+			continue
+		}
+		p, err := r.targetPath(f)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(p, 0755); err != nil {
+			return fmt.Errorf("restore: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// restoreDestFile copies df from the device to the restored file at its start byte. Only the bytes not restored from
+// another copy of the file are written. The destination file is skipped if all of its bytes are restored.
+func (r *restoreTracker) restoreDestFile(d *destFileData, trakc chan<- fileTracker) error {
+	need := r.needed(d)
+	if len(need) == 0 && (d.df.Size > 0 || r.restoreFile(d.f).done) {
+		Log.WithFields(logrus.Fields{"file": d.f.Path, "destFile": d.df.Path}).Debugln("Restored from another copy")
+		return nil
+	}
+	p, err := r.targetPath(d.f)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return fmt.Errorf("restore: %s", err.Error())
+	}
+	sFile, err := os.Open(d.df.Path)
+	if err != nil {
+		return SyncSourceFileOpenError{fmt.Errorf("restore sfile open: %s", err.Error())}
+	}
+	defer sFile.Close()
+	flag := os.O_WRONLY | os.O_CREATE
+	if !r.restoreFile(d.f).opened {
+		// The bytes of an existing file would be left after the end of the restored file
+		flag |= os.O_TRUNC
+	}
+	oFile, err := os.OpenFile(p, flag, 0600)
+	if err != nil {
+		return SyncDestinatonFileOpenError{fmt.Errorf("restore ofile open: %s", err.Error())}
+	}
+	defer oFile.Close()
+	r.restoreFile(d.f).opened = true
+
+	Log.WithFields(logrus.Fields{"file": p, "destFile": d.df.Path, "device": d.dev.Name,
+		"fileSplitStart": d.df.StartByte, "fileSplitEnd": d.df.EndByte}).Infoln("Restoring file")
+
+	pReporter := make(chan uint64, 100)
+	rw := &rangeWriter{file: oFile, off: d.df.StartByte, ranges: need, sparse: d.f.Extents != nil,
+		written: r.restoreFile(d.f).written}
+	mIo := NewIoReaderWriter(p, rw, d.df.Size, pReporter, r.ctx.HashAlgorithm.New(), &r.ctx.Done)
+	w := mIo.MultiWriter()
+	if fh := r.fileHash(d.f, d.df, need); fh != nil {
+		w = io.MultiWriter(w, fh)
+	}
+
+	ft := fileTracker{io: mIo, f: d.f, df: d.df, device: d.dev, done: make(chan bool)}
+	trakc <- ft
+	if _, err = io.CopyN(w, sFile, int64(d.df.Size)); err != nil {
+		return RestoreCopyError{d.df.Path, err}
+	}
+	// Zero length files do not report any bytes written, see sync2dev.
+	if d.df.Size == 0 {
+		mIo.sizeWritn <- 0
+	}
+	<-ft.done
+
+	if err = oFile.Close(); err != nil {
+		return fmt.Errorf("restore: %s", err.Error())
+	}
+	d.df.done = true
+	rf := r.restoreFile(d.f)
+	for _, b := range need {
+		rf.written = addRange(rf.written, b)
+	}
+	if sum := mIo.SumToString(); d.df.Sum != "" && sum != d.df.Sum {
+		r.ctx.Errors <- RestoreSumMismatchError{d.f.Path, d.df.Path, d.df.Sum, sum}
+		// The bytes are restored again if another copy of the file has them
+		rf.hash = nil
+		return nil
+	}
+	for _, b := range need {
+		rf.good = addRange(rf.good, b)
+	}
+	if len(missingRanges(rf.good, byteRange{0, d.f.Size})) == 0 {
+		return r.finishFile(d.f, p, rf)
+	}
+	return nil
+}
+
+// finishFile checks the sum of a completely restored file and sets its metadata. A hole at the end of a sparse file is not
+// written, so the file is extended to its size.
+func (r *restoreTracker) finishFile(f *File, p string, rf *restoreFile) (err error) {
+	rf.done = true
+	if f.Extents != nil {
+		if err = os.Truncate(p, int64(f.Size)); err != nil {
+			return fmt.Errorf("restore: %s", err.Error())
+		}
+	}
+	var sum string
+	if rf.hash != nil {
+		sum = hex.EncodeToString(rf.hash.Sum(nil))
+	} else if sum, err = fileSum(r.ctx.HashAlgorithm, p); err != nil {
+		return
+	}
+	if f.Sum != "" && sum != f.Sum {
+		r.ctx.Errors <- RestoreSumMismatchError{FilePath: f.Path, ExpectSum: f.Sum, GotSum: sum}
+	} else {
+		Log.WithFields(logrus.Fields{"file": p, "sum": sum}).Infoln("Restored file sum")
+	}
+	if err = os.Chmod(p, f.Mode); err != nil {
+		return fmt.Errorf("restore: %s", err.Error())
+	}
+	if err = setFileMetaData(p, f); err != nil {
+		return
+	}
+	r.restoreXattrs(p, f)
+	return nil
+}
+
+// restoreXattrs sets the extended attributes of f on the restored file at p. Every attribute that could not be set is
+// reported on the error channel.
+func (r *restoreTracker) restoreXattrs(p string, f *File) {
+	for _, err := range setXattrs(p, f.Xattrs, nil) {
+		r.ctx.Errors <- err
+	}
+}
+
+// finishDamaged checks the sums and sets the metadata of the files that were written completely, but not only from
+// destination files with a good sum. No other copy of the damaged bytes was found.
+func (r *restoreTracker) finishDamaged() {
+	for _, f := range r.index {
+		rf, ok := r.files[f]
+		if !ok || rf.done || len(missingRanges(rf.written, byteRange{0, f.Size})) > 0 {
+			continue
+		}
+		p, err := r.targetPath(f)
+		if err == nil {
+			err = r.finishFile(f, p, rf)
+		}
+		if err != nil {
+			r.ctx.Errors <- err
+		}
+	}
+}
+
+// deviceNeeded returns true if the device holds bytes of the files that still need to be restored.
+func (r *restoreTracker) deviceNeeded(device *Device) bool {
+	for _, d := range r.index.DeviceFiles(device) {
+		if d.f.FileType == FILE && len(r.needed(d)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreDevice restores all of the destination files stored on device.
+func (r *restoreTracker) restoreDevice(device *Device, trakc chan<- fileTracker) {
+	Log.WithFields(logrus.Fields{"device": device.Name}).Infoln("Restoring from device")
+	for _, d := range r.index.DeviceFiles(device) {
+		if err := r.restoreDestFile(d, trakc); err != nil {
+			r.ctx.Errors <- err
+			if _, ok := err.(RestoreCopyError); ok {
+				// The file tracker for the device is still waiting on the failed copy
+				break
+			}
+		}
+	}
+	Log.WithFields(logrus.Fields{"device": device.Name, "mountPoint": device.MountPoint}).Info("Restore from device complete")
+}
+
+// restoreLinks creates the symlinks of the file index. Symlink targets within the backup path are pointed to the restored
+// target.
+func (r *restoreTracker) restoreLinks() {
+	for _, f := range r.index {
+		if f.FileType != SYMLINK {
+			continue
+		}
+		p, err := r.targetPath(f)
+		if err != nil {
+			r.ctx.Errors <- err
+			continue
+		}
+		tgt := f.SymlinkTarget
+		if rel, err := r.ctx.relPath(tgt); err == nil {
+			if tgt, err = filepath.Rel(filepath.Dir(p), filepath.Join(r.target, rel)); err != nil {
+				r.ctx.Errors <- err
+				continue
+			}
+		}
+		if err = os.Symlink(tgt, p); err == nil {
+			err = setFileMetaData(p, f)
+		}
+		if err != nil {
+			r.ctx.Errors <- fmt.Errorf("restore symlink: %s", err.Error())
+		}
+	}
+}
+
+// restoreDuplicates copies the restored files to the paths of their duplicates. The mode and metadata of each duplicate
+// are its own.
+func (r *restoreTracker) restoreDuplicates() {
+	for _, f := range r.index {
+		if f.FileType != DUPLICATE {
+			continue
+		}
+		if err := r.restoreDuplicate(f); err != nil {
+			r.ctx.Errors <- fmt.Errorf("restore duplicate: %s", err.Error())
+		}
+	}
+}
+
+// restoreDuplicate copies the restored file f is a duplicate of to the path of f, and checks the sum of the copy.
+func (r *restoreTracker) restoreDuplicate(f *File) error {
+	p, err := r.targetPath(f)
+	if err != nil {
+		return err
+	}
+	tgt, err := r.targetPath(&File{Path: f.LinkTarget})
+	if err != nil {
+		return err
+	}
+	src, err := openNoAtime(tgt)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	h := r.ctx.HashAlgorithm.New()
+	_, err = io.Copy(io.MultiWriter(dst, h), src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); f.Sum != "" && sum != f.Sum {
+		r.ctx.Errors <- RestoreSumMismatchError{FilePath: f.Path, ExpectSum: f.Sum, GotSum: sum}
+	}
+	if err := os.Chmod(p, f.Mode); err != nil {
+		return err
+	}
+	if err := setFileMetaData(p, f); err != nil {
+		return err
+	}
+	r.restoreXattrs(p, f)
+	return nil
+}
+
+// restoreHardlinks creates the hardlinks of the file index as other names of the restored files they link to.
+func (r *restoreTracker) restoreHardlinks() {
+	for _, f := range r.index {
+		if f.FileType != HARDLINK {
+			continue
+		}
+		p, err := r.targetPath(f)
+		if err != nil {
+			r.ctx.Errors <- err
+			continue
+		}
+		tgt, err := r.targetPath(&File{Path: f.LinkTarget})
+		if err == nil {
+			if err = os.MkdirAll(filepath.Dir(p), 0755); err == nil {
+				err = os.Link(tgt, p)
+			}
+		}
+		if err != nil {
+			r.ctx.Errors <- fmt.Errorf("restore hardlink: %s", err.Error())
+		}
+	}
+}
+
+// restoreDirMetaData sets the mode and metadata of the restored directories. This is done last and in reverse order so that
+// restoring files does not change the modification times.
+func (r *restoreTracker) restoreDirMetaData() {
+	for x := len(r.index) - 1; x >= 0; x-- {
+		f := r.index[x]
+		if f.FileType != DIRECTORY {
+			continue
+		}
+		p, err := r.targetPath(f)
+		if err == nil {
+			if err = os.Chmod(p, f.Mode); err == nil {
+				err = setFileMetaData(p, f)
+			}
+		}
+		if err != nil {
+			r.ctx.Errors <- fmt.Errorf("restore directory: %s", err.Error())
+			continue
+		}
+		r.restoreXattrs(p, f)
+	}
+}
+
+func restoreLaunch(c *Context, r *restoreTracker, index int, done chan bool) {
+	Log.Debugln("Starting Restore() iteration", index)
+	d := c.Devices[index]
+
+	// ENSURE DEVICE IS MOUNTED
+	c.SyncDeviceMount[index] <- true
+	<-c.SyncDeviceMount[index]
+	Log.Debugf("Received response from SyncDeviceMount[%d] channel request", index)
+
+	go c.SyncProgress.deviceCopyReporter(index)
+
+	r.restoreDevice(d, c.SyncProgress.Device[index].files)
+
+	done <- true
+
+	close(c.SyncProgress.Device[index].Report)
+	close(c.SyncProgress.Device[index].files)
+
+	Log.Debugln("RESTORE", index, "DONE")
+}
+
+// Restore rebuilds the files in fi into target from the devices recorded in a sync context loaded with
+// SyncContextFromPath. fi is either the file index of the context, or a subset of it returned by MatchFiles. The devices
+// returned by RestoreDevices are requested on the SyncDeviceMount channels, one at a time in device order. Split files are
+// put back together in StartByte order and the sum of every restored file is checked against the sum recorded in the
+// context. If a destination file is missing or corrupt, the bytes are restored from another copy of the file; the other
+// devices returned by FileDevices are only requested if they hold bytes that still need to be restored. Hardlinks are
+// recreated as other names of the restored files once all of the files are restored.
+func Restore(c *Context, fi FileIndex, target string) {
+	Log.WithFields(logrus.Fields{
+		"dataSize": fi.TotalSizeFiles(), "target": target,
+	}).Info("Restoring files")
+
+	r := newRestoreTracker(c, fi, target)
+	if err := r.makeDirs(); err != nil {
+		c.Errors <- err
+		close(c.SyncProgress.Report)
+		close(c.Done)
+		return
+	}
+
+	// Progress is tracked with the bytes read from each device
+	for _, d := range c.Devices {
+		d.SizeWritn = 0
+	}
+
+	done := make(chan bool)
+	launch := func(index int) {
+		go restoreLaunch(c, r, index, done)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Second):
+				c.SyncProgress.report(false)
+			}
+		}
+	}
+	used := make(map[int]bool)
+	for _, x := range c.RestoreDevices(fi) {
+		used[x] = true
+		launch(x)
+	}
+	// The devices holding the other copies are only needed for the missing and corrupt bytes
+	for _, x := range c.FileDevices(fi) {
+		if used[x] || !r.deviceNeeded(c.Devices[x]) {
+			continue
+		}
+		Log.WithFields(logrus.Fields{"device": c.Devices[x].Name}).Infoln("Restoring damaged files from another copy")
+		launch(x)
+	}
+	r.finishDamaged()
+
+	// One final update to show full copy
+	c.SyncProgress.report(true)
+
+	r.restoreDuplicates()
+	r.restoreHardlinks()
+	r.restoreLinks()
+	r.restoreDirMetaData()
+
+	close(c.SyncProgress.Report)
+	close(c.Done)
+}
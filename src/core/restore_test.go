@@ -0,0 +1,510 @@
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// restoreTest restores the files of a completed sync test using the sync context saved to the last device.
+type restoreTest struct {
+	t      *testing.T
+	sync   *syncTest
+	target string
+
+	expectErrors func() []error
+
+	// If set, called with the loaded sync context before restoring
+	beforeRestore func(c *Context)
+
+	match        string // Only restore files matching the pattern
+	expectFiles  int    // The number of files expected to match
+	expectDevice []int  // The indexes of the devices expected to be used by the restore
+
+	ctx    *Context
+	files  FileIndex
+	errors []error // The errors sent during the restore
+}
+
+// accessTime returns the access time of the file described by fi.
+func accessTime(fi os.FileInfo) time.Time {
+	return time.Unix(fi.Sys().(*syscall.Stat_t).Atim.Unix())
+}
+
+// checkRestoredFiles compares the restored files to the source files.
+func (r *restoreTest) checkRestoredFiles() {
+	for _, f := range r.files {
+		rel, err := r.ctx.relPath(f.Path)
+		if err != nil {
+			r.t.Error(err)
+			continue
+		}
+		p := filepath.Join(r.target, rel)
+		fi, err := os.Lstat(p)
+		if err != nil {
+			r.t.Error(err)
+			continue
+		}
+		if fi.Mode() != f.Mode {
+			r.t.Errorf("File: %q\n\t Got Mode: %s Expect: %s\n", p, fi.Mode(), f.Mode)
+		}
+		if f.FileType == HARDLINK {
+			tgt, err := r.ctx.relPath(f.LinkTarget)
+			if err != nil {
+				r.t.Error(err)
+				continue
+			}
+			if tfi, err := os.Stat(filepath.Join(r.target, tgt)); err != nil || !os.SameFile(fi, tfi) {
+				r.t.Errorf("Hardlink: %q\n\t Expect: Link to %q GOT: Another file (%v)", p, tgt, err)
+			}
+			continue
+		}
+		if f.FileType == DIRECTORY && !fi.ModTime().Equal(f.ModTime) {
+			r.t.Errorf("Directory: %q\n\t Got ModTime: %s Expect: %s\n", p, fi.ModTime(), f.ModTime)
+		}
+		if f.FileType != FILE && f.FileType != DUPLICATE {
+			continue
+		}
+		if !fi.ModTime().Equal(f.ModTime) {
+			r.t.Errorf("File: %q\n\t Got ModTime: %s Expect: %s\n", p, fi.ModTime(), f.ModTime)
+		}
+		if at := accessTime(fi); !at.Equal(f.AccTime) {
+			r.t.Errorf("File: %q\n\t Got AccTime: %s Expect: %s\n", p, at, f.AccTime)
+		}
+		if uint64(fi.Size()) != f.Size {
+			r.t.Errorf("File: %q\n\t Got Size: %d Expect: %d\n", p, fi.Size(), f.Size)
+		}
+		eSum, err := fileSum(r.ctx.HashAlgorithm, f.Path)
+		if err != nil {
+			r.t.Error(err)
+			continue
+		}
+		sum, err := fileSum(r.ctx.HashAlgorithm, p)
+		if err != nil {
+			r.t.Error(err)
+			continue
+		}
+		if sum != eSum {
+			r.t.Errorf("File: %q\n\t Expect Sum: %q\n\t Got Sum: %q", p, eSum, sum)
+		}
+	}
+}
+
+// Run syncs the files of the sync test, then restores them to a temporary target directory.
+func (r *restoreTest) Run() {
+	r.sync.saveSyncContext = true
+	r.sync.Run()
+	if r.t.Failed() {
+		return
+	}
+	r.ctx = r.sync.loadSyncContext()
+	r.target = NewMountPoint(r.t, testTempDir, "restore-")
+	if r.beforeRestore != nil {
+		r.beforeRestore(r.ctx)
+	}
+
+	s := &syncTest{t: r.t, ctx: r.ctx, expectErrors: r.expectErrors}
+	s.errorCollector()
+	s.progressDump()
+
+	r.files = r.ctx.FileIndex
+	if r.match != "" {
+		var err error
+		if r.files, err = r.ctx.MatchFiles(r.match); err != nil {
+			r.t.Fatalf("EXPECT: No errors from MatchFiles() GOT: %s", err)
+		}
+		if len(r.files) != r.expectFiles {
+			r.t.Errorf("EXPECT: %d files matching %q GOT: %d", r.expectFiles, r.match, len(r.files))
+		}
+	}
+	if r.expectDevice != nil {
+		if d := r.ctx.FileDevices(r.files); !reflect.DeepEqual(d, r.expectDevice) {
+			r.t.Errorf("EXPECT: Restore devices %v GOT: %v", r.expectDevice, d)
+		}
+	}
+
+	Restore(r.ctx, r.files, r.target)
+
+	// Slowdown, give the errorCollector a chance to process any errors
+	time.Sleep(time.Millisecond)
+	s.checkErrors()
+	r.errors = s.errors
+	if r.expectErrors != nil {
+		return
+	}
+	r.checkRestoredFiles()
+}
+
+func TestRestoreSimpleCopy(t *testing.T) {
+	r := &restoreTest{t: t,
+		sync: &syncTest{t: t,
+			backupPath: "../../testdata/filesync_freebooks/",
+			deviceList: func() DeviceList {
+				return DeviceList{
+					&Device{
+						Name:       "Test Device 0",
+						SizeTotal:  28173338480,
+						MountPoint: NewMountPoint(t, testTempDir, "mountpoint-0-"),
+					},
+				}
+			},
+		},
+	}
+	r.Run()
+}
+
+// TestRestoreFileSplitAcrossDevices restores files that were split across devices. The backup path does not end with a "/",
+// so the base directory is restored as well.
+func TestRestoreFileSplitAcrossDevices(t *testing.T) {
+	r := &restoreTest{t: t,
+		sync: &syncTest{t: t,
+			backupPath: "../../testdata/filesync_freebooks",
+			deviceList: func() DeviceList {
+				return DeviceList{
+					&Device{
+						Name:       "Test Device 0",
+						SizeTotal:  1493583,
+						MountPoint: NewMountPoint(t, testTempDir, "mountpoint-0-"),
+					},
+					&Device{
+						Name:       "Test Device 1",
+						SizeTotal:  1020000,
+						MountPoint: NewMountPoint(t, testTempDir, "mountpoint-1-"),
+					},
+				}
+			},
+		},
+	}
+	r.Run()
+	if _, err := os.Stat(filepath.Join(r.target, "filesync_freebooks")); err != nil {
+		t.Errorf("EXPECT: Restored base directory GOT: %s", err)
+	}
+}
+
+// TestRestoreOverLongerFile restores files split across devices over longer files at their paths. The existing files are
+// replaced, no bytes are left after the end of the restored files.
+func TestRestoreOverLongerFile(t *testing.T) {
+	r := &restoreTest{t: t,
+		sync: &syncTest{t: t,
+			backupPath: "../../testdata/filesync_freebooks",
+			deviceList: splitDevices(t),
+		},
+	}
+	r.beforeRestore = func(c *Context) {
+		for _, f := range c.FileIndex {
+			if f.FileType != FILE {
+				continue
+			}
+			rel, err := c.relPath(f.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := filepath.Join(r.target, rel)
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(p, bytes.Repeat([]byte{'x'}, int(f.Size)+4096), 0664); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	r.Run()
+}
+
+func TestRestoreSymlinks(t *testing.T) {
+	r := &restoreTest{t: t,
+		sync: &syncTest{t: t,
+			backupPath: "../../testdata/filesync_symlinks/",
+			deviceList: func() DeviceList {
+				return DeviceList{
+					&Device{
+						Name:       "Test Device 0",
+						SizeTotal:  28173338480,
+						MountPoint: NewMountPoint(t, testTempDir, "mountpoint-0-"),
+					},
+				}
+			},
+		},
+	}
+	r.Run()
+	tgt, err := os.Readlink(filepath.Join(r.target, "testlink"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tgt != "test.txt" {
+		t.Errorf("EXPECT: %s GOT: %s", "test.txt", tgt)
+	}
+}
+
+// TestRestoreBadDestFile expects a sha1 sum mismatch when a destination file is modified after the sync.
+func TestRestoreBadDestFile(t *testing.T) {
+	r := &restoreTest{t: t,
+		sync: &syncTest{t: t,
+			backupPath: "../../testdata/filesync_freebooks/alice/",
+			deviceList: func() DeviceList {
+				return DeviceList{
+					&Device{
+						Name:       "Test Device 0",
+						SizeTotal:  28173338480,
+						MountPoint: NewMountPoint(t, testTempDir, "mountpoint-0-"),
+					},
+				}
+			},
+		},
+		beforeRestore: func(c *Context) {
+			for _, f := range c.FileIndex {
+				if f.FileType != FILE || f.Size == 0 {
+					continue
+				}
+				df, err := os.OpenFile(f.DestFiles[0].Path, os.O_WRONLY, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				df.WriteAt([]byte("gds"), 0)
+				df.Close()
+				return
+			}
+		},
+		expectErrors: func() []error {
+			return []error{RestoreSumMismatchError{}}
+		},
+	}
+	r.Run()
+}
+
+// TestRestoreMatch restores the files of one directory when the files of the backup path are split across devices. Only the
+// devices holding the matched files are used.
+func TestRestoreMatch(t *testing.T) {
+	r := &restoreTest{t: t,
+		sync: &syncTest{t: t,
+			backupPath: "../../testdata/filesync_freebooks",
+			deviceList: func() DeviceList {
+				return DeviceList{
+					&Device{
+						Name:       "Test Device 0",
+						SizeTotal:  1493583,
+						MountPoint: NewMountPoint(t, testTempDir, "mountpoint-0-"),
+					},
+					&Device{
+						Name:       "Test Device 1",
+						SizeTotal:  1020000,
+						MountPoint: NewMountPoint(t, testTempDir, "mountpoint-1-"),
+					},
+				}
+			},
+		},
+		match:        "filesync_freebooks/alice/**",
+		expectFiles:  2,
+		expectDevice: []int{0},
+	}
+	r.Run()
+	if _, err := os.Stat(filepath.Join(r.target, "filesync_freebooks", "ulysses")); err == nil {
+		t.Error("EXPECT: filesync_freebooks/ulysses is not restored GOT: Restored")
+	}
+}
+
+// TestRestoreMatchSplitFile restores a single file that is split across devices. All of the devices holding the file are
+// needed.
+func TestRestoreMatchSplitFile(t *testing.T) {
+	r := &restoreTest{t: t,
+		sync: &syncTest{t: t,
+			backupPath: "../../testdata/filesync_freebooks",
+			deviceList: func() DeviceList {
+				return DeviceList{
+					&Device{
+						Name:       "Test Device 0",
+						SizeTotal:  1493583,
+						MountPoint: NewMountPoint(t, testTempDir, "mountpoint-0-"),
+					},
+					&Device{
+						Name:       "Test Device 1",
+						SizeTotal:  1020000,
+						MountPoint: NewMountPoint(t, testTempDir, "mountpoint-1-"),
+					},
+				}
+			},
+		},
+		match:        "**/ulysses/*.htm",
+		expectFiles:  1,
+		expectDevice: []int{0, 1},
+	}
+	r.Run()
+}
+
+// TestRestoreCopies corrupts the first copy of a file and removes the second part of the first copy of a split file. The
+// damaged bytes are restored from the second copy of the files on the third device.
+func TestRestoreCopies(t *testing.T) {
+	r := &restoreTest{t: t,
+		sync: &syncTest{t: t,
+			context: copiesContext(t, "../../testdata/filesync_freebooks", copiesDevices(t), 2),
+		},
+		beforeRestore: func(c *Context) {
+			modifyDestFile(t, c, "Test Device 0", func(df *DestFile) {
+				f, err := os.OpenFile(df.Path, os.O_WRONLY, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				f.WriteAt([]byte("gds"), 0)
+				f.Close()
+			})
+			modifyDestFile(t, c, "Test Device 1", func(df *DestFile) {
+				if df.StartByte == 0 {
+					t.Fatalf("EXPECT: The second part of a split file on %q GOT: %q", df.DeviceName, df.Path)
+				}
+				if err := os.Remove(df.Path); err != nil {
+					t.Fatal(err)
+				}
+			})
+		},
+		expectErrors: func() []error {
+			return []error{RestoreSumMismatchError{}, SyncSourceFileOpenError{}}
+		},
+	}
+	r.Run()
+	if t.Failed() {
+		return
+	}
+	for _, e := range r.errors {
+		if m, ok := e.(RestoreSumMismatchError); ok && m.DestPath == "" {
+			t.Errorf("EXPECT: Only the damaged destination file reported GOT: %s", e)
+		}
+	}
+	r.checkRestoredFiles()
+}
+
+// hardlinkSource returns a backup path with the file "a" hardlinked as "b" and "dir/c", and the file "d" that is not
+// linked.
+func hardlinkSource(t *testing.T) string {
+	src := NewMountPoint(t, testTempDir, "source-")
+	if err := os.Mkdir(filepath.Join(src, "dir"), 0775); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []string{"a", "d"} {
+		if err := ioutil.WriteFile(filepath.Join(src, n), bytes.Repeat([]byte(n), 4096), 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, n := range []string{"b", "dir/c"} {
+		if err := os.Link(filepath.Join(src, "a"), filepath.Join(src, n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return src + "/"
+}
+
+// TestRestoreHardlinks expects the hardlinks of a file to be stored once and restored as links to the restored file.
+func TestRestoreHardlinks(t *testing.T) {
+	src := hardlinkSource(t)
+	r := &restoreTest{t: t,
+		sync: &syncTest{t: t,
+			backupPath: src,
+			deviceList: func() DeviceList {
+				return DeviceList{
+					&Device{
+						Name:       "Test Device 0",
+						SizeTotal:  28173338480,
+						MountPoint: NewMountPoint(t, testTempDir, "mountpoint-0-"),
+					},
+				}
+			},
+		},
+	}
+	r.Run()
+	if t.Failed() {
+		return
+	}
+	links := make(map[string]string)
+	for _, f := range r.ctx.FileIndex {
+		if f.FileType == HARDLINK {
+			links[f.Path] = f.LinkTarget
+			if len(f.DestFiles) != 0 {
+				t.Errorf("EXPECT: No destination files for hardlink %q GOT: %d", f.Path, len(f.DestFiles))
+			}
+		}
+	}
+	expect := map[string]string{
+		filepath.Join(src, "b"):     filepath.Join(src, "a"),
+		filepath.Join(src, "dir/c"): filepath.Join(src, "a"),
+	}
+	if !reflect.DeepEqual(links, expect) {
+		t.Errorf("EXPECT: Hardlinks %v GOT: %v", expect, links)
+	}
+	if n := len(r.ctx.FileIndex.DeviceFiles(r.ctx.Devices[0])); n != 2 {
+		t.Errorf("EXPECT: 2 destination files GOT: %d", n)
+	}
+}
+
+// TestRestoreMatchHardlink expects the file a matching hardlink links to be restored with the link.
+func TestRestoreMatchHardlink(t *testing.T) {
+	r := &restoreTest{t: t,
+		sync: &syncTest{t: t,
+			backupPath: hardlinkSource(t),
+			deviceList: func() DeviceList {
+				return DeviceList{
+					&Device{
+						Name:       "Test Device 0",
+						SizeTotal:  28173338480,
+						MountPoint: NewMountPoint(t, testTempDir, "mountpoint-0-"),
+					},
+				}
+			},
+		},
+		match:       "dir/c",
+		expectFiles: 2,
+	}
+	r.Run()
+}
+
+// TestRestoreTimes expects the access and modification times of a file to be recorded in the sync context, set on the
+// destination file, and restored with nanosecond precision.
+func TestRestoreTimes(t *testing.T) {
+	src := NewMountPoint(t, testTempDir, "source-")
+	p := filepath.Join(src, "a")
+	if err := ioutil.WriteFile(p, []byte("times"), 0664); err != nil {
+		t.Fatal(err)
+	}
+	at := time.Unix(1262304000, 123456789)
+	mt := time.Unix(1420070400, 987654321)
+	if err := LUtimesNano(p, []syscall.Timespec{syscall.NsecToTimespec(at.UnixNano()),
+		syscall.NsecToTimespec(mt.UnixNano())}); err != nil {
+		t.Fatal(err)
+	}
+	r := &restoreTest{t: t,
+		sync: &syncTest{t: t,
+			backupPath: src + "/",
+			deviceList: func() DeviceList {
+				return DeviceList{
+					&Device{
+						Name:       "Test Device 0",
+						SizeTotal:  28173338480,
+						MountPoint: NewMountPoint(t, testTempDir, "mountpoint-0-"),
+					},
+				}
+			},
+		},
+	}
+	r.Run()
+	if t.Failed() {
+		return
+	}
+	f, err := r.ctx.FileIndex.FileByName("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.AccTime.Equal(at) || !f.ModTime.Equal(mt) {
+		t.Errorf("EXPECT: Recorded times %s %s GOT: %s %s", at, mt, f.AccTime, f.ModTime)
+	}
+	fi, err := os.Stat(f.DestFiles[0].Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().Equal(mt) {
+		t.Errorf("EXPECT: Destination file modification time %s GOT: %s", mt, fi.ModTime())
+	}
+	// The times of the restored file are compared by checkRestoredFiles before the file is read
+}
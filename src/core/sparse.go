@@ -0,0 +1,166 @@
+package core
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// The whence values of lseek(2) for finding the data and holes of a sparse file on Linux
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// Extent is a range of bytes of a sparse file holding data. The bytes between the extents are holes that read as zeros and
+// take up no space.
+type Extent struct {
+	Offset uint64 `json:"offset"`
+	Size   uint64 `json:"size"`
+}
+
+// dataExtents returns the data extents of the file at path using SEEK_DATA and SEEK_HOLE. Nil is returned if the file
+// system can not report the holes of the file.
+func dataExtents(path string, size uint64) ([]Extent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	extents := []Extent{}
+	for off := uint64(0); off < size; {
+		d, err := f.Seek(int64(off), seekData)
+		if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.ENXIO {
+			// No data after off
+			break
+		} else if ok && pe.Err == syscall.EINVAL {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		h, err := f.Seek(d, seekHole)
+		if err != nil {
+			return nil, err
+		}
+		if uint64(h) > size {
+			h = int64(size)
+		}
+		if h > d {
+			extents = append(extents, Extent{uint64(d), uint64(h - d)})
+		}
+		off = uint64(h)
+	}
+	return extents, nil
+}
+
+// allocated returns the number of bytes of the range from start to end of the file that take up space on a device. The holes
+// of a sparse file are not stored.
+func (f *File) allocated(start, end uint64) uint64 {
+	if f.Extents == nil {
+		return end - start
+	}
+	var size uint64
+	for _, e := range f.Extents {
+		s, t := e.Offset, e.Offset+e.Size
+		if s < start {
+			s = start
+		}
+		if t > end {
+			t = end
+		}
+		if t > s {
+			size += t - s
+		}
+	}
+	return size
+}
+
+// allocatedSize returns the number of bytes of the file that take up space on a device.
+func (f *File) allocatedSize() uint64 {
+	return f.allocated(0, f.Size)
+}
+
+// allocatedEnd returns the end of the longest range of the file starting at start that takes up at most size bytes on a
+// device. A range of a sparse file ending in a hole is extended to the next extent.
+func (f *File) allocatedEnd(start, size uint64) uint64 {
+	if f.Extents == nil {
+		if start+size > f.Size {
+			return f.Size
+		}
+		return start + size
+	}
+	for _, e := range f.Extents {
+		s, t := e.Offset, e.Offset+e.Size
+		if t <= start {
+			continue
+		}
+		if s < start {
+			s = start
+		}
+		if t-s > size {
+			return s + size
+		}
+		size -= t - s
+		if size == 0 {
+			// The hole after the extent takes up no space
+			for _, n := range f.Extents {
+				if n.Offset >= t {
+					return n.Offset
+				}
+			}
+			return f.Size
+		}
+	}
+	return f.Size
+}
+
+// copyExtents copies the data extents of the sparse file f in the range from start to end of src to dst, with start at the
+// beginning of dst. The holes are skipped, so they stay holes in dst, and their zeros are written to holes instead. This way
+// the sums of the range cover every byte.
+func (f *File) copyExtents(dst *os.File, data, holes io.Writer, src *os.File, start, end uint64) error {
+	off := start
+	zeros := func(n uint64) error {
+		z := make([]byte, 32*1024)
+		for n > 0 {
+			b := z
+			if n < uint64(len(b)) {
+				b = b[:n]
+			}
+			if _, err := holes.Write(b); err != nil {
+				return err
+			}
+			n -= uint64(len(b))
+		}
+		return nil
+	}
+	for _, e := range f.Extents {
+		s, t := e.Offset, e.Offset+e.Size
+		if s < start {
+			s = start
+		}
+		if t > end {
+			t = end
+		}
+		if t <= s {
+			continue
+		}
+		if err := zeros(s - off); err != nil {
+			return err
+		}
+		if _, err := src.Seek(int64(s), 0); err != nil {
+			return err
+		}
+		if _, err := dst.Seek(int64(s-start), 0); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(data, src, int64(t-s)); err != nil {
+			return err
+		}
+		off = t
+	}
+	if err := zeros(end - off); err != nil {
+		return err
+	}
+	// A hole at the end of the range is not written
+	return dst.Truncate(int64(end - start))
+}
@@ -0,0 +1,141 @@
+package core
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// sparseSource returns a backup path with the 4MiB sparse file "a.img" holding 64KiB of data at the start and at 3MiB, and
+// the file "b" that is not sparse. The test is skipped if the file system does not report the holes of the sparse file.
+func sparseSource(t *testing.T) string {
+	src := NewMountPoint(t, testTempDir, "source-")
+	f, err := os.Create(filepath.Join(src, "a.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data := make([]byte, 65536)
+	for _, off := range []int64{0, 3 << 20} {
+		if _, err := rand.Read(data); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteAt(data, off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Truncate(4 << 20); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	e, err := dataExtents(f.Name(), 4<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := []Extent{{0, 65536}, {3 << 20, 65536}}; !reflect.DeepEqual(e, expect) {
+		t.Skipf("File system does not report the holes of sparse files: expect extents %v GOT: %v", expect, e)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "b"), data[:4096], 0664); err != nil {
+		t.Fatal(err)
+	}
+	return src + "/"
+}
+
+func TestFileAllocated(t *testing.T) {
+	f := &File{Size: 1000, Extents: []Extent{{100, 100}, {500, 200}}}
+	tests := []struct {
+		start, end uint64
+		expect     uint64
+	}{
+		{0, 1000, 300},
+		{0, 100, 0},
+		{150, 600, 150},
+		{700, 1000, 0},
+	}
+	for _, test := range tests {
+		if got := f.allocated(test.start, test.end); got != test.expect {
+			t.Errorf("EXPECT: allocated(%d, %d) = %d GOT: %d", test.start, test.end, test.expect, got)
+		}
+	}
+	ends := []struct {
+		start, size uint64
+		expect      uint64
+	}{
+		{0, 50, 150},    // Ends in the first extent
+		{0, 100, 500},   // The hole after the first extent is free
+		{0, 300, 1000},  // The hole at the end of the file is free
+		{150, 100, 550}, // Starts in the first extent
+		{200, 1000, 1000},
+	}
+	for _, test := range ends {
+		if got := f.allocatedEnd(test.start, test.size); got != test.expect {
+			t.Errorf("EXPECT: allocatedEnd(%d, %d) = %d GOT: %d", test.start, test.size, test.expect, got)
+		}
+	}
+	if f := (&File{Size: 1000}); f.allocated(100, 300) != 200 || f.allocatedEnd(900, 300) != 1000 {
+		t.Errorf("EXPECT: Every byte of a file without extents is allocated GOT: %d", f.allocated(100, 300))
+	}
+}
+
+// TestRestoreSparse syncs a sparse file that only fits on the devices without its holes. The file is split in its second
+// extent, and the holes are kept on the devices and in the restored file.
+func TestRestoreSparse(t *testing.T) {
+	src := sparseSource(t)
+	r := &restoreTest{t: t,
+		sync: &syncTest{t: t,
+			backupPath: src,
+			deviceList: func() DeviceList {
+				return DeviceList{
+					&Device{
+						Name:       "Test Device 0",
+						SizeTotal:  99296, // 98304 bytes padded, the split is block aligned
+						MountPoint: NewMountPoint(t, testTempDir, "mountpoint-0-"),
+					},
+					&Device{
+						Name:       "Test Device 1",
+						SizeTotal:  200000,
+						MountPoint: NewMountPoint(t, testTempDir, "mountpoint-1-"),
+					},
+				}
+			},
+		},
+	}
+	r.Run()
+	if t.Failed() {
+		return
+	}
+	f, err := r.ctx.FileIndex.FileByName("a.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ranges [][2]uint64
+	for _, df := range f.DestFiles {
+		ranges = append(ranges, [2]uint64{df.StartByte, df.EndByte})
+		fi, err := os.Stat(df.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expect := f.allocated(df.StartByte, df.EndByte); usedSize(fi) != expect {
+			t.Errorf("EXPECT: %q uses %d bytes GOT: %d", df.Path, expect, usedSize(fi))
+		}
+	}
+	if expect := [][2]uint64{{0, 3<<20 + 32768}, {3<<20 + 32768, 4 << 20}}; !reflect.DeepEqual(ranges, expect) {
+		t.Errorf("EXPECT: Destination files %v GOT: %v", expect, ranges)
+	}
+	rel, err := r.ctx.relPath(f.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(filepath.Join(r.target, rel))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usedSize(fi) >= f.Size {
+		t.Errorf("EXPECT: Restored file keeps the holes GOT: %d bytes used", usedSize(fi))
+	}
+}
@@ -0,0 +1,271 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// sumsDeviceHeader starts the header line naming the device.
+const sumsDeviceHeader = "# gds device: "
+
+// sumsAlgorithmHeader starts the header line naming the hash algorithm of the sums.
+const sumsAlgorithmHeader = "# gds hash algorithm: "
+
+// SumsEntry is a checksum line of a checksum file.
+type SumsEntry struct {
+	Sum  string
+	Path string // The path of the destination file relative to the directory of the checksum file
+}
+
+// Sums is a checksum file in the format of the coreutils tools, like sha1sum or b2sum.
+type Sums struct {
+	DeviceName    string // Read from the header written by gds, empty if the file was not written by gds
+	HashAlgorithm HashAlgorithm
+	Entries       []SumsEntry
+}
+
+// SumsBadLineError is given when a line of a checksum file is not in the format written by the coreutils tools.
+type SumsBadLineError struct {
+	Path string
+	Line int
+}
+
+// Error implements the Error interface.
+func (e SumsBadLineError) Error() string {
+	return fmt.Sprintf("Improperly formatted checksum line %d in %q", e.Line, e.Path)
+}
+
+// SumsUnknownAlgorithmError is given when the hash algorithm of a checksum file cannot be determined.
+type SumsUnknownAlgorithmError struct {
+	Path string
+}
+
+// Error implements the Error interface.
+func (e SumsUnknownAlgorithmError) Error() string {
+	return fmt.Sprintf("Unknown hash algorithm of checksum file %q", e.Path)
+}
+
+// sumsEscaper and sumsUnescaper handle file names with backslashes or newlines the same way as coreutils. A line with an
+// escaped name starts with a backslash.
+var (
+	sumsEscaper   = strings.NewReplacer("\\", "\\\\", "\n", "\\n")
+	sumsUnescaper = strings.NewReplacer("\\\\", "\\", "\\n", "\n")
+)
+
+// sumsLine returns the checksum line of a file in the format of the coreutils tools.
+func sumsLine(sum, name string) string {
+	if strings.ContainsAny(name, "\\\n") {
+		return fmt.Sprintf("\\%s  %s\n", sum, sumsEscaper.Replace(name))
+	}
+	return fmt.Sprintf("%s  %s\n", sum, name)
+}
+
+// sumsTool returns the name of the coreutils tool checking the sums of the algorithm.
+func sumsTool(a HashAlgorithm) string {
+	if a == HashBLAKE2b {
+		return "b2sum"
+	}
+	return string(a) + "sum"
+}
+
+// NewSums returns the contents of the checksum file of the destination files copied to the device. The comment header
+// maps the destination files to the source files, relative to the backup path, and the byte ranges they contain.
+func (c *Context) NewSums(device *Device) ([]byte, error) {
+	var head, sums bytes.Buffer
+	var number int
+	for x, d := range c.Devices {
+		if d == device {
+			number = x + 1
+		}
+	}
+	fmt.Fprintf(&head, "%s%s (%d of %d)\n", sumsDeviceHeader, device.Name, number, len(c.Devices))
+	fmt.Fprintf(&head, "%s%s\n", sumsAlgorithmHeader, c.HashAlgorithm)
+	fmt.Fprintf(&head, "# Check with: cd <mount point> && %s -c %s\n", sumsTool(c.HashAlgorithm),
+		c.HashAlgorithm.SumsFileName())
+	if len(c.BackupPaths) == 0 {
+		fmt.Fprintf(&head, "# Backup path: %q\n", c.BackupPath)
+	}
+	for _, bp := range c.BackupPaths {
+		fmt.Fprintf(&head, "# Backup path: %q %q\n", bp.Name, bp.Path)
+	}
+	fmt.Fprintf(&head, "# <destination file> <source file> <start byte>-<end byte>\n")
+	for _, d := range c.FileIndex.DeviceFiles(device) {
+		if d.f.FileType != FILE || !d.df.done || d.df.Sum == "" {
+			continue
+		}
+		rel, err := filepath.Rel(device.MountPoint, d.df.Path)
+		if err != nil {
+			return nil, err
+		}
+		src, err := c.relPath(d.f.Path)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&head, "# %q %q %d-%d\n", rel, src, d.df.StartByte, d.df.EndByte)
+		sums.WriteString(sumsLine(d.df.Sum, rel))
+	}
+	head.Write(sums.Bytes())
+	return head.Bytes(), nil
+}
+
+// saveSums writes the checksum file of the device to the root of the device. The checksum files of the other hash
+// algorithms written by a previous sync are removed, they do not match the files on the device anymore.
+func saveSums(c *Context, device *Device) error {
+	b, err := c.NewSums(device)
+	if err != nil {
+		return err
+	}
+	// The file of a previous sync is replaced
+	device.SumsSize = 0
+	name := c.HashAlgorithm.SumsFileName()
+	if device.SumsSize, err = writeMetadataFile(device, name, b); err != nil {
+		return err
+	}
+	Log.WithFields(logrus.Fields{"device": device.Name, "file": name, "size": device.SumsSize}).Infoln("Saved sums")
+	for _, h := range hashAlgorithms {
+		if h.sumsFile == name {
+			continue
+		}
+		if err := os.Remove(filepath.Join(device.MountPoint, h.sumsFile)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindSumsFile returns the path of the checksum file written by gds in the directory dir. The SHA1SUMS path is returned if
+// there is none.
+func FindSumsFile(dir string) string {
+	for _, a := range []HashAlgorithm{HashSHA1, HashSHA256, HashSHA512, HashBLAKE2b} {
+		p := filepath.Join(dir, a.SumsFileName())
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return filepath.Join(dir, HashSHA1.SumsFileName())
+}
+
+// sumsAlgorithm returns the hash algorithm of the checksum file at path. The header written by gds is used if there is one,
+// then the name of the file, and finally the length of the sums.
+func sumsAlgorithm(path, header string, sumLen int) (HashAlgorithm, bool) {
+	if a := HashAlgorithm(header); header != "" {
+		return a, checkHashAlgorithm(a) == nil
+	}
+	for a, h := range hashAlgorithms {
+		if filepath.Base(path) == h.sumsFile {
+			return a, true
+		}
+	}
+	// The length of BLAKE2b-512 sums is the same as SHA-512, those files are recognized by name
+	for _, a := range []HashAlgorithm{HashSHA1, HashSHA256, HashSHA512} {
+		if a.New().Size()*2 == sumLen {
+			return a, true
+		}
+	}
+	return "", false
+}
+
+// ReadSums reads the checksum file at path. Comments and empty lines are ignored.
+func ReadSums(path string) (*Sums, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sums := &Sums{}
+	var header string
+	var lines []int
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if strings.HasPrefix(line, sumsDeviceHeader) {
+			sums.DeviceName = strings.TrimPrefix(line, sumsDeviceHeader)
+			if x := strings.LastIndex(sums.DeviceName, " ("); x != -1 {
+				sums.DeviceName = sums.DeviceName[:x]
+			}
+		}
+		if strings.HasPrefix(line, sumsAlgorithmHeader) {
+			header = strings.TrimPrefix(line, sumsAlgorithmHeader)
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		escaped := strings.HasPrefix(line, "\\")
+		if escaped {
+			line = line[1:]
+		}
+		// Binary mode lines use " *" as the separator
+		x := strings.Index(line, " ")
+		if x < 1 || len(line) < x+3 || (line[x+1] != ' ' && line[x+1] != '*') {
+			return nil, SumsBadLineError{path, n}
+		}
+		e := SumsEntry{Sum: line[:x], Path: line[x+2:]}
+		if escaped {
+			e.Path = sumsUnescaper.Replace(e.Path)
+		}
+		sums.Entries = append(sums.Entries, e)
+		lines = append(lines, n)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	var sumLen int
+	if len(sums.Entries) > 0 {
+		sumLen = len(sums.Entries[0].Sum)
+	}
+	a, ok := sumsAlgorithm(path, header, sumLen)
+	if !ok {
+		return nil, SumsUnknownAlgorithmError{path}
+	}
+	sums.HashAlgorithm = a
+	for x, e := range sums.Entries {
+		if len(e.Sum) != a.New().Size()*2 {
+			return nil, SumsBadLineError{path, lines[x]}
+		}
+	}
+	return sums, nil
+}
+
+// VerifySums hashes the files listed in the checksum file at path and compares them to the listed sums. The paths are
+// relative to the directory of the checksum file. A sync context is not needed.
+func VerifySums(path string) (*VerifyDeviceReport, error) {
+	sums, err := ReadSums(path)
+	if err != nil {
+		return nil, err
+	}
+	root := filepath.Dir(path)
+	name := sums.DeviceName
+	if name == "" {
+		name = root
+	}
+	report := &VerifyDeviceReport{DeviceName: name}
+	for _, e := range sums.Entries {
+		report.Checked++
+		p := filepath.Join(root, e.Path)
+		if _, err := os.Lstat(p); os.IsNotExist(err) {
+			report.Missing++
+			report.Errors = append(report.Errors, VerifyDestFileMissingError{e.Path, p})
+			continue
+		}
+		sum, err := fileSum(sums.HashAlgorithm, p)
+		if err != nil {
+			report.Errors = append(report.Errors, err)
+			continue
+		}
+		if sum != e.Sum {
+			report.Mismatched++
+			report.Errors = append(report.Errors, BadDestPathSum{e.Sum, sum, p})
+		}
+	}
+	Log.WithFields(logrus.Fields{
+		"sums": path, "hashAlgorithm": sums.HashAlgorithm, "checked": report.Checked, "missing": report.Missing,
+		"mismatched": report.Mismatched,
+	}).Infoln("Verify sums complete")
+	return report, nil
+}
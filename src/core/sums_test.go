@@ -0,0 +1,162 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestSyncSums checks the checksum file written to each device can be checked by the coreutils tool of the hash algorithm
+// and gds.
+func TestSyncSums(t *testing.T) {
+	for _, a := range []HashAlgorithm{HashSHA1, HashSHA256, HashSHA512, HashBLAKE2b} {
+		s := &syncTest{t: t,
+			context: func() *Context {
+				c, err := NewContext("../../testdata/filesync_freebooks", 0, FileIndex{}, splitDevices(t)(), 0)
+				if err != nil {
+					t.Fatalf("EXPECT: No errors from NewContext() GOT: %s", err)
+				}
+				c.HashAlgorithm = a
+				return c
+			},
+		}
+		s.Run()
+		if t.Failed() {
+			return
+		}
+		expectChecked := []int{3, 1}
+		for x, d := range s.ctx.Devices {
+			p := filepath.Join(d.MountPoint, a.SumsFileName())
+			if _, err := exec.LookPath(sumsTool(a)); err == nil {
+				cmd := exec.Command(sumsTool(a), "-c", "--strict", a.SumsFileName())
+				cmd.Dir = d.MountPoint
+				if out, err := cmd.CombinedOutput(); err != nil {
+					t.Errorf("EXPECT: No errors from %s -c GOT: %s (%s)", sumsTool(a), err, out)
+				}
+			}
+			if FindSumsFile(d.MountPoint) != p {
+				t.Errorf("EXPECT: FindSumsFile() == %q GOT: %q", p, FindSumsFile(d.MountPoint))
+			}
+			r, err := VerifySums(p)
+			if err != nil {
+				t.Fatalf("EXPECT: No errors from VerifySums() GOT: %s", err)
+			}
+			if r.DeviceName != d.Name || r.Checked != expectChecked[x] || r.Failed() {
+				t.Errorf("EXPECT: %q checked %d files without errors using %s GOT: %+v", d.Name, expectChecked[x], a, *r)
+			}
+		}
+
+		// Corrupt a destination file
+		modifyDestFile(t, s.ctx, "Test Device 0", func(df *DestFile) {
+			if err := ioutil.WriteFile(df.Path, make([]byte, df.Size), 0644); err != nil {
+				t.Fatal(err)
+			}
+		})
+		r, err := VerifySums(filepath.Join(s.ctx.Devices[0].MountPoint, a.SumsFileName()))
+		if err != nil {
+			t.Fatalf("EXPECT: No errors from VerifySums() GOT: %s", err)
+		}
+		if r.Mismatched != 1 || len(r.Errors) != 1 {
+			t.Errorf("EXPECT: 1 mismatched file using %s GOT: %+v", a, *r)
+		} else if _, ok := r.Errors[0].(BadDestPathSum); !ok {
+			t.Errorf("EXPECT: Error type %T GOT: %T", BadDestPathSum{}, r.Errors[0])
+		}
+	}
+}
+
+// TestReadSumsEscaped reads names with backslashes and newlines escaped like sha1sum does.
+func TestReadSumsEscaped(t *testing.T) {
+	p := filepath.Join(NewMountPoint(t, testTempDir, "sums-"), HashSHA1.SumsFileName())
+	sum := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	b := "# comment\n\n" + sumsLine(sum, "a\\b\nc") + sumsLine(sum, "plain name") + sum + " *binary\n"
+	if err := ioutil.WriteFile(p, []byte(b), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sums, err := ReadSums(p)
+	if err != nil {
+		t.Fatalf("EXPECT: No errors from ReadSums() GOT: %s", err)
+	}
+	expect := []SumsEntry{{sum, "a\\b\nc"}, {sum, "plain name"}, {sum, "binary"}}
+	if !reflect.DeepEqual(sums.Entries, expect) || sums.HashAlgorithm != HashSHA1 {
+		t.Errorf("EXPECT: %s %q GOT: %s %q", HashSHA1, expect, sums.HashAlgorithm, sums.Entries)
+	}
+
+	if err := ioutil.WriteFile(p, []byte("not a checksum\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadSums(p); !reflect.DeepEqual(err, SumsBadLineError{p, 1}) {
+		t.Errorf("EXPECT: %T GOT: %v", SumsBadLineError{}, err)
+	}
+}
+
+// TestSyncSumsOtherAlgorithm syncs with SHA-256 to devices holding the SHA1SUMS file of a previous sync. The stale file
+// is removed, so FindSumsFile returns the checksum file of the sync.
+func TestSyncSumsOtherAlgorithm(t *testing.T) {
+	s := &syncTest{t: t,
+		context: func() *Context {
+			c := hashAlgorithmContext(t, HashSHA256)()
+			stale := []byte(sumsLine("da39a3ee5e6b4b0d3255bfef95601890afd80709", "a"))
+			for _, d := range c.Devices {
+				p := filepath.Join(d.MountPoint, HashSHA1.SumsFileName())
+				if err := ioutil.WriteFile(p, stale, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return c
+		},
+	}
+	s.Run()
+	if t.Failed() {
+		return
+	}
+	for _, d := range s.ctx.Devices {
+		if _, err := os.Stat(filepath.Join(d.MountPoint, HashSHA1.SumsFileName())); !os.IsNotExist(err) {
+			t.Errorf("EXPECT: %s removed from %q GOT: %v", HashSHA1.SumsFileName(), d.Name, err)
+		}
+		if p := filepath.Join(d.MountPoint, HashSHA256.SumsFileName()); FindSumsFile(d.MountPoint) != p {
+			t.Errorf("EXPECT: FindSumsFile() == %q GOT: %q", p, FindSumsFile(d.MountPoint))
+		}
+	}
+}
+
+// TestReadSumsAlgorithm determines the hash algorithm of checksum files from the header, the file name and the length of
+// the sums.
+func TestReadSumsAlgorithm(t *testing.T) {
+	dir := NewMountPoint(t, testTempDir, "sums-")
+	sha1Sum := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	sha256Sum := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	tests := []struct {
+		name   string
+		data   string
+		expect HashAlgorithm
+		err    error
+	}{
+		{"sums", sumsAlgorithmHeader + "sha256\n" + sumsLine(sha256Sum, "a"), HashSHA256, nil},
+		{"SHA256SUMS", sumsLine(sha256Sum, "a"), HashSHA256, nil},
+		{"sums", sumsLine(sha1Sum, "a"), HashSHA1, nil},
+		{"sums", sumsLine(sha1Sum, "a") + sumsLine(sha256Sum, "b"), "", SumsBadLineError{Line: 2}},
+		{"sums", sumsAlgorithmHeader + "md5\n" + sumsLine(sha1Sum, "a"), "", SumsUnknownAlgorithmError{}},
+		{"B2SUMS", sumsLine(sha1Sum, "a"), "", SumsBadLineError{Line: 1}},
+	}
+	for _, test := range tests {
+		p := filepath.Join(dir, test.name)
+		if err := ioutil.WriteFile(p, []byte(test.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		sums, err := ReadSums(p)
+		switch e := err.(type) {
+		case SumsBadLineError:
+			e.Path = ""
+			err = e
+		case SumsUnknownAlgorithmError:
+			e.Path = ""
+			err = e
+		}
+		if err != test.err || (err == nil && sums.HashAlgorithm != test.expect) {
+			t.Errorf("EXPECT: %s %v from %q GOT: %v %v", test.expect, test.err, test.data, sums, err)
+		}
+	}
+}
@@ -9,7 +9,9 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -72,9 +74,10 @@ func saveSyncContext(c *Context) (size uint64, err error) {
 	lastDevice := c.Devices[len(c.Devices)-1]
 	Log.WithFields(logrus.Fields{
 		"sgzSize+lastDevice.SizeWritn": uint64(sgzSize) + lastDevice.SizeWritn,
+		"lastDevice.SizeUsed":          lastDevice.SizeUsed,
 		"lastDevice.SizeTotalPadded":   lastDevice.SizeTotalPadded(),
 	}).Debugln("saveSyncContext: Sizes")
-	if uint64(sgzSize)+lastDevice.SizeWritn > lastDevice.SizeTotalPadded() {
+	if uint64(sgzSize)+lastDevice.SizeWritn+lastDevice.SizeUsed+lastDevice.sizeMetadata() > lastDevice.SizeTotalPadded() {
 		err = SyncNotEnoughDeviceSpaceForSyncContextError{
 			lastDevice.Name, lastDevice.SizeWritn, lastDevice.SizeTotalPadded(), uint64(sgzSize),
 		}
@@ -127,14 +130,189 @@ func (e SyncSourceFileOpenError) Error() string {
 	return e.err.Error()
 }
 
+// SyncRemoveOrphanError is given when an orphaned destination file of a previous sync could not be removed from a device.
+type SyncRemoveOrphanError struct {
+	DestPath string
+	err      error
+}
+
+// Error implements the Error interface.
+func (e SyncRemoveOrphanError) Error() string {
+	return fmt.Sprintf("Could not remove orphaned destination file %q: %s", e.DestPath, e.err)
+}
+
+// removeOrphans removes the destination files of a previous sync that are not used anymore from the device. The paths
+// of the removed files are returned.
+func removeOrphans(c *Context, device *Device) (removed []string) {
+	for _, df := range c.deviceOrphans(device) {
+		if err := os.Remove(df.Path); err != nil && !os.IsNotExist(err) {
+			c.Errors <- SyncRemoveOrphanError{df.Path, err}
+			continue
+		}
+		df.done = true
+		removed = append(removed, df.Path)
+		Log.WithFields(logrus.Fields{"destPath": df.Path, "size": df.Size}).Infoln("Removed orphaned destination file")
+	}
+	return
+}
+
+// SyncMoveDestFileError is given when the kept destination file of a renamed file could not be moved to its new path on
+// a device using the mirror layout.
+type SyncMoveDestFileError struct {
+	DestPath    string
+	RenamedFrom string
+	err         error
+}
+
+// Error implements the Error interface.
+func (e SyncMoveDestFileError) Error() string {
+	return fmt.Sprintf("Could not move destination file %q to %q: %s", e.RenamedFrom, e.DestPath, e.err)
+}
+
+// moveRenamedFiles moves the kept destination files of renamed files on the device to their new paths. This is done
+// before any file is copied, the new files can use the previous paths. The previous paths of the moved files are
+// returned.
+func moveRenamedFiles(c *Context, device *Device) (moved []string) {
+	for _, d := range c.FileIndex.DeviceFiles(device) {
+		if !d.f.Kept || d.df.RenamedFrom == "" {
+			continue
+		}
+		prev := d.df.RenamedFrom
+		err := os.MkdirAll(filepath.Dir(d.df.Path), 0755)
+		if err == nil {
+			err = os.Rename(prev, d.df.Path)
+		}
+		if _, serr := os.Lstat(d.df.Path); os.IsNotExist(err) && serr == nil {
+			// Moved by an interrupted sync that is being resumed
+			err = nil
+		}
+		if err != nil {
+			c.Errors <- SyncMoveDestFileError{d.df.Path, prev, err}
+			continue
+		}
+		d.df.RenamedFrom = ""
+		moved = append(moved, prev)
+		Log.WithFields(logrus.Fields{"destPath": d.df.Path, "previousDestPath": prev}).Infoln("Moved destination file")
+		if !d.f.MetaChanged {
+			d.df.done = true
+			journalRecord(c, d.df)
+		}
+	}
+	return
+}
+
+// removeEmptyDirs removes the directories of the removed and moved destination files at paths from a device using the
+// mirror layout if they are empty, and the directories of the previous sync that were deleted from the backup path.
+// Their parents are removed as well, up to the first directory that is still in the backup path or not empty.
+func removeEmptyDirs(c *Context, device *Device, paths []string) {
+	keep := make(map[string]bool)
+	for _, f := range c.FileIndex {
+		if f.FileType != DIRECTORY {
+			continue
+		}
+		if rel, err := c.relPath(f.Path); err == nil {
+			keep[filepath.Join(device.MountPoint, rel)] = true
+		}
+	}
+	var dirs []string
+	for _, p := range paths {
+		dirs = append(dirs, filepath.Dir(p))
+	}
+	for _, p := range c.deletedDirs {
+		if rel, err := c.relPath(p); err == nil {
+			dirs = append(dirs, filepath.Join(device.MountPoint, rel))
+		}
+	}
+	// Children first
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	mp := filepath.Clean(device.MountPoint)
+	for _, d := range dirs {
+		for ; strings.HasPrefix(d, mp+"/") && !keep[d]; d = filepath.Dir(d) {
+			// Only removes empty directories
+			if err := syscall.Rmdir(d); err != nil {
+				break
+			}
+			Log.WithFields(logrus.Fields{"device": device.Name, "dir": d}).Infoln("Removed empty directory")
+		}
+	}
+}
+
+// mirrorDirs creates the directories of the backup path on a device using the mirror layout. The metadata of the
+// directories is set after the files are copied, children first, so that creating files does not change the modification
+// times.
+func mirrorDirs(c *Context, device *Device) {
+	for x := len(c.FileIndex) - 1; x >= 0; x-- {
+		f := c.FileIndex[x]
+		if f.FileType != DIRECTORY {
+			continue
+		}
+		rel, err := c.relPath(f.Path)
+		if err != nil {
+			c.Errors <- err
+			continue
+		}
+		p := filepath.Join(device.MountPoint, rel)
+		if err = os.MkdirAll(p, 0755); err == nil {
+			if err = os.Chmod(p, f.Mode.Perm()); err == nil {
+				err = setFileMetaData(p, f)
+			}
+		}
+		if err != nil {
+			c.Errors <- fmt.Errorf("mirrorDirs: %s", err.Error())
+			continue
+		}
+		c.setDestXattrs(device, p, f)
+	}
+}
+
+// journalRecord records the completed destination file in the journal of the context.
+func journalRecord(c *Context, df *DestFile) {
+	if c.Journal == nil {
+		return
+	}
+	if err := c.Journal.Record(df); err != nil {
+		c.Errors <- fmt.Errorf("journal: %s", err.Error())
+	}
+}
+
 // sync2dev is the main file syncing function. It is big, mean, and will eat your bytes.
 func sync2dev(c *Context, device *Device, trakc chan<- fileTracker) {
 	Log.WithFields(logrus.Fields{"device": device.Name}).Infoln("Syncing to device")
 
 	syncErrCtx := fmt.Sprintf("sync Device[%q]:", device.Name)
 
+	// Free the space used by files that were deleted or modified since the previous sync
+	removed := removeOrphans(c, device)
+	if device.Layout == LayoutMirror {
+		removed = append(removed, moveRenamedFiles(c, device)...)
+		removeEmptyDirs(c, device, removed)
+	}
+
 	for _, d := range c.FileIndex.DeviceFiles(device) {
 
+		if d.f.Kept {
+			if d.f.MetaChanged && !d.df.done {
+				// Only the metadata has changed since the previous sync
+				err := os.Chmod(d.df.Path, d.f.Mode)
+				if err == nil {
+					err = d.df.setMetaData(d.f)
+				}
+				if err != nil {
+					c.Errors <- fmt.Errorf("%s %s", syncErrCtx, err.Error())
+					continue
+				}
+				c.setDestXattrs(device, d.df.Path, d.f)
+				d.df.done = true
+				journalRecord(c, d.df)
+			}
+			continue
+		}
+
+		if d.df.done {
+			// Copied by an interrupted sync that is being resumed
+			continue
+		}
+
 		d.df.createFile(d.f)
 		if d.df.err != nil {
 			c.Errors <- d.df.err
@@ -152,8 +330,8 @@ func sync2dev(c *Context, device *Device, trakc chan<- fileTracker) {
 
 		var oFile *os.File
 		var err error
-		// Open dest file for writing
-		oFile, err = os.OpenFile(d.df.Path, os.O_RDWR, d.f.Mode)
+		// Open dest file for writing. A partially written file of an interrupted sync is truncated.
+		oFile, err = os.OpenFile(d.df.Path, os.O_RDWR|os.O_TRUNC, d.f.Mode)
 		if err != nil {
 			c.Errors <- SyncDestinatonFileOpenError{fmt.Errorf("%s ofile open: %s", syncErrCtx, err.Error())}
 			continue
@@ -162,13 +340,17 @@ func sync2dev(c *Context, device *Device, trakc chan<- fileTracker) {
 
 		var sFile *os.File
 		var syncTest bool
+		var before sourceState
 		if strings.Contains(d.f.Path, fakeTestPath) {
 			// For testing
 			syncTest = true
 			sFile, err = os.Open("/dev/urandom")
 		} else {
-			sFile, err = os.Open(d.f.Path)
-			defer sFile.Close()
+			// Used to catch changes to the source file during the copy
+			if before, err = statSource(d.f.Path); err == nil {
+				sFile, err = os.Open(d.f.Path)
+				defer sFile.Close()
+			}
 		}
 		if err != nil {
 			c.Errors <- SyncSourceFileOpenError{fmt.Errorf("%s sfile open: %s", syncErrCtx, err.Error())}
@@ -184,9 +366,19 @@ func sync2dev(c *Context, device *Device, trakc chan<- fileTracker) {
 			}
 		}
 
+		// The progress counts the bytes stored on the device, the holes of a sparse file are only written to the sums
+		allocated := d.f.allocated(d.df.StartByte, d.df.EndByte)
 		pReporter := make(chan uint64, 100)
-		mIo := NewIoReaderWriter(d.df.Path, oFile, d.df.Size, pReporter, false, &c.Done)
+		mIo := NewIoReaderWriter(d.df.Path, oFile, allocated, pReporter, c.HashAlgorithm.New(), &c.Done)
 		nIo := mIo.MultiWriter()
+		hIo := io.Writer(mIo.hash)
+		if c.sourceHashes != nil && !syncTest {
+			// Chain the parts of a split file into the sum of the source file
+			if sw := c.sourceHashes.writer(c.HashAlgorithm, d.f, d.df); sw != nil {
+				nIo = io.MultiWriter(nIo, sw)
+				hIo = io.MultiWriter(hIo, sw)
+			}
+		}
 
 		ns := time.Now()
 		ft := fileTracker{io: mIo, f: d.f, df: d.df, device: device, done: make(chan bool)}
@@ -196,7 +388,21 @@ func sync2dev(c *Context, device *Device, trakc chan<- fileTracker) {
 		case <-time.After(200 * time.Second):
 			panic("Should not be here! No receive on tracker channel in 200 seconds...")
 		}
-		if !d.f.IsSplit() && !syncTest {
+		if d.f.Extents != nil && !syncTest {
+			// Only the data extents are copied, the holes stay holes on the device
+			if err := d.f.copyExtents(oFile, nIo, hIo, sFile, d.df.StartByte, d.df.EndByte); err != nil {
+				ft.closed = true
+				Log.WithFields(logrus.Fields{"filePath": d.df.Path, "fileSourceSize": d.f.Size,
+					"fileDestSize": d.df.Size, "allocated": allocated, "deviceSize": device.SizeTotal,
+				}).Error("Error copying sparse file!")
+				c.Errors <- fmt.Errorf("%s copy extents %s: %s", syncErrCtx, d.df.Path, err.Error())
+				break
+			}
+			sFile.Close()
+			if err = oFile.Close(); err == nil {
+				err = os.Chmod(d.df.Path, d.f.Mode)
+			}
+		} else if !d.f.IsSplit() && !syncTest {
 			if _, err := io.Copy(nIo, sFile); err != nil {
 				ft.closed = true
 				Log.WithFields(logrus.Fields{"filePath": d.df.Path, "fileSourceSize": d.f.Size,
@@ -235,15 +441,28 @@ func sync2dev(c *Context, device *Device, trakc chan<- fileTracker) {
 				err = oFile.Close()
 			}
 		}
+		if err == nil {
+			d.df.Sum = mIo.SumToString()
+			if !syncTest {
+				err = c.checkStable(d.f, d.df, before, device, trakc)
+			}
+		}
 		if err == nil {
 			d.df.done = true
-			d.df.Sha1Sum = mIo.Sha1SumToString()
-			Log.WithFields(logrus.Fields{"file": d.df.Path, "sha1sum": d.df.Sha1Sum}).Infoln("File sha1sum")
+			Log.WithFields(logrus.Fields{"file": d.df.Path, "sum": d.df.Sum}).Infoln("File sum")
+			if c.sourceHashes != nil {
+				c.sourceHashes.copied(d.f, d.df)
+			}
 			err = d.df.setMetaData(d.f)
+			if err == nil {
+				c.setDestXattrs(device, d.df.Path, d.f)
+				journalRecord(c, d.df)
+			}
 			// For zero length files, report zero on the sizeWritn channel. io.Copy will only
 			// create the file, but it will not report bytes written since there are none.
 			// Otherwise sends to the tracker will block causing everything to grind to a halt.
-			if d.f.Size == 0 && d.f.FileType == FILE {
+			// The same goes for a destination file that only holds holes of a sparse file.
+			if allocated == 0 && d.f.FileType == FILE {
 				mIo.sizeWritn <- 0
 			}
 		} else {
@@ -254,13 +473,47 @@ func sync2dev(c *Context, device *Device, trakc chan<- fileTracker) {
 		// Wait for the filetracker reporter to complete
 		<-ft.done
 	}
+	if device.Layout == LayoutMirror {
+		mirrorDirs(c, device)
+	}
+	if err := saveManifest(c, device); err != nil {
+		c.Errors <- err
+	}
 	Log.WithFields(logrus.Fields{"device": device.Name, "mountPoint": device.MountPoint}).Info("Sync to device complete")
 }
 
+// deviceHasChanges returns true if files need to be copied to or removed from the device, or the metadata of files on the
+// device needs to be updated.
+func (c *Context) deviceHasChanges(device *Device) bool {
+	if device.Parity {
+		// The parity of the previous sync is kept if the data devices are unchanged
+		return device.ParitySum == ""
+	}
+	if len(c.deviceOrphans(device)) > 0 {
+		return true
+	}
+	for _, d := range c.FileIndex.DeviceFiles(device) {
+		// Unchanged files and files copied by an interrupted sync are done
+		if !d.df.done {
+			return true
+		}
+	}
+	return false
+}
+
 func syncLaunch(c *Context, index int, done chan bool) {
 	Log.Debugln("Starting Sync() iteration", index)
 	d := c.Devices[index]
 
+	if !c.deviceHasChanges(d) {
+		// Nothing has changed on the device since the previous sync, there is no need to mount it
+		Log.WithFields(logrus.Fields{"device": d.Name}).Infoln("No changes for device")
+		done <- true
+		close(c.SyncProgress.Device[index].Report)
+		close(c.SyncProgress.Device[index].files)
+		return
+	}
+
 	// ENSURE DEVICE IS MOUNTED
 	// Block until a reply is sent. Discard the value because it's not important.
 	Log.Debugln("Sending SyncDeviceMount channel request to index", index)
@@ -271,7 +524,14 @@ func syncLaunch(c *Context, index int, done chan bool) {
 	go c.SyncProgress.deviceCopyReporter(index)
 
 	// Finally, starting syncing!
-	sync2dev(c, d, c.SyncProgress.Device[index].files)
+	if d.Parity {
+		syncParity(c, d, c.SyncProgress.Device[index].files)
+	} else {
+		sync2dev(c, d, c.SyncProgress.Device[index].files)
+		if err := saveSums(c, d); err != nil {
+			c.Errors <- err
+		}
+	}
 
 	done <- true
 
@@ -282,13 +542,26 @@ func syncLaunch(c *Context, index int, done chan bool) {
 }
 
 // Sync synchronizes files to mounted devices on mountpoints. Sync will copy new files, delete old files, and fix or update
-// files on the destination device that do not match the source sha1 hash. If disableContextSave is true, the context file
+// files on the destination device that do not match the source hash. If disableContextSave is true, the context file
 // will be NOT be dumped to the last devices as compressed JSON.
 func Sync(c *Context, disableContextSave bool) {
 	Log.WithFields(logrus.Fields{
 		"dataSize": c.FileIndex.TotalSize(), "poolSizePadded": c.Devices.TotalSizePadded(),
 	}).Info("Data vs Pool size")
 
+	// Files unchanged since the previous sync are complete from the start
+	for _, f := range c.FileIndex {
+		for _, df := range f.DestFiles {
+			if f.Kept && df.done {
+				journalRecord(c, df)
+			}
+		}
+	}
+
+	if c.SinglePass && c.sourceHashes == nil {
+		c.sourceHashes = newSourceHashes()
+	}
+
 	// GO GO GO
 	var streamCount uint16
 	i := 0
@@ -318,6 +591,20 @@ func Sync(c *Context, disableContextSave bool) {
 	// One final update to show full copy
 	c.SyncProgress.report(true)
 
+	if c.sourceHashes != nil {
+		// The source files were not hashed before the sync
+		c.sourceHashes.finish(c)
+	}
+
+	// Only the orphaned destination files that could not be removed are recorded for the next sync
+	orphans := c.OrphanedDestFiles
+	c.OrphanedDestFiles = nil
+	for _, df := range orphans {
+		if !df.done {
+			c.OrphanedDestFiles = append(c.OrphanedDestFiles, df)
+		}
+	}
+
 	if !disableContextSave {
 		var err error
 		c.SyncContextSize, err = saveSyncContext(c)
@@ -0,0 +1,100 @@
+package core
+
+import (
+	"encoding/hex"
+	"hash"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// sourceHash is the sum of a split source file computed from its destination files as they are copied.
+type sourceHash struct {
+	hash    hash.Hash // Nil once a destination file is copied out of order
+	next    uint64    // The StartByte of the next destination file
+	copying bool      // Set while a destination file is written to hash
+}
+
+// sourceHashes computes the sums of the source files during the copy in single-pass mode. The parts of a split file are
+// chained into the sum of the whole file if they are copied in StartByte order, one after another. Otherwise the source
+// file is hashed again once the sync is complete.
+type sourceHashes struct {
+	lock  sync.Mutex
+	files map[*File]*sourceHash
+}
+
+func newSourceHashes() *sourceHashes {
+	return &sourceHashes{files: make(map[*File]*sourceHash)}
+}
+
+// writer returns the writer used to compute the sum of f while df is copied. Nil is returned if f is not split, if df is
+// out of order, or if df is part of an extra copy.
+func (s *sourceHashes) writer(a HashAlgorithm, f *File, df *DestFile) io.Writer {
+	if !f.IsSplit() || df.Copy != 0 {
+		// The sum of the destination file is the sum of the source file, or the sum is chained from the first copy
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sh, ok := s.files[f]
+	if !ok {
+		sh = &sourceHash{hash: a.New()}
+		s.files[f] = sh
+	}
+	if sh.hash == nil || sh.copying || df.StartByte != sh.next {
+		Log.WithFields(logrus.Fields{"file": f.Path, "startByte": df.StartByte}).Debugln("Destination file out of order")
+		sh.hash = nil
+		return nil
+	}
+	sh.copying = true
+	return sh.hash
+}
+
+// copied records that df has been copied completely. If the copy fails, the chained sum of f is not used.
+func (s *sourceHashes) copied(f *File, df *DestFile) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if sh, ok := s.files[f]; ok && sh.copying && df.Copy == 0 && df.StartByte == sh.next {
+		sh.copying = false
+		sh.next = df.EndByte
+	}
+}
+
+// discard drops the chained sum of f. The source file is hashed again once the sync is complete.
+func (s *sourceHashes) discard(f *File) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if sh, ok := s.files[f]; ok {
+		sh.hash = nil
+	}
+}
+
+// finish sets the sums of the source files once the sync is complete. The sum of a file with a single destination file is
+// the sum of that file. A split file is hashed again if the chained sum is not available, like when a part was copied out
+// of order or by an interrupted sync.
+func (s *sourceHashes) finish(c *Context) {
+	for _, f := range c.FileIndex {
+		if f.FileType != FILE || f.Sum != "" || len(f.DestFiles) == 0 || !f.DestFilesDone() ||
+			strings.Contains(f.Path, fakeTestPath) {
+			continue
+		}
+		if !f.IsSplit() {
+			f.Sum = f.DestFiles[0].Sum
+			continue
+		}
+		if sh := s.files[f]; sh != nil && sh.hash != nil && !sh.copying && sh.next == f.Size {
+			f.Sum = hex.EncodeToString(sh.hash.Sum(nil))
+			continue
+		}
+		sum, err := fileSum(c.HashAlgorithm, f.Path)
+		if err != nil {
+			c.Errors <- err
+			continue
+		}
+		Log.WithFields(logrus.Fields{"file": f.Path, "sum": sum}).Infoln("Hashed split source file again")
+		f.Sum = sum
+	}
+	s.files = make(map[*File]*sourceHash)
+}
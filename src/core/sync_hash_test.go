@@ -0,0 +1,55 @@
+package core
+
+import "testing"
+
+// TestSyncSinglePass computes the sums of the source files while copying. The sum of the split file is chained from its
+// destination files.
+func TestSyncSinglePass(t *testing.T) {
+	s := &syncTest{t: t,
+		backupPath: "../../testdata/filesync_freebooks",
+		deviceList: splitDevices(t),
+		singlePass: true,
+	}
+	s.Run()
+	if t.Failed() {
+		return
+	}
+	var split int
+	for _, f := range s.ctx.FileIndex {
+		if f.FileType == FILE && f.Sum == "" {
+			t.Errorf("EXPECT: Sum of %q GOT: Empty sum", f.Path)
+		}
+		if f.IsSplit() {
+			split++
+		}
+	}
+	if split != 1 {
+		t.Errorf("EXPECT: 1 split file GOT: %d", split)
+	}
+}
+
+// TestSyncSinglePassOutOfOrder copies the parts of a split file in reverse order. The source file is hashed again after the
+// sync.
+func TestSyncSinglePassOutOfOrder(t *testing.T) {
+	s := &syncTest{t: t,
+		context: func() *Context {
+			c, err := NewContext("../../testdata/filesync_freebooks", 0, FileIndex{}, splitDevices(t)(), 0)
+			if err != nil {
+				t.Fatalf("EXPECT: No errors from NewContext() GOT: %s", err)
+			}
+			c.sourceHashes = newSourceHashes()
+			for _, f := range c.FileIndex {
+				if f.IsSplit() {
+					// The last part is copied first
+					df := f.DestFiles[len(f.DestFiles)-1]
+					if c.sourceHashes.writer(c.HashAlgorithm, f, df) != nil {
+						t.Errorf("EXPECT: No writer for the out of order destination file %q", df.Path)
+					}
+				}
+			}
+			return c
+		},
+		singlePass: true,
+	}
+	s.Run()
+}
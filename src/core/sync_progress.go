@@ -130,7 +130,7 @@ outer:
 			s.Device[index].Report <- SyncDeviceProgress{
 				FileName:             ft.f.Name,
 				FilePath:             ft.df.Path,
-				FileSize:             ft.df.Size,
+				FileSize:             ft.io.sizeTotal,
 				FileSizeWritn:        bw,
 				FileTotalSizeWritn:   ft.io.sizeWritnTotal,
 				FileBytesPerSecond:   fbps.Calc(),
@@ -138,7 +138,7 @@ outer:
 				DeviceTotalSizeWritn: dev.SizeWritn,
 				DeviceBytesPerSecond: dt.bps.Calc(),
 			}
-			if size == ft.df.Size {
+			if size == ft.io.sizeTotal {
 				Log.WithFields(logrus.Fields{
 					"bw":                   bw,
 					"destPath":             ft.f.Path,
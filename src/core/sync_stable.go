@@ -0,0 +1,156 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// DefaultUnstableRetries is the number of times a source file that changed while it was copied is copied again before
+// it is flagged as unstable.
+const DefaultUnstableRetries = 2
+
+var (
+	// The time to wait before copying a changed source file again. Gives the program modifying the file a chance to
+	// finish. Used for testing.
+	unstableRetryWait = time.Second
+)
+
+// SyncUnstableFileError is given when a source file changed every time it was copied, or changed after the file index
+// was built. The destination files of the source file might not match the sum of the source file or each other. The
+// file is flagged as unstable in the sync context.
+type SyncUnstableFileError struct {
+	FilePath string
+	Attempts int
+	Reason   string
+}
+
+// Error implements the Error interface.
+func (e SyncUnstableFileError) Error() string {
+	return fmt.Sprintf("Source file %q changed while it was copied (%d attempts): %s", e.FilePath, e.Attempts, e.Reason)
+}
+
+// sourceState is the size and modification time of a source file at a point in time.
+type sourceState struct {
+	size    uint64
+	modTime time.Time
+}
+
+func statSource(p string) (s sourceState, err error) {
+	fi, err := os.Lstat(p)
+	if err == nil {
+		s = sourceState{uint64(fi.Size()), fi.ModTime()}
+	}
+	return
+}
+
+// sourceChanged returns the reason the copy of df is not consistent with the source file f, or an empty string if the
+// copy is good. The source file must be the same before and after the copy and match the file index. The sum of the
+// copied bytes is compared to the sum of the hashing phase if the file is not split. Only a file that changed during
+// the copy is worth copying again, retry is false if the file was stable during the copy but changed before it.
+func sourceChanged(f *File, df *DestFile, before, after sourceState, sum string) (reason string, retry bool) {
+	if before.size != after.size || !before.modTime.Equal(after.modTime) {
+		return "size or modification time changed during the copy", true
+	}
+	if after.size != f.Size || !after.modTime.Equal(f.ModTime) {
+		return "size or modification time does not match the file index", false
+	}
+	if !f.IsSplit() && f.Sum != "" && sum != f.Sum {
+		return fmt.Sprintf("sum of the copied bytes %s does not match the source sum %s", sum, f.Sum), false
+	}
+	return "", false
+}
+
+// recopy copies the bytes of the destination file df from the source file f to the device again. The progress of the
+// copy is reported on trakc. The sum of the copied bytes is returned with the state of the source file before and after
+// the copy. The holes of a sparse file are copied as zeros, the data extents recorded when the file was found might not
+// match the changed file.
+func recopy(c *Context, f *File, df *DestFile, device *Device, trakc chan<- fileTracker) (sum string, before,
+	after sourceState, err error) {
+	if before, err = statSource(f.Path); err != nil {
+		return
+	}
+	sFile, err := os.Open(f.Path)
+	if err != nil {
+		return
+	}
+	defer sFile.Close()
+	oFile, err := os.OpenFile(df.Path, os.O_RDWR|os.O_TRUNC, f.Mode)
+	if err != nil {
+		return
+	}
+	defer oFile.Close()
+	if _, err = sFile.Seek(int64(df.StartByte), 0); err != nil {
+		return
+	}
+	pReporter := make(chan uint64, 100)
+	mIo := NewIoReaderWriter(df.Path, oFile, df.Size, pReporter, c.HashAlgorithm.New(), &c.Done)
+	ft := fileTracker{io: mIo, f: f, df: df, device: device, done: make(chan bool)}
+	trakc <- ft
+	if _, err = io.CopyN(mIo.MultiWriter(), sFile, int64(df.Size)); err != nil && err != io.EOF {
+		ft.closed = true
+		return
+	}
+	// A source file that became shorter is caught by the size check. The bytes that were not copied are reported so
+	// the file tracker completes.
+	if mIo.sizeWritnTotal < df.Size || df.Size == 0 {
+		mIo.sizeWritn <- mIo.sizeWritnFromLastReport + df.Size - mIo.sizeWritnTotal
+	}
+	<-ft.done
+	if err = oFile.Close(); err != nil {
+		return
+	}
+	after, err = statSource(f.Path)
+	sum = mIo.SumToString()
+	return
+}
+
+// checkStable compares the copy of the destination file df on device with the source file f. The state of the source
+// file before the copy is before. If the source file changed during the copy, df is copied again up to UnstableRetries
+// times, the progress is reported on trakc. A file that was stable during the copy but does not match the file index or
+// the source sum is not copied again, no copy can match. The sum of the last copy is set on df. If no copy was
+// consistent, f is flagged as unstable and SyncUnstableFileError is sent on the error channel. An error is returned
+// only if the destination file could not be written.
+func (c *Context) checkStable(f *File, df *DestFile, before sourceState, device *Device,
+	trakc chan<- fileTracker) error {
+	after, err := statSource(f.Path)
+	if err != nil {
+		return err
+	}
+	reason, retry := sourceChanged(f, df, before, after, df.Sum)
+	attempts := 1
+	for ; retry && attempts <= c.UnstableRetries; attempts++ {
+		Log.WithFields(logrus.Fields{"file": f.Path, "destPath": df.Path, "reason": reason,
+			"attempt": attempts}).Warnln("Source file changed while copying, copying again")
+		if c.sourceHashes != nil {
+			// The chained sum contains the bytes of the inconsistent copy
+			c.sourceHashes.discard(f)
+		}
+		time.Sleep(unstableRetryWait)
+		var sum string
+		if sum, before, after, err = recopy(c, f, df, device, trakc); err != nil {
+			return err
+		}
+		df.Sum = sum
+		reason, retry = sourceChanged(f, df, before, after, sum)
+	}
+	if reason != "" {
+		f.Unstable = true
+		c.Errors <- SyncUnstableFileError{f.Path, attempts, reason}
+	}
+	return nil
+}
+
+// UnstableFiles returns the files that changed every time they were copied.
+func (c *Context) UnstableFiles() []*File {
+	var files []*File
+	for _, f := range c.FileIndex {
+		if f.Unstable {
+			files = append(files, f)
+		}
+	}
+	return files
+}
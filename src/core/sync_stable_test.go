@@ -0,0 +1,157 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestSyncUnstableFile changes the modification time of the split source file after the file index is built. The file
+// is stable during the copy but inconsistent with the file index, so it is flagged as unstable without copying it
+// again.
+func TestSyncUnstableFile(t *testing.T) {
+	unstableRetryWait = 0
+	defer func() { unstableRetryWait = time.Second }()
+	src := NewMountPoint(t, testTempDir, "source-")
+	if out, err := exec.Command("cp", "-a", "../../testdata/filesync_freebooks/.", src).CombinedOutput(); err != nil {
+		t.Fatalf("EXPECT: No errors from cp GOT: %s (%s)", err, out)
+	}
+	var changed *File
+	s := &syncTest{t: t,
+		context: func() *Context {
+			c, err := NewContext(src, 0, FileIndex{}, splitDevices(t)(), 0)
+			if err != nil {
+				t.Fatalf("EXPECT: No errors from NewContext() GOT: %s", err)
+			}
+			c.UnstableRetries = 1
+			for _, f := range c.FileIndex {
+				if f.IsSplit() {
+					changed = f
+				}
+			}
+			if changed == nil {
+				t.Fatal("EXPECT: A split file GOT: None")
+			}
+			mt := changed.ModTime.Add(time.Hour)
+			if err := os.Chtimes(changed.Path, mt, mt); err != nil {
+				t.Fatal(err)
+			}
+			return c
+		},
+		expectErrors: func() []error {
+			return []error{SyncUnstableFileError{}}
+		},
+	}
+	s.Run()
+	if t.Failed() {
+		return
+	}
+	u := s.ctx.UnstableFiles()
+	if len(u) != 1 || u[0] != changed {
+		t.Fatalf("EXPECT: %q flagged as unstable GOT: %d unstable files", changed.Path, len(u))
+	}
+	for _, df := range changed.DestFiles {
+		if !df.done {
+			t.Errorf("EXPECT: Destination file %q done GOT: Not done", df.Path)
+		}
+	}
+	for _, e := range s.errors {
+		if ue, ok := e.(SyncUnstableFileError); ok && ue.Attempts != 1 {
+			t.Errorf("EXPECT: 1 attempt GOT: %d", ue.Attempts)
+		}
+	}
+}
+
+// TestSourceChanged checks the comparison of a copy with the source file.
+func TestSourceChanged(t *testing.T) {
+	mt := time.Now()
+	f := &File{Size: 10, ModTime: mt, Sum: "abc", DestFiles: []*DestFile{&DestFile{}}}
+	state := sourceState{10, mt}
+	tests := []struct {
+		before, after sourceState
+		sum           string
+		expect        bool
+		expectRetry   bool
+	}{
+		{state, state, "abc", false, false},
+		{state, state, "def", true, false},
+		{state, sourceState{11, mt}, "abc", true, true},
+		{sourceState{10, mt.Add(time.Second)}, state, "abc", true, true},
+		{sourceState{10, mt.Add(time.Second)}, sourceState{10, mt.Add(time.Second)}, "abc", true, false},
+	}
+	for x, test := range tests {
+		r, retry := sourceChanged(f, f.DestFiles[0], test.before, test.after, test.sum)
+		if (r != "") != test.expect {
+			t.Errorf("Test %d: EXPECT: Changed %t GOT: %q", x, test.expect, r)
+		}
+		if retry != test.expectRetry {
+			t.Errorf("Test %d: EXPECT: Retry %t GOT: %t", x, test.expectRetry, retry)
+		}
+	}
+}
+
+// TestCheckStableRetry gives checkStable a source state that differs from the state after the copy, as if the source
+// file changed during the copy. The file is copied again with the progress reported on the tracker channel.
+func TestCheckStableRetry(t *testing.T) {
+	unstableRetryWait = 0
+	defer func() { unstableRetryWait = time.Second }()
+	dir := NewMountPoint(t, testTempDir, "stable-")
+	src := filepath.Join(dir, "source")
+	data := []byte("The quick brown fox jumps over the lazy dog")
+	if err := ioutil.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Lstat(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum, err := fileSum(HashSHA1, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &File{Name: "source", Path: src, Size: uint64(len(data)), ModTime: fi.ModTime(), Mode: 0644, Sum: sum}
+	df := &DestFile{Path: filepath.Join(dir, "dest"), Size: f.Size, EndByte: f.Size}
+	f.DestFiles = []*DestFile{df}
+	if err := ioutil.WriteFile(df.Path, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := &Context{HashAlgorithm: HashSHA1, UnstableRetries: DefaultUnstableRetries, Errors: make(chan error, 10),
+		Done: make(chan bool)}
+	trakc := make(chan fileTracker)
+	var reported, copies uint64
+	go func() {
+		for ft := range trakc {
+			copies++
+			for size := uint64(0); size < ft.io.sizeTotal; {
+				bw := <-ft.io.sizeWritn
+				size += bw
+				reported += bw
+			}
+			ft.done <- true
+		}
+	}()
+	before := sourceState{f.Size, f.ModTime.Add(-time.Hour)}
+	if err := c.checkStable(f, df, before, &Device{}, trakc); err != nil {
+		t.Fatalf("EXPECT: No errors from checkStable() GOT: %s", err)
+	}
+	close(trakc)
+	close(c.Errors)
+	for err := range c.Errors {
+		t.Errorf("EXPECT: No errors GOT: %s", err)
+	}
+	if f.Unstable {
+		t.Errorf("EXPECT: %q stable GOT: Unstable", f.Path)
+	}
+	if df.Sum != sum {
+		t.Errorf("EXPECT: Destination sum %s GOT: %s", sum, df.Sum)
+	}
+	if copies != 1 || reported != f.Size {
+		t.Errorf("EXPECT: 1 copy of %d bytes reported GOT: %d copies of %d bytes", f.Size, copies, reported)
+	}
+	if b, err := ioutil.ReadFile(df.Path); err != nil || string(b) != string(data) {
+		t.Errorf("EXPECT: Destination file %q GOT: %q (%v)", data, b, err)
+	}
+}
@@ -1,9 +1,9 @@
 package core
 
 import (
-	"crypto/sha1"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -11,6 +11,7 @@ import (
 	"path"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
 	"syscall"
 	"testing"
@@ -42,6 +43,13 @@ type syncTest struct {
 	fileIndex         func() FileIndex
 	deviceList        func() DeviceList
 	saveSyncContext   bool
+	previous          *Context        // If set, only files changed since the previous sync context are synced
+	context           func() *Context // If set, the returned context is synced instead of a new context
+	journal           string          // If set, the progress of the sync is recorded in the journal at this path
+	singlePass        bool            // If set, the source files are hashed by the sync instead of before the sync
+	dedup             bool            // If set, files with the same content are stored once
+	dedupSaved        uint64          // The number of bytes saved by the deduplication
+	beforeMount       func(x int)     // If set, called when the device with the index x is requested to be mounted
 
 	errors       []error // These are checked
 	errChan      *chan error
@@ -95,7 +103,7 @@ func (s *syncTest) checkPerms(f *File) {
 		if fi.Mode() != f.Mode {
 			s.t.Errorf("File: %q\n\t Got Mode: %q Expect: %q\n", f.Name, fi.Mode(), f.Mode)
 		}
-		if fi.ModTime() != f.ModTime {
+		if !fi.ModTime().Equal(f.ModTime) {
 			s.t.Errorf("File: %q\n\t Got ModTime: %q Expect: %q\n", f.Name, fi.ModTime(), f.ModTime)
 		}
 		if int(fi.Sys().(*syscall.Stat_t).Uid) != f.Owner {
@@ -125,64 +133,69 @@ func (s *syncTest) checkDestSize(f *File) {
 	}
 }
 
-// checkSha1Sum will check the sha1 sums of all the destination files
-func (s *syncTest) checkSha1Sum(f *File) {
-	// Check sha1sum for source file
-	eSum, err := sha1sum(f.Path)
+// checkSum will check the sums of all the destination files
+func (s *syncTest) checkSum(f *File) {
+	// Check sum for source file
+	eSum, err := fileSum(s.ctx.HashAlgorithm, f.Path)
 	if err != nil {
-		s.t.Errorf("Error: No errors from CalcSha1Sum()\n\t Got Sha1Sum: %s", err)
+		s.t.Errorf("Error: No errors from fileSum()\n\t Got Sum: %s", err)
 		return
 	}
-	if eSum != f.Sha1Sum {
-		s.t.Errorf("Error: File: %q\n\t  Expect Sha1Sum: %q\n\t  Got Sha1Sum: %q", f.Name, eSum, f.Sha1Sum)
+	if eSum != f.Sum {
+		s.t.Errorf("Error: File: %q\n\t  Expect Sum: %q\n\t  Got Sum: %q", f.Name, eSum, f.Sum)
 	}
-	Log.Debugf("%s sha1sum %q, got f.sha1sum: %q", f.Name, eSum, f.Sha1Sum)
+	Log.Debugf("%s sum %q, got f.sum: %q", f.Name, eSum, f.Sum)
 
-	// Check sha1sum for each dest file
+	// Check sum for each dest file
 	for _, df := range f.DestFiles {
-		sum, err := sha1sum(df.Path)
+		sum, err := fileSum(s.ctx.HashAlgorithm, df.Path)
 		if err != nil {
 			s.t.Error(err)
 			continue
 		}
-		if df.Sha1Sum != sum {
-			s.t.Errorf("Error: DestFile: %q\n\t  Expect Sha1Sum: %q\n\t  Got Sha1Sum: %q",
-				df.Path, df.Sha1Sum, sum)
+		if df.Sum != sum {
+			s.t.Errorf("Error: DestFile: %q\n\t  Expect Sum: %q\n\t  Got Sum: %q",
+				df.Path, df.Sum, sum)
 		}
 	}
 
-	// Sha1 sum of source file should not be similar to sha1 sum of dest files if the file is split
-	if len(f.DestFiles) > 1 {
-		for _, df := range f.DestFiles {
-			if f.Sha1Sum == df.Sha1Sum {
-				s.t.Errorf("Error: Source file %q and dest file have same sha1 sum!", f.Name)
+	// Sum of source file should not be similar to sum of dest files if the file is split
+	for n := 0; n < f.Copies(); n++ {
+		if dfs := f.CopyDestFiles(n); len(dfs) > 1 {
+			for _, df := range dfs {
+				if f.Sum == df.Sum {
+					s.t.Errorf("Error: Source file %q and dest file have same sum!", f.Name)
+				}
 			}
 		}
 	}
 }
 
-// checkSplitFile will check the sha1sum of a file that has been split across devices.
-func (s *syncTest) checkMergedSplitFileSha1Sum(f *File) {
-	ss := sha1.New()
-	for _, df := range f.DestFiles {
-		pf, err := os.Open(df.Path)
-		if err != nil {
-			s.t.Fatal(err)
-		}
-		if _, err := io.Copy(ss, pf); err != nil {
-			s.t.Fatal(err)
-		}
-	}
-	cSum := hex.EncodeToString(ss.Sum(nil))
-	eSum, err := sha1sum(f.Path)
+// checkMergedSplitFileSum will check the sum of each copy of a file that has been split across devices.
+func (s *syncTest) checkMergedSplitFileSum(f *File) {
+	eSum, err := fileSum(s.ctx.HashAlgorithm, f.Path)
 	if err != nil {
-		s.t.Errorf("Error: No errors from CalcSha1Sum()\n\t Got Sha1Sum: %s", err)
+		s.t.Errorf("Error: No errors from fileSum()\n\t Got Sum: %s", err)
 		return
 	}
-	if eSum != cSum {
-		s.t.Errorf("EXPECT: sha1: %q\n\t GOT: %q", eSum, cSum)
+	for n := 0; n < f.Copies(); n++ {
+		ss := s.ctx.HashAlgorithm.New()
+		for _, df := range f.CopyDestFiles(n) {
+			pf, err := os.Open(df.Path)
+			if err != nil {
+				s.t.Fatal(err)
+			}
+			if _, err := io.Copy(ss, pf); err != nil {
+				s.t.Fatal(err)
+			}
+			pf.Close()
+		}
+		cSum := hex.EncodeToString(ss.Sum(nil))
+		if eSum != cSum {
+			s.t.Errorf("EXPECT: sum: %q\n\t GOT: %q", eSum, cSum)
+		}
+		Log.Infof("sum %q matched for split file copy %q", cSum, f.Name)
 	}
-	Log.Infof("sha1 %q matched for split file copy %q", cSum, f.Name)
 
 	s.checkSplitSizes(f)
 }
@@ -196,16 +209,25 @@ func (s *syncTest) checkSplitSizes(f *File) {
 	}
 }
 
+// usedSize returns the bytes a file takes up on a device. The holes of a sparse file are not counted.
+func usedSize(i os.FileInfo) uint64 {
+	if b := uint64(i.Sys().(*syscall.Stat_t).Blocks) * 512; b < uint64(i.Size()) {
+		return b
+	}
+	return uint64(i.Size())
+}
+
 // checkMountPointSizes calculates the sizes of the mountpoints for each device on disk and checks against expected values.
 func (s *syncTest) checkMountPointSizes() {
 	check := func(path string) uint64 {
 		var byts uint64
 		walkFunc := func(p string, i os.FileInfo, err error) error {
-			if p == path {
+			if p == path || i.IsDir() {
+				// Directories are created by the mirror layout
 				return nil
 			}
 			Log.Debugf("checkMountPointSizes: Got size bytes %d for %q", i.Size(), p)
-			byts += uint64(i.Size())
+			byts += usedSize(i)
 			return nil
 		}
 		err := filepath.Walk(path, walkFunc)
@@ -220,16 +242,16 @@ func (s *syncTest) checkMountPointSizes() {
 			s.t.Errorf("Mountpoint %q usage (%d bytes) is greater than device size (%d bytes)",
 				dev.MountPoint, ms, dev.SizeTotal)
 		}
-		if uint64(ms) != dev.SizeWritn {
+		if uint64(ms) != dev.SizeWritn+dev.SizeUsed+dev.sizeMetadata() {
 			var sCalc uint64
 			if s.ctx.SyncContextSize != 0 && dev.Name == s.ctx.Devices[len(s.ctx.Devices)-1].Name {
-				if uint64(ms) != (dev.SizeWritn + s.ctx.SyncContextSize) {
-					sCalc = dev.SizeWritn + s.ctx.SyncContextSize
+				if uint64(ms) != (dev.SizeWritn + dev.SizeUsed + dev.sizeMetadata() + s.ctx.SyncContextSize) {
+					sCalc = dev.SizeWritn + dev.SizeUsed + dev.sizeMetadata() + s.ctx.SyncContextSize
 				} else {
 					continue
 				}
 			} else {
-				sCalc = dev.SizeWritn
+				sCalc = dev.SizeWritn + dev.SizeUsed + dev.sizeMetadata()
 			}
 			s.t.Errorf("MountPoint: %q\n\t  Got Size: %d dev.SizeWritn: %d\n", dev.MountPoint, ms, sCalc)
 		}
@@ -246,6 +268,9 @@ func (s *syncTest) progressDump() {
 			for {
 				select {
 				case <-s.ctx.SyncDeviceMount[index]:
+					if s.beforeMount != nil {
+						s.beforeMount(index)
+					}
 					s.ctx.SyncDeviceMount[index] <- true
 				case <-s.ctx.SyncProgress.Device[index].Report:
 				case <-s.ctx.SyncProgress.Report:
@@ -269,6 +294,21 @@ func (s *syncTest) errorCollector() {
 	}()
 }
 
+// loadSyncContext loads the newest sync context saved to the last device of the sync test.
+func (s *syncTest) loadSyncContext() *Context {
+	last := s.ctx.Devices[len(s.ctx.Devices)-1]
+	m, err := filepath.Glob(filepath.Join(last.MountPoint, "sync_context_*.json.gz"))
+	if err != nil || len(m) == 0 {
+		s.t.Fatalf("EXPECT: Sync context on %q GOT: %d (%v)", last.MountPoint, len(m), err)
+	}
+	sort.Strings(m)
+	c, err := SyncContextFromPath(m[len(m)-1])
+	if err != nil {
+		s.t.Fatalf("EXPECT: No errors from SyncContextFromPath() GOT: %s", err)
+	}
+	return c
+}
+
 func (s *syncTest) printMountPoints() {
 	for _, d := range s.ctx.Devices {
 		Log.WithFields(logrus.Fields{"deviceName": d.Name, "mountPoint": d.MountPoint}).Print("Test mountpoint")
@@ -286,7 +326,7 @@ func (s *syncTest) prepareFileIndex() (FileIndex, DeviceList) {
 	return files, devs
 }
 
-func (s *syncTest) calcSha1Sum(files FileIndex) {
+func (s *syncTest) calcSums(a HashAlgorithm, files FileIndex) {
 	for _, f := range files {
 		if strings.Contains(f.Path, fakeTestPath) {
 			continue
@@ -294,28 +334,62 @@ func (s *syncTest) calcSha1Sum(files FileIndex) {
 		if f.FileType != FILE {
 			continue
 		}
-		eSum, err := sha1sum(f.Path)
+		eSum, err := fileSum(a, f.Path)
 		if err != nil {
 			*s.errChan <- err
 		}
-		f.Sha1Sum = eSum
+		f.Sum = eSum
 	}
 }
 
 // run intiates the test sync
 func (s *syncTest) run() {
-	fi, dl := s.prepareFileIndex()
-
-	c, err := NewContext(s.backupPath, s.outputStreams, fi, dl, s.paddingPercentage)
-	if err != nil {
-		s.errors = append(s.errors, err)
-		return
+	var c *Context
+	if s.context != nil {
+		c = s.context()
+	} else {
+		fi, dl := s.prepareFileIndex()
+		var err error
+		c, err = NewContext(s.backupPath, s.outputStreams, fi, dl, s.paddingPercentage)
+		if err != nil {
+			s.errors = append(s.errors, err)
+			return
+		}
 	}
 	s.ctx = c
 
+	if s.journal != "" {
+		j, err := NewJournal(s.journal)
+		if err != nil {
+			s.t.Fatalf("EXPECT: No errors from NewJournal() GOT: %s", err)
+		}
+		defer j.Close()
+		c.Journal = j
+	}
+
+	if s.previous != nil {
+		if err := c.Incremental(s.previous); err != nil {
+			s.errors = append(s.errors, err)
+			return
+		}
+	}
+
 	s.errorCollector()
 
-	s.calcSha1Sum(c.FileIndex)
+	if s.singlePass {
+		c.SinglePass = true
+	} else {
+		s.calcSums(c.HashAlgorithm, c.FileIndex)
+	}
+
+	if s.dedup {
+		c.Dedup = true
+		saved, err := c.DedupFiles()
+		if err != nil {
+			s.t.Fatalf("EXPECT: No errors from DedupFiles() GOT: %s", err)
+		}
+		s.dedupSaved = saved
+	}
 
 	if s.dumpFileIndex {
 		spd.Dump(c.FileIndex)
@@ -345,17 +419,18 @@ func (s *syncTest) Run() {
 	}
 	// Check the work for each file
 	for _, file := range s.ctx.FileIndex {
-		if file.FileType == DIRECTORY || file.FileType == SYMLINK || file.Owner != os.Getuid() {
+		if file.FileType == DIRECTORY || file.FileType == SYMLINK || file.FileType == HARDLINK ||
+			file.FileType == DUPLICATE || file.Owner != os.Getuid() {
 			continue
 		}
 		s.checkPerms(file)
 		if s.t.Failed() {
 			continue
 		}
-		// Check sha1 of dest files
-		s.checkSha1Sum(file)
-		if len(file.DestFiles) > 1 {
-			s.checkMergedSplitFileSha1Sum(file)
+		// Check sums of dest files
+		s.checkSum(file)
+		if file.IsSplit() {
+			s.checkMergedSplitFileSum(file)
 		}
 		s.checkDestSize(file)
 	}
@@ -886,7 +961,7 @@ func TestSyncDirsWithLotsOfFiles(t *testing.T) {
 			return DeviceList{
 				&Device{
 					Name:       "Test Device 0",
-					SizeTotal:  4300000,
+					SizeTotal:  4600000, // Includes the space for the manifest and SHA1SUMS files
 					MountPoint: NewMountPoint(t, testTempDir, "mountpoint-0-"),
 				},
 			}
@@ -1035,3 +1110,414 @@ func TestSyncFromTempDirectory(t *testing.T) {
 	}
 	f.Run()
 }
+
+// placementContext returns a context for backupPath with the files cataloged again using the placement strategy p.
+func placementContext(t *testing.T, backupPath string, devices func() DeviceList, p Placement) func() *Context {
+	return catalogContext(t, backupPath, devices, func(c *Context) { c.Placement = p })
+}
+
+// copiesContext returns a context for backupPath with the files cataloged again to store n copies of each file.
+func copiesContext(t *testing.T, backupPath string, devices func() DeviceList, n int) func() *Context {
+	return catalogContext(t, backupPath, devices, func(c *Context) { c.Copies = n })
+}
+
+// catalogContext returns a context for backupPath with the files cataloged again after the context is changed with set.
+func catalogContext(t *testing.T, backupPath string, devices func() DeviceList, set func(c *Context)) func() *Context {
+	return func() *Context {
+		c, err := NewContext(backupPath, 0, FileIndex{}, devices(), 0)
+		if err != nil {
+			t.Fatalf("EXPECT: No errors from NewContext() GOT: %s", err)
+		}
+		set(c)
+		for _, f := range c.FileIndex {
+			f.DestFiles = nil
+		}
+		if err := c.catalog(); err != nil {
+			t.Fatalf("EXPECT: No errors from catalog() GOT: %s", err)
+		}
+		return c
+	}
+}
+
+// TestSyncFirstFitDecreasing places the large file on the second device and the small file on the first device. With the
+// sequential placement the large file would be split.
+func TestSyncFirstFitDecreasing(t *testing.T) {
+	devices := func() DeviceList {
+		return DeviceList{
+			&Device{
+				Name:       "Test Device 0",
+				SizeTotal:  700000,
+				MountPoint: NewMountPoint(t, testTempDir, "mountpoint-0-"),
+			},
+			&Device{
+				Name:       "Test Device 1",
+				SizeTotal:  1900000,
+				MountPoint: NewMountPoint(t, testTempDir, "mountpoint-1-"),
+			},
+		}
+	}
+	f := &syncTest{t: t,
+		context: placementContext(t, "../../testdata/filesync_freebooks", devices, PlacementFirstFitDecreasing),
+	}
+	f.Run()
+	if n := len(f.ctx.FileIndex.SplitFiles()); n != 0 {
+		t.Errorf("EXPECT: No split files GOT: %d", n)
+	}
+}
+
+// TestCatalogPlacement checks the destination files chosen by each placement strategy.
+func TestCatalogPlacement(t *testing.T) {
+	tests := []struct {
+		name         string
+		placement    Placement
+		devices      []uint64
+		files        []uint64
+		paths        []string // The paths of the files relative to the backup path, "file-<index>" if not set
+		rules        []PlacementRule
+		copies       int
+		expectSplit  int
+		expectDevs   map[string][]string // The devices of the destination files of each file, by path
+		expectSpread []string
+		expectErr    error
+	}{
+		{
+			name:        "sequential",
+			placement:   PlacementSequential,
+			devices:     []uint64{100, 100},
+			files:       []uint64{60, 60, 40, 40},
+			expectSplit: 1,
+			expectDevs: map[string][]string{
+				"file-0": {"Device 0"}, "file-1": {"Device 0", "Device 1"},
+				"file-2": {"Device 1"}, "file-3": {"Device 1"},
+			},
+		},
+		{
+			name:      "first fit decreasing",
+			placement: PlacementFirstFitDecreasing,
+			devices:   []uint64{100, 100},
+			files:     []uint64{40, 60, 40, 60},
+			expectDevs: map[string][]string{
+				"file-0": {"Device 0"}, "file-1": {"Device 0"},
+				"file-2": {"Device 1"}, "file-3": {"Device 1"},
+			},
+		},
+		{
+			name:        "first fit decreasing split",
+			placement:   PlacementFirstFitDecreasing,
+			devices:     []uint64{100, 50, 80},
+			files:       []uint64{30, 150},
+			expectSplit: 1,
+			expectDevs: map[string][]string{
+				"file-0": {"Device 1"}, "file-1": {"Device 0", "Device 2"},
+			},
+		},
+		{
+			name:      "directory",
+			placement: PlacementDirectory,
+			devices:   []uint64{100, 100},
+			files:     []uint64{30, 30, 50, 20, 40},
+			paths:     []string{"a/1", "a/2", "b/1", "b/2", "c/1"},
+			expectDevs: map[string][]string{
+				"a/1": {"Device 1"}, "a/2": {"Device 1"},
+				"b/1": {"Device 0"}, "b/2": {"Device 0"},
+				"c/1": {"Device 1"},
+			},
+		},
+		{
+			name:      "directory spread",
+			placement: PlacementDirectory,
+			devices:   []uint64{100, 100},
+			files:     []uint64{60, 60, 10, 30},
+			paths:     []string{"a/1", "a/2", "a/b/1", "c/1"},
+			expectDevs: map[string][]string{
+				"a/1": {"Device 0"}, "a/2": {"Device 1"}, "a/b/1": {"Device 0"},
+				"c/1": {"Device 0"},
+			},
+			expectSpread: []string{"a"},
+		},
+		{
+			name:      "sequential with rule",
+			placement: PlacementSequential,
+			devices:   []uint64{100, 100},
+			files:     []uint64{60, 30, 40},
+			paths:     []string{"a/1", "raw/1", "a/2"},
+			rules:     []PlacementRule{{Match: "raw/**", Device: "Device 1"}},
+			expectDevs: map[string][]string{
+				"a/1": {"Device 0"}, "raw/1": {"Device 1"}, "a/2": {"Device 0"},
+			},
+		},
+		{
+			name:      "first fit decreasing with excluded device",
+			placement: PlacementFirstFitDecreasing,
+			devices:   []uint64{100, 100},
+			files:     []uint64{50, 50, 80},
+			paths:     []string{"docs/1", "docs/2", "c"},
+			rules:     []PlacementRule{{Match: "docs/**", ExcludeDevices: []string{"Device 0"}}},
+			expectDevs: map[string][]string{
+				"docs/1": {"Device 1"}, "docs/2": {"Device 1"}, "c": {"Device 0"},
+			},
+		},
+		{
+			name:      "first matching rule",
+			placement: PlacementDirectory,
+			devices:   []uint64{100, 100, 100},
+			files:     []uint64{10, 10},
+			paths:     []string{"raw/1.mov", "raw/2.jpg"},
+			rules: []PlacementRule{
+				{Match: "raw/*.mov", Device: "Device 2"},
+				{Match: "raw/**", Device: "Device 1"},
+			},
+			expectDevs: map[string][]string{
+				"raw/1.mov": {"Device 2"}, "raw/2.jpg": {"Device 1"},
+			},
+		},
+		{
+			name:      "rule exceeded",
+			placement: PlacementSequential,
+			devices:   []uint64{100, 100},
+			files:     []uint64{80, 80},
+			paths:     []string{"raw/1", "raw/2"},
+			rules:     []PlacementRule{{Match: "raw/**", Device: "Device 0"}},
+			expectErr: PlacementRuleSizeExceeded{},
+		},
+		{
+			name:        "sequential with copies",
+			placement:   PlacementSequential,
+			devices:     []uint64{100, 100, 100},
+			files:       []uint64{60, 60},
+			copies:      2,
+			expectSplit: 1,
+			expectDevs: map[string][]string{
+				"file-0": {"Device 0", "Device 1"}, "file-1": {"Device 0", "Device 1", "Device 2"},
+			},
+		},
+		{
+			name:      "first fit decreasing with rule copies",
+			placement: PlacementFirstFitDecreasing,
+			devices:   []uint64{100, 100, 100},
+			files:     []uint64{50, 30},
+			paths:     []string{"docs/1", "b"},
+			rules:     []PlacementRule{{Match: "docs/**", Copies: 3}},
+			expectDevs: map[string][]string{
+				"docs/1": {"Device 0", "Device 1", "Device 2"}, "b": {"Device 0"},
+			},
+		},
+		{
+			name:      "copies exceeded",
+			placement: PlacementSequential,
+			devices:   []uint64{100, 100},
+			files:     []uint64{80, 80},
+			copies:    2,
+			expectErr: CopyPlacementError{},
+		},
+		{
+			name:      "first fit decreasing pool exceeded",
+			placement: PlacementFirstFitDecreasing,
+			devices:   []uint64{100},
+			files:     []uint64{60, 60},
+			expectErr: DevicePoolSizeExceeded{},
+		},
+	}
+	for _, test := range tests {
+		c := &Context{BackupPath: fakeTestPath, Placement: test.placement, PlacementRules: test.rules, Copies: test.copies}
+		for x, size := range test.devices {
+			c.Devices.Add(&Device{Name: fmt.Sprintf("Device %d", x), SizeTotal: size, MountPoint: fakeTestPath})
+		}
+		for x, size := range test.files {
+			p := fmt.Sprintf("file-%d", x)
+			if test.paths != nil {
+				p = test.paths[x]
+			}
+			c.FileIndex.Add(&File{Name: path.Base(p), Path: path.Join(fakeTestPath, p), Size: size})
+		}
+		err := c.catalog()
+		if reflect.TypeOf(err) != reflect.TypeOf(test.expectErr) {
+			t.Errorf("%s: EXPECT: Error %#v GOT: %#v", test.name, test.expectErr, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if n := len(c.FileIndex.SplitFiles()); n != test.expectSplit {
+			t.Errorf("%s: EXPECT: %d split files GOT: %d", test.name, test.expectSplit, n)
+		}
+		if !reflect.DeepEqual(c.SpreadDirectories, test.expectSpread) {
+			t.Errorf("%s: EXPECT: Spread directories %q GOT: %q", test.name, test.expectSpread, c.SpreadDirectories)
+		}
+		for _, f := range c.FileIndex {
+			rel := strings.TrimPrefix(f.Path, fakeTestPath)
+			var devs []string
+			var size uint64
+			for _, df := range f.DestFiles {
+				devs = append(devs, df.DeviceName)
+				size += df.Size
+			}
+			if !reflect.DeepEqual(devs, test.expectDevs[rel]) {
+				t.Errorf("%s: EXPECT: %q on %q GOT: %q", test.name, rel, test.expectDevs[rel], devs)
+			}
+			r, _ := c.placementRule(f)
+			if n := c.fileCopies(r); f.Copies() != n || size != f.Size*uint64(n) {
+				t.Errorf("%s: EXPECT: %d copies of %d bytes of %q placed GOT: %d copies %d bytes", test.name, n,
+					f.Size, rel, f.Copies(), size)
+			}
+		}
+	}
+}
+
+// TestSyncDirectoryPlacement keeps the files of each directory on one device.
+func TestSyncDirectoryPlacement(t *testing.T) {
+	devices := func() DeviceList {
+		return DeviceList{
+			&Device{
+				Name:       "Test Device 0",
+				SizeTotal:  700000,
+				MountPoint: NewMountPoint(t, testTempDir, "mountpoint-0-"),
+			},
+			&Device{
+				Name:       "Test Device 1",
+				SizeTotal:  1900000,
+				MountPoint: NewMountPoint(t, testTempDir, "mountpoint-1-"),
+			},
+		}
+	}
+	f := &syncTest{t: t,
+		context: placementContext(t, "../../testdata/filesync_freebooks", devices, PlacementDirectory),
+	}
+	f.Run()
+	if t.Failed() {
+		return
+	}
+	if len(f.ctx.SpreadDirectories) != 0 {
+		t.Errorf("EXPECT: No spread directories GOT: %q", f.ctx.SpreadDirectories)
+	}
+	dirs := make(map[string]string)
+	for _, file := range f.ctx.FileIndex {
+		if file.FileType != FILE {
+			continue
+		}
+		if len(file.DestFiles) != 1 {
+			t.Errorf("EXPECT: 1 destination file for %q GOT: %d", file.Path, len(file.DestFiles))
+			continue
+		}
+		d := filepath.Dir(file.Path)
+		if dev, ok := dirs[d]; ok && dev != file.DestFiles[0].DeviceName {
+			t.Errorf("EXPECT: Files of %q on %q GOT: %q", d, dev, file.DestFiles[0].DeviceName)
+		}
+		dirs[d] = file.DestFiles[0].DeviceName
+	}
+}
+
+// TestCatalogPlacementRuleShortfall checks the shortfall of a placement rule that does not fit on its device.
+func TestCatalogPlacementRuleShortfall(t *testing.T) {
+	c := &Context{BackupPath: fakeTestPath, PlacementRules: []PlacementRule{{Match: "raw/**", Device: "Archive"}}}
+	c.Devices.Add(&Device{Name: "Archive", SizeTotal: 1000, MountPoint: fakeTestPath, SizeUsed: 200})
+	c.Devices.Add(&Device{Name: "SSD", SizeTotal: 1000, MountPoint: fakeTestPath})
+	c.FileIndex.Add(&File{Name: "1", Path: path.Join(fakeTestPath, "raw/1"), Size: 500})
+	c.FileIndex.Add(&File{Name: "2", Path: path.Join(fakeTestPath, "raw/2"), Size: 500})
+	err := c.catalog()
+	e, ok := err.(PlacementRuleSizeExceeded)
+	if !ok {
+		t.Fatalf("EXPECT: %T GOT: %v", PlacementRuleSizeExceeded{}, err)
+	}
+	if e.Rule.Match != "raw/**" || e.TotalRuleSize != 1000 || e.TotalDeviceSize != 800 || e.Shortfall != 200 {
+		t.Errorf("EXPECT: Rule %q size 1000 device size 800 shortfall 200 GOT: %+v", "raw/**", e)
+	}
+}
+
+// TestSyncCopies stores two copies of every file. The copies of a file are on distinct devices.
+func TestSyncCopies(t *testing.T) {
+	f := &syncTest{t: t,
+		context: copiesContext(t, "../../testdata/filesync_freebooks", copiesDevices(t), 2),
+	}
+	f.Run()
+	if t.Failed() {
+		return
+	}
+	for _, file := range f.ctx.FileIndex {
+		if file.FileType != FILE {
+			continue
+		}
+		if n := file.Copies(); n != 2 {
+			t.Errorf("EXPECT: 2 copies of %q GOT: %d", file.Path, n)
+		}
+		devs := make(map[string]int)
+		for _, df := range file.DestFiles {
+			if x, ok := devs[df.DeviceName]; ok && x != df.Copy {
+				t.Errorf("EXPECT: Copies of %q on distinct devices GOT: Copy %d and %d on %q", file.Path, x,
+					df.Copy, df.DeviceName)
+			}
+			devs[df.DeviceName] = df.Copy
+		}
+	}
+}
+
+// TestContextCheckSizesCopies expects the size check to count every copy of a file.
+func TestContextCheckSizesCopies(t *testing.T) {
+	c := &Context{BackupPath: fakeTestPath, Copies: 2}
+	c.Devices.Add(&Device{Name: "Device 0", SizeTotal: 100, MountPoint: fakeTestPath})
+	c.Devices.Add(&Device{Name: "Device 1", SizeTotal: 100, MountPoint: fakeTestPath})
+	c.FileIndex.Add(&File{Name: "1", Path: path.Join(fakeTestPath, "1"), Size: 60})
+	c.FileIndex.Add(&File{Name: "2", Path: path.Join(fakeTestPath, "2"), Size: 60})
+	if err, ok := c.checkSizes().(DevicePoolSizeExceeded); !ok || err.TotalIndexSize != 240 {
+		t.Errorf("EXPECT: %T with TotalIndexSize 240 GOT: %v", DevicePoolSizeExceeded{}, c.checkSizes())
+	}
+}
+
+// TestContextBadCopies expects more copies than devices to be rejected.
+func TestContextBadCopies(t *testing.T) {
+	_, err := NewContextFromYaml([]byte(`
+backupPath: /tmp
+copies: 2
+devices:
+  - name: Test Device 0
+    uuid: test-device-0
+    sizeTotal: 1000
+    mountPoint: /mnt/test
+`))
+	if expect := (ContextFileBadCopies{2, 1}); err != expect {
+		t.Errorf("EXPECT: %v GOT: %v", expect, err)
+	}
+}
+
+// TestContextBadPlacementRule checks the placement rules of the configuration.
+func TestContextBadPlacementRule(t *testing.T) {
+	tests := []struct {
+		rule   string
+		reason string
+	}{
+		{`{match: "raw/**", device: "Test Device 1"}`, `device "Test Device 1" does not exist`},
+		{`{match: "raw/**", excludeDevices: ["Test Device 0"]}`, "all devices are excluded"},
+		{`{match: "raw/**"}`, "device, excludeDevices or copies must be defined"},
+		{`{match: "raw/[", device: "Test Device 0"}`, filepath.ErrBadPattern.Error()},
+		{`{match: "raw/**", device: "Test Device 0", copies: 2}`, "2 copies need more than the 1 allowed devices"},
+	}
+	for _, test := range tests {
+		_, err := NewContextFromYaml([]byte(`
+backupPath: /tmp
+placementRules: [` + test.rule + `]
+devices:
+  - name: Test Device 0
+    uuid: test-device-0
+    sizeTotal: 1000
+    mountPoint: /mnt/test
+`))
+		if e, ok := err.(ContextFileBadPlacementRule); !ok || e.Reason != test.reason {
+			t.Errorf("EXPECT: %T %q for %s GOT: %v", ContextFileBadPlacementRule{}, test.reason, test.rule, err)
+		}
+	}
+}
+
+func TestContextBadPlacement(t *testing.T) {
+	_, err := NewContextFromYaml([]byte(`
+backupPath: /tmp
+placement: best-fit
+devices:
+  - name: Test Device 0
+    uuid: test-device-0
+    sizeTotal: 1000
+    mountPoint: /mnt/test
+`))
+	if expect := (ContextFileBadPlacement{"best-fit"}); err != expect {
+		t.Errorf("EXPECT: %v GOT: %v", expect, err)
+	}
+}
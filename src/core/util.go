@@ -2,11 +2,11 @@ package core
 
 import (
 	"crypto/rand"
-	"crypto/sha1"
-	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"unsafe"
 )
@@ -27,23 +27,6 @@ func NewID() (string, error) {
 		uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:]), nil
 }
 
-// sha1sum gets the sha1 hash of filePath using an external hashing tool.
-func sha1sum(filePath string) (hash string, err error) {
-	f, err := os.Open(filePath)
-	if err != nil {
-		err = fmt.Errorf("sha1sum: %s", err.Error())
-		return
-	}
-	sh := sha1.New()
-	_, err = io.Copy(sh, f)
-	if err != nil {
-		err = fmt.Errorf("sha1sum: %s", err.Error())
-		return
-	}
-	hash = hex.EncodeToString(sh.Sum(nil))
-	return
-}
-
 // From https://github.com/docker/docker/blob/master/pkg/system/utimes_linux.go
 func LUtimesNano(path string, ts []syscall.Timespec) error {
 	// These are not currently available in syscall
@@ -64,3 +47,54 @@ func LUtimesNano(path string, ts []syscall.Timespec) error {
 
 	return nil
 }
+
+// openNoAtime opens the file at path for reading without updating its access time. The file is opened normally if the
+// caller does not own it.
+func openNoAtime(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOATIME, 0)
+	if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.EPERM {
+		return os.Open(path)
+	}
+	return f, err
+}
+
+// matchPath reports whether the slash separated path p matches pattern. Each pattern segment is matched using
+// filepath.Match, except for "**" which matches zero or more path segments.
+func matchPath(pattern, p string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(p, "/"))
+}
+
+func matchSegments(pat, seg []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			pat = pat[1:]
+			if len(pat) == 0 {
+				return true
+			}
+			for x := 0; x <= len(seg); x++ {
+				if matchSegments(pat, seg[x:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(seg) == 0 {
+			return false
+		}
+		if ok, err := filepath.Match(pat[0], seg[0]); err != nil || !ok {
+			return false
+		}
+		pat, seg = pat[1:], seg[1:]
+	}
+	return len(seg) == 0
+}
+
+// checkPattern returns filepath.ErrBadPattern if a segment of pattern is malformed.
+func checkPattern(pattern string) error {
+	for _, s := range strings.Split(pattern, "/") {
+		if _, err := filepath.Match(s, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
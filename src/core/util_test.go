@@ -17,8 +17,8 @@ func NewMountPoint(t *testing.T, basePath string, prefix string) string {
 	return p
 }
 
-func TestSha1Sum(t *testing.T) {
-	_, err := sha1sum("/root")
+func TestFileSum(t *testing.T) {
+	_, err := fileSum(HashSHA1, "/root")
 	if err == nil {
 		t.Error("EXPECT: error permission denied GOT: No errors")
 	}
@@ -42,3 +42,30 @@ func TestLUtimesNano(t *testing.T) {
 		t.Errorf("Expect: Error Got: %q", err)
 	}
 }
+
+func TestMatchPath(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		expect  bool
+	}{
+		{"photos/2015/**", "photos/2015", true},
+		{"photos/2015/**", "photos/2015/jan/img.jpg", true},
+		{"photos/2015/**", "photos/2016/img.jpg", false},
+		{"photos/*/img.jpg", "photos/2015/img.jpg", true},
+		{"photos/*/img.jpg", "photos/2015/jan/img.jpg", false},
+		{"**/*.jpg", "img.jpg", true},
+		{"**/*.jpg", "photos/2015/img.jpg", true},
+		{"photos/**/img.jpg", "photos/img.jpg", true},
+		{"photos/**/img.jpg", "photos/2015/jan/img.jpg", true},
+		{"photos", "photos/img.jpg", false},
+	}
+	for _, x := range tests {
+		if got := matchPath(x.pattern, x.path); got != x.expect {
+			t.Errorf("matchPath(%q, %q) EXPECT: %t GOT: %t", x.pattern, x.path, x.expect, got)
+		}
+	}
+	if err := checkPattern("photos/[2015"); err == nil {
+		t.Error("EXPECT: Bad pattern error GOT: nil")
+	}
+}
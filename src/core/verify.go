@@ -0,0 +1,274 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// VerifyDestFileMissingError is given when a destination file recorded in the sync context is not found on the device.
+type VerifyDestFileMissingError struct {
+	FilePath string
+	DestPath string
+}
+
+// Error implements the Error interface.
+func (e VerifyDestFileMissingError) Error() string {
+	return fmt.Sprintf("Destination file %q of %q is missing", e.DestPath, e.FilePath)
+}
+
+// VerifyDestFileSizeError is given when the size of a destination file on the device does not match the size recorded in the
+// sync context. A smaller file has been truncated.
+type VerifyDestFileSizeError struct {
+	FilePath   string
+	DestPath   string
+	ExpectSize uint64
+	GotSize    uint64
+}
+
+// Error implements the Error interface.
+func (e VerifyDestFileSizeError) Error() string {
+	if e.GotSize < e.ExpectSize {
+		return fmt.Sprintf("Destination file %q of %q is truncated: expect_size=%d got=%d", e.DestPath, e.FilePath,
+			e.ExpectSize, e.GotSize)
+	}
+	return fmt.Sprintf("Destination file %q of %q size mismatch: expect_size=%d got=%d", e.DestPath, e.FilePath,
+		e.ExpectSize, e.GotSize)
+}
+
+// VerifyDestFileTimeError is given when the modification time of a destination file on the device does not match the
+// modification time recorded in the sync context, to the nanosecond. The data of the file may still be intact. The access
+// time is not compared, it changes whenever the destination file is read.
+type VerifyDestFileTimeError struct {
+	FilePath      string
+	DestPath      string
+	ExpectModTime time.Time
+	GotModTime    time.Time
+}
+
+// Error implements the Error interface.
+func (e VerifyDestFileTimeError) Error() string {
+	return fmt.Sprintf("Destination file %q of %q modification time drift: expect_time=%s got=%s", e.DestPath, e.FilePath,
+		e.ExpectModTime.Format(time.RFC3339Nano), e.GotModTime.Format(time.RFC3339Nano))
+}
+
+// VerifyDeviceReport contains the results of verifying the destination files stored on one device.
+type VerifyDeviceReport struct {
+	DeviceName string
+	Checked    int // Number of destination files checked
+	Missing    int
+	Truncated  int // Number of destination files with the wrong size
+	Mismatched int // Number of destination files with the wrong sum
+	Drifted    int // Number of destination files with the wrong modification time
+	Errors     []error
+
+	// The destination files with the wrong modification time. Their data is checked, drift does not fail the device.
+	Drifts []VerifyDestFileTimeError
+}
+
+// Failed returns true if any of the destination files on the device could not be verified. Modification time drift is
+// not a failure.
+func (r *VerifyDeviceReport) Failed() bool {
+	return len(r.Errors) > 0
+}
+
+// verifyCheck is a destination file being verified.
+type verifyCheck struct {
+	d      *destFileData
+	sum    string // The sum of the destination file
+	expect string // The expected sum
+}
+
+// Verifier reads the destination files recorded in a sync context back from the devices and checks them against the sums
+// recorded in the context.
+type Verifier struct {
+	ctx    *Context
+	source bool
+
+	// Reports receives the hashing progress of the destination files. It is closed once all devices are verified.
+	Reports chan HashFile
+
+	// Devices contains the report for each verified device.
+	Devices []*VerifyDeviceReport
+
+	damaged map[*DestFile]bool // The missing, truncated, corrupt and unreadable destination files
+}
+
+// NewVerifier returns a verifier for the destination files of a sync context loaded with SyncContextFromPath. If source is
+// true, the destination files are compared to the byte ranges of the source files instead of the recorded sums.
+func NewVerifier(c *Context, source bool) *Verifier {
+	return &Verifier{ctx: c, source: source, Reports: make(chan HashFile), damaged: make(map[*DestFile]bool)}
+}
+
+// Failed returns true if any of the verified devices failed.
+func (v *Verifier) Failed() bool {
+	for _, r := range v.Devices {
+		if r.Failed() {
+			return true
+		}
+	}
+	return false
+}
+
+// SizeTotal returns the number of bytes that will be hashed to verify the devices.
+func (v *Verifier) SizeTotal() (size uint64) {
+	for _, x := range v.ctx.FileDevices(v.ctx.FileIndex) {
+		for _, d := range v.ctx.FileIndex.DeviceFiles(v.ctx.Devices[x]) {
+			if d.f.FileType == FILE {
+				size += d.df.Size
+			}
+		}
+	}
+	if v.source {
+		size *= 2
+	}
+	return
+}
+
+// prepare checks the existence and size of the destination files on the device. The files that can be hashed are returned.
+func (v *Verifier) prepare(device *Device, report *VerifyDeviceReport) ([]*verifyCheck, []HashFile) {
+	var checks []*verifyCheck
+	var files []HashFile
+	for _, d := range v.ctx.FileIndex.DeviceFiles(device) {
+		if d.f.FileType != FILE {
+			continue
+		}
+		report.Checked++
+		fi, err := os.Lstat(d.df.Path)
+		if os.IsNotExist(err) {
+			report.Missing++
+			report.Errors = append(report.Errors, VerifyDestFileMissingError{d.f.Path, d.df.Path})
+			v.damaged[d.df] = true
+			continue
+		} else if err != nil {
+			report.Errors = append(report.Errors, err)
+			v.damaged[d.df] = true
+			continue
+		}
+		if uint64(fi.Size()) != d.df.Size {
+			report.Truncated++
+			v.damaged[d.df] = true
+			report.Errors = append(report.Errors,
+				VerifyDestFileSizeError{d.f.Path, d.df.Path, d.df.Size, uint64(fi.Size())})
+			continue
+		}
+		if !fi.ModTime().Equal(d.f.ModTime) {
+			report.Drifted++
+			report.Drifts = append(report.Drifts,
+				VerifyDestFileTimeError{d.f.Path, d.df.Path, d.f.ModTime, fi.ModTime()})
+		}
+		vc := &verifyCheck{d: d, expect: d.df.Sum}
+		if vc.expect == "" && !d.f.IsSplit() {
+			vc.expect = d.f.Sum
+		}
+		files = append(files, NewHashFile(d.f.Name, d.df.Path, 0, d.df.Size, false, &vc.sum))
+		if v.source {
+			// The part of the source file stored in the destination file
+			vc.expect = ""
+			files = append(files, NewHashFile(d.f.Name, d.f.Path, d.df.StartByte, d.df.Size, true, &vc.expect))
+		}
+		checks = append(checks, vc)
+	}
+	return checks, files
+}
+
+// verifyDevice hashes the destination files stored on device and compares the sums.
+func (v *Verifier) verifyDevice(device *Device) *VerifyDeviceReport {
+	Log.WithFields(logrus.Fields{"device": device.Name}).Infoln("Verifying device")
+	report := &VerifyDeviceReport{DeviceName: device.Name}
+	checks, files := v.prepare(device, report)
+
+	errs := make(chan error)
+	h := NewHashComputer(v.ctx.HashAlgorithm, files, errs)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for hf := range h.Reports {
+			v.Reports <- hf
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for err := range errs {
+			report.Errors = append(report.Errors, err)
+			v.ctx.Errors <- err
+		}
+	}()
+	h.ComputeAll(v.ctx.Done)
+	close(errs)
+	wg.Wait()
+
+	for _, vc := range checks {
+		if vc.sum == "" || vc.expect == "" {
+			Log.WithFields(logrus.Fields{"destFile": vc.d.df.Path}).Warnln("Could not compare sum")
+			if vc.sum == "" {
+				// The destination file could not be read
+				v.damaged[vc.d.df] = true
+			}
+			continue
+		}
+		if vc.sum != vc.expect {
+			v.damaged[vc.d.df] = true
+			report.Mismatched++
+			report.Errors = append(report.Errors, BadDestPathSum{vc.expect, vc.sum, vc.d.df.Path})
+		}
+	}
+	Log.WithFields(logrus.Fields{
+		"device": device.Name, "checked": report.Checked, "missing": report.Missing,
+		"truncated": report.Truncated, "mismatched": report.Mismatched, "drifted": report.Drifted,
+	}).Infoln("Verify device complete")
+	return report
+}
+
+// DamagedFiles returns the files with a missing or corrupt destination file on the verified devices. A file is recoverable
+// if every damaged byte is stored by a destination file of another copy that is not damaged. Restore uses the other copies
+// for the damaged bytes. The bytes of the lost files are not stored by any good destination file.
+func (v *Verifier) DamagedFiles() (recoverable, lost FileIndex) {
+	verified := make(map[string]bool)
+	for _, r := range v.Devices {
+		verified[r.DeviceName] = true
+	}
+	for _, f := range v.ctx.FileIndex {
+		var damaged bool
+		var good []byteRange
+		for _, df := range f.DestFiles {
+			if v.damaged[df] {
+				damaged = true
+			} else if verified[df.DeviceName] {
+				good = addRange(good, byteRange{df.StartByte, df.EndByte})
+			}
+		}
+		if !damaged {
+			continue
+		}
+		if len(good) > 0 && len(missingRanges(good, byteRange{0, f.Size})) == 0 {
+			recoverable.Add(f)
+		} else {
+			lost.Add(f)
+		}
+	}
+	return
+}
+
+// Run verifies each device that contains destination files. The devices are requested on the SyncDeviceMount channels one at
+// a time in device order.
+func (v *Verifier) Run() {
+	c := v.ctx
+outer:
+	for _, index := range c.FileDevices(c.FileIndex) {
+		// ENSURE DEVICE IS MOUNTED
+		c.SyncDeviceMount[index] <- true
+		<-c.SyncDeviceMount[index]
+		v.Devices = append(v.Devices, v.verifyDevice(c.Devices[index]))
+		select {
+		case <-c.Done:
+			break outer
+		default:
+		}
+	}
+	close(v.Reports)
+}
@@ -0,0 +1,301 @@
+package core
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// verifyTest verifies the devices of a completed sync test using the sync context saved to the last device.
+type verifyTest struct {
+	t      *testing.T
+	sync   *syncTest
+	source bool
+
+	// If set, called with the loaded sync context before verifying
+	beforeVerify func(c *Context)
+
+	expectErrors  func() []error // Errors expected to be sent on the context error channel
+	expectReports []VerifyDeviceReport
+}
+
+func (v *verifyTest) Run() *Verifier {
+	v.sync.saveSyncContext = true
+	v.sync.Run()
+	if v.t.Failed() {
+		return nil
+	}
+	c := v.sync.loadSyncContext()
+	if v.beforeVerify != nil {
+		v.beforeVerify(c)
+	}
+
+	s := &syncTest{t: v.t, ctx: c, expectErrors: v.expectErrors}
+	s.errorCollector()
+
+	for _, x := range c.FileDevices(c.FileIndex) {
+		c.SyncDeviceMount[x] = make(chan bool)
+		go func(index int) {
+			<-c.SyncDeviceMount[index]
+			c.SyncDeviceMount[index] <- true
+		}(x)
+	}
+	vr := NewVerifier(c, v.source)
+	go func() {
+		for range vr.Reports {
+		}
+	}()
+	vr.Run()
+	s.checkErrors()
+
+	if len(vr.Devices) != len(v.expectReports) {
+		v.t.Fatalf("EXPECT: %d device reports GOT: %d", len(v.expectReports), len(vr.Devices))
+	}
+	for x, r := range vr.Devices {
+		e := v.expectReports[x]
+		if r.DeviceName != e.DeviceName || r.Checked != e.Checked || r.Missing != e.Missing ||
+			r.Truncated != e.Truncated || r.Mismatched != e.Mismatched {
+			v.t.Errorf("EXPECT: Report %+v GOT: %+v", e, *r)
+		}
+		if len(r.Errors) != len(e.Errors) {
+			v.t.Errorf("EXPECT: %d errors for %q GOT: %d (%v)", len(e.Errors), r.DeviceName, len(r.Errors),
+				r.Errors)
+			continue
+		}
+		for y, err := range r.Errors {
+			if reflect.TypeOf(err) != reflect.TypeOf(e.Errors[y]) {
+				v.t.Errorf("EXPECT: Error type %T GOT: %T (%s)", e.Errors[y], err, err)
+			}
+		}
+	}
+	var failed bool
+	for _, e := range v.expectReports {
+		failed = failed || len(e.Errors) > 0
+	}
+	if vr.Failed() != failed {
+		v.t.Errorf("EXPECT: Failed() == %t GOT: %t", failed, vr.Failed())
+	}
+	return vr
+}
+
+// splitDevices returns two devices that the freebooks test data is split across.
+func splitDevices(t *testing.T) func() DeviceList {
+	return func() DeviceList {
+		return DeviceList{
+			&Device{
+				Name:       "Test Device 0",
+				SizeTotal:  1493583,
+				MountPoint: NewMountPoint(t, testTempDir, "mountpoint-0-"),
+			},
+			&Device{
+				Name:       "Test Device 1",
+				SizeTotal:  1020000,
+				MountPoint: NewMountPoint(t, testTempDir, "mountpoint-1-"),
+			},
+		}
+	}
+}
+
+// copiesDevices returns three devices that hold two copies of the freebooks test data. The first copy is split across the
+// first two devices like with splitDevices.
+func copiesDevices(t *testing.T) func() DeviceList {
+	return func() DeviceList {
+		devices := splitDevices(t)()
+		return append(devices, &Device{
+			Name:       "Test Device 2",
+			SizeTotal:  2600000,
+			MountPoint: NewMountPoint(t, testTempDir, "mountpoint-2-"),
+		})
+	}
+}
+
+// modifyDestFile calls fn with the first destination file stored on the named device of a regular file that is at least
+// 1KiB.
+func modifyDestFile(t *testing.T, c *Context, device string, fn func(df *DestFile)) {
+	for _, f := range c.FileIndex {
+		if f.FileType != FILE || f.Size < 1024 {
+			continue
+		}
+		for _, df := range f.DestFiles {
+			if df.DeviceName == device {
+				fn(df)
+				return
+			}
+		}
+	}
+	t.Fatalf("No destination file found on %q", device)
+}
+
+func TestVerifyFileSplitAcrossDevices(t *testing.T) {
+	v := &verifyTest{t: t,
+		sync: &syncTest{t: t,
+			backupPath: "../../testdata/filesync_freebooks",
+			deviceList: splitDevices(t),
+		},
+		expectReports: []VerifyDeviceReport{
+			{DeviceName: "Test Device 0", Checked: 3},
+			{DeviceName: "Test Device 1", Checked: 1},
+		},
+	}
+	v.Run()
+}
+
+func TestVerifySource(t *testing.T) {
+	v := &verifyTest{t: t,
+		sync: &syncTest{t: t,
+			backupPath: "../../testdata/filesync_freebooks",
+			deviceList: splitDevices(t),
+		},
+		source: true,
+		expectReports: []VerifyDeviceReport{
+			{DeviceName: "Test Device 0", Checked: 3},
+			{DeviceName: "Test Device 1", Checked: 1},
+		},
+	}
+	v.Run()
+}
+
+func TestVerifyMissingDestFile(t *testing.T) {
+	v := &verifyTest{t: t,
+		sync: &syncTest{t: t,
+			backupPath: "../../testdata/filesync_freebooks",
+			deviceList: splitDevices(t),
+		},
+		beforeVerify: func(c *Context) {
+			modifyDestFile(t, c, "Test Device 1", func(df *DestFile) {
+				if err := os.Remove(df.Path); err != nil {
+					t.Fatal(err)
+				}
+			})
+		},
+		expectReports: []VerifyDeviceReport{
+			{DeviceName: "Test Device 0", Checked: 3},
+			{DeviceName: "Test Device 1", Checked: 1, Missing: 1,
+				Errors: []error{VerifyDestFileMissingError{}}},
+		},
+	}
+	v.Run()
+}
+
+func TestVerifyTruncatedDestFile(t *testing.T) {
+	v := &verifyTest{t: t,
+		sync: &syncTest{t: t,
+			backupPath: "../../testdata/filesync_freebooks",
+			deviceList: splitDevices(t),
+		},
+		beforeVerify: func(c *Context) {
+			modifyDestFile(t, c, "Test Device 0", func(df *DestFile) {
+				if err := os.Truncate(df.Path, int64(df.Size/2)); err != nil {
+					t.Fatal(err)
+				}
+			})
+		},
+		expectReports: []VerifyDeviceReport{
+			{DeviceName: "Test Device 0", Checked: 3, Truncated: 1,
+				Errors: []error{VerifyDestFileSizeError{}}},
+			{DeviceName: "Test Device 1", Checked: 1},
+		},
+	}
+	v.Run()
+}
+
+func TestVerifyCorruptDestFile(t *testing.T) {
+	v := &verifyTest{t: t,
+		sync: &syncTest{t: t,
+			backupPath: "../../testdata/filesync_freebooks",
+			deviceList: splitDevices(t),
+		},
+		beforeVerify: func(c *Context) {
+			modifyDestFile(t, c, "Test Device 0", func(df *DestFile) {
+				f, err := os.OpenFile(df.Path, os.O_WRONLY, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				f.WriteAt([]byte("gds"), 0)
+				f.Close()
+			})
+		},
+		expectReports: []VerifyDeviceReport{
+			{DeviceName: "Test Device 0", Checked: 3, Mismatched: 1,
+				Errors: []error{BadDestPathSum{}}},
+			{DeviceName: "Test Device 1", Checked: 1},
+		},
+	}
+	v.Run()
+}
+
+// TestVerifyDestFileTime expects a destination file with a different modification time to be reported as drifted, but not
+// damaged. The device does not fail.
+func TestVerifyDestFileTime(t *testing.T) {
+	v := &verifyTest{t: t,
+		sync: &syncTest{t: t,
+			backupPath: "../../testdata/filesync_freebooks",
+			deviceList: splitDevices(t),
+		},
+		beforeVerify: func(c *Context) {
+			modifyDestFile(t, c, "Test Device 1", func(df *DestFile) {
+				fi, err := os.Stat(df.Path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				mt := fi.ModTime().Add(time.Nanosecond)
+				if err := os.Chtimes(df.Path, mt, mt); err != nil {
+					t.Fatal(err)
+				}
+			})
+		},
+		expectReports: []VerifyDeviceReport{
+			{DeviceName: "Test Device 0", Checked: 3},
+			{DeviceName: "Test Device 1", Checked: 1},
+		},
+	}
+	vr := v.Run()
+	if t.Failed() {
+		return
+	}
+	if r := vr.Devices[1]; r.Drifted != 1 || len(r.Drifts) != 1 || r.Failed() {
+		t.Errorf("EXPECT: 1 drifted destination file without failing GOT: %+v", *r)
+	}
+	if recoverable, lost := vr.DamagedFiles(); len(recoverable) != 0 || len(lost) != 0 {
+		t.Errorf("EXPECT: No damaged files GOT: %d recoverable %d lost", len(recoverable), len(lost))
+	}
+}
+
+// TestVerifyCopies corrupts the first copy of a file. The file can be restored from its second copy.
+func TestVerifyCopies(t *testing.T) {
+	var corrupt string
+	v := &verifyTest{t: t,
+		sync: &syncTest{t: t,
+			context: copiesContext(t, "../../testdata/filesync_freebooks", copiesDevices(t), 2),
+		},
+		beforeVerify: func(c *Context) {
+			modifyDestFile(t, c, "Test Device 0", func(df *DestFile) {
+				f, err := os.OpenFile(df.Path, os.O_WRONLY, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				f.WriteAt([]byte("gds"), 0)
+				f.Close()
+				corrupt = df.Path
+			})
+		},
+		expectReports: []VerifyDeviceReport{
+			{DeviceName: "Test Device 0", Checked: 3, Mismatched: 1,
+				Errors: []error{BadDestPathSum{}}},
+			{DeviceName: "Test Device 1", Checked: 2},
+			{DeviceName: "Test Device 2", Checked: 2},
+		},
+	}
+	vr := v.Run()
+	if t.Failed() {
+		return
+	}
+	recoverable, lost := vr.DamagedFiles()
+	if len(recoverable) != 1 || len(lost) != 0 {
+		t.Fatalf("EXPECT: 1 recoverable and 0 lost files GOT: %d recoverable %d lost", len(recoverable), len(lost))
+	}
+	if recoverable[0].DestFiles[0].Path != corrupt {
+		t.Errorf("EXPECT: %q recoverable GOT: %q", corrupt, recoverable[0].DestFiles[0].Path)
+	}
+}
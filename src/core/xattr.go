@@ -0,0 +1,142 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// XattrError is given when an extended attribute of a file could not be read or set. POSIX ACLs and SELinux labels are
+// extended attributes as well. The error is not fatal, the file itself is synced or restored.
+type XattrError struct {
+	Op   string // "list", "get", "set" or "remove"
+	Path string
+	Name string // Empty if the attributes of the file could not be listed
+	Err  error
+}
+
+// Error implements the Error interface.
+func (e XattrError) Error() string {
+	if e.Name == "" {
+		return fmt.Sprintf("Could not %s the extended attributes of %q: %s", e.Op, e.Path, e.Err)
+	}
+	return fmt.Sprintf("Could not %s extended attribute %q of %q: %s", e.Op, e.Name, e.Path, e.Err)
+}
+
+// The extended attribute of the SELinux label.
+const selinuxXattr = "security.selinux"
+
+var (
+	// Reads an extended attribute. Used for testing.
+	getxattr = syscall.Getxattr
+)
+
+// xattrUnsupported returns true if err means the file system does not support the extended attribute.
+func xattrUnsupported(err error) bool {
+	return err == syscall.ENOTSUP || err == syscall.EOPNOTSUPP
+}
+
+// listXattrs returns the names of the extended attributes of the file at p. Nil is returned if the file has no
+// attributes or the file system does not support them.
+func listXattrs(p string) ([]string, error) {
+	size, err := syscall.Listxattr(p, nil)
+	if xattrUnsupported(err) || size == 0 {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	list := make([]byte, size)
+	if size, err = syscall.Listxattr(p, list); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range bytes.Split(list[:size], []byte{0}) {
+		if len(name) > 0 {
+			names = append(names, string(name))
+		}
+	}
+	return names, nil
+}
+
+// readXattrs returns the extended attributes of the file at p by name. Nil is returned if the file has no attributes or
+// the file system does not support them. An attribute that can not be read is left out and an error is returned for it,
+// the other attributes are still returned.
+func readXattrs(p string) (map[string][]byte, []XattrError) {
+	names, err := listXattrs(p)
+	if err != nil {
+		return nil, []XattrError{{"list", p, "", err}}
+	}
+	var xattrs map[string][]byte
+	var errs []XattrError
+	for _, n := range names {
+		size, err := getxattr(p, n, nil)
+		if err != nil {
+			errs = append(errs, XattrError{"get", p, n, err})
+			continue
+		}
+		value := make([]byte, size)
+		if size, err = getxattr(p, n, value); err != nil {
+			errs = append(errs, XattrError{"get", p, n, err})
+			continue
+		}
+		if xattrs == nil {
+			xattrs = make(map[string][]byte)
+		}
+		xattrs[n] = value[:size]
+	}
+	return xattrs, errs
+}
+
+// setXattrs sets the extended attributes xattrs on the file at p in name order, except for the names in skip. The other
+// attributes of the file are removed, so a removed ACL or user attribute of the source file is removed from the copy as
+// well. The SELinux label is kept, it is given to the file by the policy of the system it is written on. An error is
+// returned for each attribute that could not be set or removed.
+func setXattrs(p string, xattrs map[string][]byte, skip map[string]bool) []XattrError {
+	var errs []XattrError
+	current, err := listXattrs(p)
+	if err != nil {
+		errs = append(errs, XattrError{"list", p, "", err})
+	}
+	for _, n := range current {
+		if _, ok := xattrs[n]; ok || skip[n] || n == selinuxXattr {
+			continue
+		}
+		if err := syscall.Removexattr(p, n); err != nil {
+			errs = append(errs, XattrError{"remove", p, n, err})
+		}
+	}
+	var names []string
+	for n := range xattrs {
+		if !skip[n] {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		if err := syscall.Setxattr(p, n, xattrs[n], 0); err != nil {
+			errs = append(errs, XattrError{"set", p, n, err})
+		}
+	}
+	return errs
+}
+
+// setDestXattrs sets the extended attributes of f on the file at p on the device and removes the others. An attribute
+// the file system of the device does not support is skipped for the other files of the device.
+func (c *Context) setDestXattrs(device *Device, p string, f *File) {
+	for _, err := range setXattrs(p, f.Xattrs, device.xattrsUnsupported) {
+		if xattrUnsupported(err.Err) {
+			Log.WithFields(logrus.Fields{
+				"device": device.Name, "xattr": err.Name,
+			}).Warnln("Extended attribute is not supported by the device")
+			if device.xattrsUnsupported == nil {
+				device.xattrsUnsupported = make(map[string]bool)
+			}
+			device.xattrsUnsupported[err.Name] = true
+			continue
+		}
+		c.Errors <- err
+	}
+}
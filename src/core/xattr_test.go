@@ -0,0 +1,199 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+// setTestXattr sets the extended attribute "user.gds.test" of the file at p to value. The test is skipped if the file system
+// does not support extended attributes.
+func setTestXattr(t *testing.T, p, value string) {
+	if err := syscall.Setxattr(p, "user.gds.test", []byte(value), 0); xattrUnsupported(err) || err == syscall.EPERM {
+		t.Skipf("File system does not support user extended attributes: %s", err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expectTestXattr expects the extended attribute "user.gds.test" of the file at p to be value.
+func expectTestXattr(t *testing.T, p, value string) {
+	b := make([]byte, 256)
+	n, err := syscall.Getxattr(p, "user.gds.test", b)
+	if err != nil || string(b[:n]) != value {
+		t.Errorf("EXPECT: Extended attribute user.gds.test=%q on %q GOT: %q (%v)", value, p, b[:n], err)
+	}
+}
+
+// TestRestoreXattrs expects the extended attributes of files and directories to be recorded in the context, set on the
+// destination files, and restored.
+func TestRestoreXattrs(t *testing.T) {
+	src := NewMountPoint(t, testTempDir, "source-")
+	if err := os.Mkdir(filepath.Join(src, "dir"), 0775); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "dir", "a"), []byte("extended"), 0664); err != nil {
+		t.Fatal(err)
+	}
+	setTestXattr(t, filepath.Join(src, "dir", "a"), "file")
+	setTestXattr(t, filepath.Join(src, "dir"), "directory")
+
+	r := &restoreTest{t: t,
+		sync: &syncTest{t: t,
+			backupPath: src + "/",
+			deviceList: func() DeviceList {
+				return DeviceList{
+					&Device{
+						Name:       "Test Device 0",
+						SizeTotal:  28173338480,
+						MountPoint: NewMountPoint(t, testTempDir, "mountpoint-0-"),
+					},
+				}
+			},
+		},
+	}
+	r.Run()
+	if t.Failed() {
+		return
+	}
+	f, err := r.ctx.FileIndex.FileByName("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := map[string][]byte{"user.gds.test": []byte("file")}; !reflect.DeepEqual(f.Xattrs, expect) {
+		t.Errorf("EXPECT: Extended attributes %q GOT: %q", expect, f.Xattrs)
+	}
+	expectTestXattr(t, f.DestFiles[0].Path, "file")
+	for _, n := range []string{"dir", "dir/a"} {
+		rel, err := r.ctx.relPath(filepath.Join(src, n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := "file"
+		if n == "dir" {
+			expect = "directory"
+		}
+		expectTestXattr(t, filepath.Join(r.target, rel), expect)
+	}
+}
+
+// TestSyncIncrementalXattrs expects a changed extended attribute to be set on the destination file without copying the
+// file again.
+func TestSyncIncrementalXattrs(t *testing.T) {
+	name := "alice/alice_in_wonderland_by_lewis_carroll_gutenberg.org.htm"
+	i := &incrementalTest{t: t,
+		backupPath: "../../testdata/filesync_freebooks",
+		deviceList: splitDevices(t),
+		change: func(src string) {
+			setTestXattr(t, filepath.Join(src, name), "changed")
+		},
+	}
+	i.Run()
+	if t.Failed() {
+		return
+	}
+	f, err := i.second.ctx.FileIndex.FileByName(filepath.Base(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Kept || !f.MetaChanged {
+		t.Errorf("EXPECT: Only the metadata of %q changed GOT: kept %t metaChanged %t", f.Path, f.Kept, f.MetaChanged)
+	}
+	for _, df := range f.DestFiles {
+		expectTestXattr(t, df.Path, "changed")
+	}
+}
+
+// TestSetXattrsError expects the attributes that can not be listed or set to be reported with XattrError.
+func TestSetXattrsError(t *testing.T) {
+	p := filepath.Join(testTempDir, "no-such-file")
+	errs := setXattrs(p, map[string][]byte{"user.a": []byte("a"), "user.b": []byte("b")}, map[string]bool{"user.b": true})
+	expect := []XattrError{{"list", p, "", syscall.ENOENT}, {"set", p, "user.a", syscall.ENOENT}}
+	if !reflect.DeepEqual(errs, expect) {
+		t.Errorf("EXPECT: %v GOT: %v", expect, errs)
+	}
+}
+
+// TestReadXattrsError expects an attribute that can not be read to be reported with XattrError and the other attributes
+// to be returned.
+func TestReadXattrsError(t *testing.T) {
+	p := filepath.Join(NewMountPoint(t, testTempDir, "xattr-"), "a")
+	if err := ioutil.WriteFile(p, []byte("extended"), 0664); err != nil {
+		t.Fatal(err)
+	}
+	setTestXattr(t, p, "file")
+	if err := syscall.Setxattr(p, "user.gds.other", []byte("other"), 0); err != nil {
+		t.Fatal(err)
+	}
+	getxattr = func(p, n string, dest []byte) (int, error) {
+		if n == "user.gds.other" {
+			return 0, syscall.EIO
+		}
+		return syscall.Getxattr(p, n, dest)
+	}
+	defer func() { getxattr = syscall.Getxattr }()
+	xattrs, errs := readXattrs(p)
+	if expect := map[string][]byte{"user.gds.test": []byte("file")}; !reflect.DeepEqual(xattrs, expect) {
+		t.Errorf("EXPECT: Extended attributes %q GOT: %q", expect, xattrs)
+	}
+	if expect := []XattrError{{"get", p, "user.gds.other", syscall.EIO}}; !reflect.DeepEqual(errs, expect) {
+		t.Errorf("EXPECT: %v GOT: %v", expect, errs)
+	}
+}
+
+// TestSetXattrsRemove expects the attributes of the file that are not set to be removed.
+func TestSetXattrsRemove(t *testing.T) {
+	p := filepath.Join(NewMountPoint(t, testTempDir, "xattr-"), "a")
+	if err := ioutil.WriteFile(p, []byte("extended"), 0664); err != nil {
+		t.Fatal(err)
+	}
+	setTestXattr(t, p, "file")
+	if err := syscall.Setxattr(p, "user.gds.stale", []byte("stale"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if errs := setXattrs(p, map[string][]byte{"user.gds.test": []byte("set")}, nil); len(errs) != 0 {
+		t.Errorf("EXPECT: No errors GOT: %v", errs)
+	}
+	expectTestXattr(t, p, "set")
+	if _, err := syscall.Getxattr(p, "user.gds.stale", nil); err != syscall.ENODATA {
+		t.Errorf("EXPECT: Extended attribute user.gds.stale removed GOT: %v", err)
+	}
+}
+
+// TestSyncIncrementalRemovedXattr expects an extended attribute removed from the source file to be removed from the
+// destination files without copying the file again.
+func TestSyncIncrementalRemovedXattr(t *testing.T) {
+	src := NewMountPoint(t, testTempDir, "source-")
+	if err := ioutil.WriteFile(filepath.Join(src, "a"), []byte("extended"), 0664); err != nil {
+		t.Fatal(err)
+	}
+	setTestXattr(t, filepath.Join(src, "a"), "removed")
+	i := &incrementalTest{t: t,
+		backupPath: src,
+		deviceList: splitDevices(t),
+		change: func(src string) {
+			if err := syscall.Removexattr(filepath.Join(src, "a"), "user.gds.test"); err != nil {
+				t.Fatal(err)
+			}
+		},
+	}
+	i.Run()
+	if t.Failed() {
+		return
+	}
+	f, err := i.second.ctx.FileIndex.FileByName("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Kept || !f.MetaChanged {
+		t.Errorf("EXPECT: Only the metadata of %q changed GOT: kept %t metaChanged %t", f.Path, f.Kept, f.MetaChanged)
+	}
+	for _, df := range f.DestFiles {
+		if _, err := syscall.Getxattr(df.Path, "user.gds.test", nil); err != syscall.ENODATA {
+			t.Errorf("EXPECT: Extended attribute user.gds.test removed from %q GOT: %v", df.Path, err)
+		}
+	}
+}